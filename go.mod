@@ -3,6 +3,7 @@ module github.com/corazawaf/coraza-proxy-wasm
 go 1.23.8
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/corazawaf/coraza-wasilibs v0.2.0
 	github.com/corazawaf/coraza/v3 v3.3.3
 	github.com/stretchr/testify v1.10.0
@@ -0,0 +1,83 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// Attribute is a proxy attribute of the transaction, e.g. the route name, enriching the
+// audit logs.
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+var attributesLookup func(txID string) []Attribute
+
+// SetAttributesLookup sets the function returning the proxy attributes of a transaction,
+// added to the audit logs of all the writers registered by this package. JSON entries get them
+// under an "envoy" object, the CEF and RFC 5424 entries as a custom string and a structured data
+// element respectively. A nil lookup disables the enrichment.
+func SetAttributesLookup(lookup func(txID string) []Attribute) {
+	attributesLookup = lookup
+}
+
+func lookupAttributes(tx plugintypes.AuditLogTransaction) []Attribute {
+	if attributesLookup == nil {
+		return nil
+	}
+	return attributesLookup(tx.ID())
+}
+
+// formatEntry formats the audit log redacted and enriched with the proxy attributes.
+func formatEntry(formatter plugintypes.AuditLogFormatter, al plugintypes.AuditLog) ([]byte, error) {
+	bts, err := formatRedacted(formatter, al)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := lookupAttributes(al.Transaction())
+	if len(attributes) == 0 {
+		return bts, nil
+	}
+	return addJSONAttributes(bts, attributes), nil
+}
+
+// addJSONAttributes adds the attributes to the entry under an "envoy" object if the entry is
+// a JSON object. Other entries are returned as they are, the CEF and RFC 5424 formatters adding
+// the attributes themselves.
+func addJSONAttributes(entry []byte, attributes []Attribute) []byte {
+	trimmed := bytes.TrimSpace(entry)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return entry
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"envoy":{`)
+	for i, attr := range attributes {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(attr.Name)
+		value, _ := json.Marshal(attr.Value)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+
+	rest := bytes.TrimSpace(trimmed[1:])
+	if rest[0] != '}' {
+		b.WriteByte(',')
+	}
+	b.Write(rest)
+	if bytes.HasSuffix(entry, []byte{'\n'}) {
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,31 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddJSONAttributes(t *testing.T) {
+	attributes := []Attribute{{Name: "xds.route_name", Value: "hello"}, {Name: "node.id", Value: `"quoted"`}}
+
+	testCases := map[string]struct {
+		entry    string
+		expected string
+	}{
+		"object":         {entry: `{"transaction":{}}`, expected: `{"envoy":{"xds.route_name":"hello","node.id":"\"quoted\""},"transaction":{}}`},
+		"empty object":   {entry: "{}\n", expected: `{"envoy":{"xds.route_name":"hello","node.id":"\"quoted\""}}` + "\n"},
+		"not an object":  {entry: `["a"]`, expected: `["a"]`},
+		"not json":       {entry: "CEF:0|OWASP|Coraza|", expected: "CEF:0|OWASP|Coraza|"},
+		"truncated json": {entry: `{"transaction":`, expected: `{"transaction":`},
+	}
+
+	for name, tCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tCase.expected, string(addJSONAttributes([]byte(tCase.entry), attributes)))
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+// cefFormatter formats the audit logs as ArcSight Common Event Format events, one line per
+// transaction. The signature of the event is the matched rule with the highest severity.
+type cefFormatter struct{}
+
+// cefSeverities maps the severity of the rules to the CEF severity, from 0 to 10.
+var cefSeverities = map[ctypes.RuleSeverity]int{
+	ctypes.RuleSeverityEmergency: 10,
+	ctypes.RuleSeverityAlert:     10,
+	ctypes.RuleSeverityCritical:  9,
+	ctypes.RuleSeverityError:     7,
+	ctypes.RuleSeverityWarning:   5,
+	ctypes.RuleSeverityNotice:    3,
+	ctypes.RuleSeverityInfo:      1,
+	ctypes.RuleSeverityDebug:     0,
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func (cefFormatter) Format(al plugintypes.AuditLog) ([]byte, error) {
+	tx := al.Transaction()
+	highest := highestSeverityMessage(al)
+
+	version := ""
+	if hasProducer(al) {
+		version = tx.Producer().Version()
+	}
+
+	signatureID, name, severity := "0", "Transaction passed", 0
+	if tx.IsInterrupted() {
+		name = "Transaction blocked"
+	}
+	if highest != nil {
+		signatureID = strconv.Itoa(highest.ID())
+		name = highest.Msg()
+		severity = cefSeverities[highest.Severity()]
+	}
+
+	var b strings.Builder
+	b.WriteString("CEF:0|OWASP|Coraza|")
+	for _, field := range []string{version, signatureID, name} {
+		b.WriteString(cefHeaderEscaper.Replace(field))
+		b.WriteByte('|')
+	}
+	b.WriteString(strconv.Itoa(severity))
+	b.WriteByte('|')
+
+	ext := cefExtensions{b: &b}
+	ext.add("rt", strconv.FormatInt(timestamp(tx).UnixMilli(), 10))
+	ext.add("externalId", tx.ID())
+	ext.add("src", tx.ClientIP())
+	ext.addInt("spt", tx.ClientPort())
+	ext.add("dst", tx.HostIP())
+	ext.addInt("dpt", tx.HostPort())
+	ext.add("dhost", tx.ServerID())
+	if tx.IsInterrupted() {
+		ext.add("act", "blocked")
+	} else {
+		ext.add("act", "passed")
+	}
+
+	if req := request(tx); req != nil {
+		ext.add("requestMethod", req.Method())
+		ext.add("request", req.URI())
+		ext.add("app", req.Protocol())
+		ext.add("requestClientApplication", header(req.Headers(), "user-agent"))
+		ext.add("requestContext", header(req.Headers(), "referer"))
+		ext.addInt("in", int(req.Length()))
+	}
+	if res := response(tx); res != nil && res.Status() != 0 {
+		ext.add("cn1Label", "responseStatus")
+		ext.addInt("cn1", res.Status())
+	}
+
+	var ruleIDs []string
+	for _, msg := range al.Messages() {
+		if data := msg.Data(); data != nil {
+			ruleIDs = append(ruleIDs, strconv.Itoa(data.ID()))
+		}
+	}
+	if len(ruleIDs) > 0 {
+		ext.add("cs1Label", "ruleIds")
+		ext.add("cs1", strings.Join(ruleIDs, ","))
+	}
+	if tags := messageTags(al); len(tags) > 0 {
+		ext.add("cs2Label", "tags")
+		ext.add("cs2", strings.Join(tags, ","))
+	}
+	if attributes := lookupAttributes(tx); len(attributes) > 0 {
+		pairs := make([]string, 0, len(attributes))
+		for _, attr := range attributes {
+			pairs = append(pairs, attr.Name+"="+attr.Value)
+		}
+		ext.add("cs3Label", "envoyAttributes")
+		ext.add("cs3", strings.Join(pairs, ","))
+	}
+	if highest != nil {
+		ext.add("msg", highest.Data())
+	}
+
+	return []byte(b.String()), nil
+}
+
+func (cefFormatter) MIME() string {
+	return "text/plain"
+}
+
+// cefExtensions writes the space separated key=value extensions of a CEF event, skipping
+// the empty values.
+type cefExtensions struct {
+	b     *strings.Builder
+	count int
+}
+
+func (e *cefExtensions) add(key, value string) {
+	if value == "" {
+		return
+	}
+	if e.count > 0 {
+		e.b.WriteByte(' ')
+	}
+	e.count++
+	e.b.WriteString(key)
+	e.b.WriteByte('=')
+	e.b.WriteString(cefExtensionEscaper.Replace(value))
+}
+
+func (e *cefExtensions) addInt(key string, value int) {
+	if value == 0 {
+		return
+	}
+	e.add(key, strconv.Itoa(value))
+}
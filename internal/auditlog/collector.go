@@ -0,0 +1,176 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// CollectorConfig configures the shipping of audit log entries to a remote collector.
+type CollectorConfig struct {
+	// Cluster is the name of the Envoy cluster of the collector.
+	Cluster string
+	// Path is the path the batches are sent to.
+	Path string
+	// Authority is the authority of the requests, defaults to the cluster name.
+	Authority string
+	// Headers are added to the requests sent to the collector.
+	Headers [][2]string
+	// BatchSize is the maximum number of entries sent in a single request.
+	BatchSize int
+	// QueueSize is the maximum number of entries waiting to be sent, newer entries are dropped
+	// once it is reached.
+	QueueSize int
+	// MaxRetries is the number of times a batch is sent again after a failure.
+	MaxRetries int
+	// Timeout is the timeout of the requests sent to the collector.
+	Timeout time.Duration
+}
+
+// callOutcome is the outcome of a request sent to a collector.
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callRejected
+	callFailed
+)
+
+// collectorProtocol builds the requests sent to a collector and interprets their responses.
+type collectorProtocol interface {
+	// headers returns the headers specific to the protocol.
+	headers() [][2]string
+	// encode encodes a batch of entries into the body of a request.
+	encode(entries [][]byte) []byte
+	// outcome tells the outcome of the request from its response, only available in the
+	// callback of proxywasm.DispatchHttpCall.
+	outcome(numHeaders, numTrailers int) (callOutcome, string)
+}
+
+type batch struct {
+	entries  [][]byte
+	attempts int
+}
+
+// Collector queues the formatted audit log entries and sends them in batches to a collector
+// through proxywasm.DispatchHttpCall. Batches are sent on the periodic flushes and a single
+// request is in flight at a time: a batch that failed (e.g. a 5xx status or no response at all)
+// is sent again on the next flush until MaxRetries is reached.
+type Collector struct {
+	cfg      CollectorConfig
+	protocol collectorProtocol
+	metrics  Metrics
+	queue    [][]byte
+	pending  *batch
+	inFlight bool
+}
+
+var _ Sink = (*Collector)(nil)
+
+func newCollector(cfg CollectorConfig, protocol collectorProtocol, metrics Metrics) *Collector {
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	return &Collector{cfg: cfg, protocol: protocol, metrics: metrics}
+}
+
+// Enqueue queues an entry to be sent on the next flush.
+func (c *Collector) Enqueue(entry []byte) {
+	if len(c.queue) >= c.cfg.QueueSize {
+		c.metrics.CountAuditLogsDropped(DropReasonQueueFull, 1)
+		return
+	}
+	c.queue = append(c.queue, entry)
+}
+
+// Flush sends the pending batch, or the queued entries if there is no pending batch, unless a
+// request is in flight already. It has to be called from the plugin context: the responses to
+// calls dispatched from an HTTP context are discarded once the HTTP context is deleted.
+func (c *Collector) Flush() {
+	if c.inFlight {
+		return
+	}
+
+	if c.pending == nil {
+		if len(c.queue) == 0 {
+			return
+		}
+		n := len(c.queue)
+		if n > c.cfg.BatchSize {
+			n = c.cfg.BatchSize
+		}
+		c.pending = &batch{entries: c.queue[:n:n]}
+		c.queue = c.queue[n:]
+	}
+
+	c.send(c.pending)
+}
+
+func (c *Collector) send(b *batch) {
+	authority := c.cfg.Authority
+	if authority == "" {
+		authority = c.cfg.Cluster
+	}
+
+	headers := [][2]string{
+		{":method", "POST"},
+		{":path", c.cfg.Path},
+		{":authority", authority},
+	}
+	headers = append(headers, c.protocol.headers()...)
+	headers = append(headers, c.cfg.Headers...)
+
+	b.attempts++
+	_, err := proxywasm.DispatchHttpCall(c.cfg.Cluster, headers, c.protocol.encode(b.entries), nil,
+		uint32(c.cfg.Timeout.Milliseconds()), c.onResponse)
+	if err != nil {
+		proxywasm.LogWarnf("Failed to send audit logs to cluster %q: %v", c.cfg.Cluster, err)
+		c.onFailure()
+		return
+	}
+	c.inFlight = true
+}
+
+func (c *Collector) onResponse(numHeaders, _, numTrailers int) {
+	c.inFlight = false
+
+	outcome, status := c.protocol.outcome(numHeaders, numTrailers)
+	switch outcome {
+	case callSucceeded:
+		c.metrics.CountAuditLogsSent(len(c.pending.entries))
+		c.pending = nil
+		// Full batches are sent right away to drain the queue.
+		if len(c.queue) >= c.cfg.BatchSize {
+			c.Flush()
+		}
+	case callRejected:
+		proxywasm.LogWarnf("Audit logs rejected by cluster %q with status %s", c.cfg.Cluster, status)
+		c.metrics.CountAuditLogsDropped(DropReasonRejected, len(c.pending.entries))
+		c.pending = nil
+	default:
+		proxywasm.LogWarnf("Failed to send audit logs to cluster %q, status %s", c.cfg.Cluster, status)
+		c.onFailure()
+	}
+}
+
+func (c *Collector) onFailure() {
+	if c.pending.attempts > c.cfg.MaxRetries {
+		c.metrics.CountAuditLogsDropped(DropReasonRetriesExhausted, len(c.pending.entries))
+		c.pending = nil
+		return
+	}
+	c.metrics.CountAuditLogsRetried(len(c.pending.entries))
+}
+
+// responseHeader returns the value of a header of the response to a dispatched call.
+func responseHeader(headers [][2]string, name string) (string, bool) {
+	for _, h := range headers {
+		if h[0] == name {
+			return h[1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,252 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// ecsVersion is the version of the Elastic Common Schema the entries conform to.
+const ecsVersion = "8.11.0"
+
+// ecsFormatter formats the audit logs as Elastic Common Schema documents
+// (see https://www.elastic.co/guide/en/ecs/current/index.html). Fields without an ECS
+// counterpart, such as the matched rules, are kept under the "coraza" namespace.
+type ecsFormatter struct{}
+
+type ecsLog struct {
+	Timestamp   string          `json:"@timestamp"`
+	ECS         ecsECS          `json:"ecs"`
+	Event       ecsEvent        `json:"event"`
+	Observer    ecsObserver     `json:"observer"`
+	Transaction ecsTransaction  `json:"transaction"`
+	Source      *ecsEndpoint    `json:"source,omitempty"`
+	Destination *ecsEndpoint    `json:"destination,omitempty"`
+	URL         *ecsURL         `json:"url,omitempty"`
+	HTTP        *ecsHTTP        `json:"http,omitempty"`
+	UserAgent   *ecsUserAgent   `json:"user_agent,omitempty"`
+	Rule        *ecsRule        `json:"rule,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Coraza      ecsCorazaFields `json:"coraza"`
+}
+
+type ecsECS struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Action   string   `json:"action"`
+	Outcome  string   `json:"outcome"`
+	Severity *int     `json:"severity,omitempty"`
+	Module   string   `json:"module"`
+	Dataset  string   `json:"dataset"`
+	Start    string   `json:"start"`
+}
+
+type ecsObserver struct {
+	Vendor   string `json:"vendor"`
+	Product  string `json:"product"`
+	Type     string `json:"type"`
+	Hostname string `json:"hostname,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+type ecsTransaction struct {
+	ID string `json:"id"`
+}
+
+type ecsEndpoint struct {
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+type ecsURL struct {
+	Original string `json:"original"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+type ecsHTTP struct {
+	Version  string           `json:"version,omitempty"`
+	Request  *ecsHTTPRequest  `json:"request,omitempty"`
+	Response *ecsHTTPResponse `json:"response,omitempty"`
+}
+
+type ecsHTTPRequest struct {
+	Method   string       `json:"method,omitempty"`
+	Referrer string       `json:"referrer,omitempty"`
+	MIMEType string       `json:"mime_type,omitempty"`
+	Bytes    int32        `json:"bytes,omitempty"`
+	Body     *ecsHTTPBody `json:"body,omitempty"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int          `json:"status_code,omitempty"`
+	MIMEType   string       `json:"mime_type,omitempty"`
+	Body       *ecsHTTPBody `json:"body,omitempty"`
+}
+
+type ecsHTTPBody struct {
+	Content string `json:"content"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsRule struct {
+	ID          string   `json:"id"`
+	Description string   `json:"description,omitempty"`
+	Ruleset     string   `json:"ruleset,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	Category    []string `json:"category,omitempty"`
+}
+
+type ecsCorazaFields struct {
+	Interrupted bool               `json:"interrupted"`
+	Messages    []ecsCorazaMessage `json:"messages,omitempty"`
+}
+
+type ecsCorazaMessage struct {
+	RuleID   int      `json:"rule_id"`
+	Message  string   `json:"message"`
+	Data     string   `json:"data,omitempty"`
+	Severity string   `json:"severity"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (ecsFormatter) Format(al plugintypes.AuditLog) ([]byte, error) {
+	tx := al.Transaction()
+	highest := highestSeverityMessage(al)
+
+	l := ecsLog{
+		Timestamp: timestamp(tx).Format(time.RFC3339Nano),
+		ECS:       ecsECS{Version: ecsVersion},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: []string{"web", "network"},
+			Type:     []string{"access"},
+			Action:   "passed",
+			Outcome:  "success",
+			Module:   "coraza",
+			Dataset:  "coraza.audit",
+			Start:    timestamp(tx).Format(time.RFC3339Nano),
+		},
+		Observer: ecsObserver{
+			Vendor:   "OWASP",
+			Product:  "Coraza",
+			Type:     "waf",
+			Hostname: tx.ServerID(),
+		},
+		Transaction: ecsTransaction{ID: tx.ID()},
+		Coraza:      ecsCorazaFields{Interrupted: tx.IsInterrupted()},
+	}
+
+	if hasProducer(al) {
+		l.Observer.Version = tx.Producer().Version()
+	}
+
+	if tx.ClientIP() != "" || tx.ClientPort() != 0 {
+		l.Source = &ecsEndpoint{IP: tx.ClientIP(), Port: tx.ClientPort()}
+	}
+	if tx.HostIP() != "" || tx.HostPort() != 0 {
+		l.Destination = &ecsEndpoint{IP: tx.HostIP(), Port: tx.HostPort()}
+	}
+
+	if req := request(tx); req != nil {
+		l.URL = ecsURLFromURI(req.URI())
+		l.HTTP = &ecsHTTP{
+			Version: strings.TrimPrefix(req.Protocol(), "HTTP/"),
+			Request: &ecsHTTPRequest{
+				Method:   req.Method(),
+				Referrer: header(req.Headers(), "referer"),
+				MIMEType: header(req.Headers(), "content-type"),
+				Bytes:    req.Length(),
+			},
+		}
+		if body := req.Body(); body != "" {
+			l.HTTP.Request.Body = &ecsHTTPBody{Content: body}
+		}
+		if ua := header(req.Headers(), "user-agent"); ua != "" {
+			l.UserAgent = &ecsUserAgent{Original: ua}
+		}
+	}
+
+	if res := response(tx); res != nil {
+		if l.HTTP == nil {
+			l.HTTP = &ecsHTTP{}
+		}
+		l.HTTP.Response = &ecsHTTPResponse{
+			StatusCode: res.Status(),
+			MIMEType:   header(res.Headers(), "content-type"),
+		}
+		if body := res.Body(); body != "" {
+			l.HTTP.Response.Body = &ecsHTTPBody{Content: body}
+		}
+	}
+
+	if tx.IsInterrupted() {
+		l.Event.Type = []string{"access", "denied"}
+		l.Event.Action = "blocked"
+		l.Event.Outcome = "failure"
+	}
+
+	if highest != nil {
+		l.Event.Kind = "alert"
+		severity := highest.Severity().Int()
+		l.Event.Severity = &severity
+		l.Rule = &ecsRule{
+			ID:          strconv.Itoa(highest.ID()),
+			Description: highest.Msg(),
+			Version:     highest.Ver(),
+			Category:    highest.Tags(),
+		}
+		if hasProducer(al) {
+			l.Rule.Ruleset = strings.Join(tx.Producer().Rulesets(), ",")
+		}
+	}
+
+	l.Tags = messageTags(al)
+	for _, msg := range al.Messages() {
+		data := msg.Data()
+		if data == nil {
+			continue
+		}
+		l.Coraza.Messages = append(l.Coraza.Messages, ecsCorazaMessage{
+			RuleID:   data.ID(),
+			Message:  data.Msg(),
+			Data:     data.Data(),
+			Severity: data.Severity().String(),
+			File:     data.File(),
+			Line:     data.Line(),
+			Tags:     data.Tags(),
+		})
+	}
+
+	return json.Marshal(l)
+}
+
+func (ecsFormatter) MIME() string {
+	return "application/json; charset=utf-8"
+}
+
+func ecsURLFromURI(uri string) *ecsURL {
+	u := &ecsURL{Original: uri}
+	if parsed, err := url.ParseRequestURI(uri); err == nil {
+		u.Path = parsed.Path
+		u.Query = parsed.RawQuery
+	}
+	return u
+}
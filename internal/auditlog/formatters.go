@@ -0,0 +1,106 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+// RegisterFormatters registers the "ecs", "cef" and "rfc5424" audit log formatters, selectable
+// through SecAuditLogFormat. They have to be registered before the directives are parsed.
+func RegisterFormatters() {
+	plugins.RegisterAuditLogFormatter("ecs", ecsFormatter{})
+	plugins.RegisterAuditLogFormatter("cef", cefFormatter{})
+	plugins.RegisterAuditLogFormatter("rfc5424", rfc5424Formatter{})
+}
+
+// timestamp returns the time the transaction started at.
+func timestamp(tx plugintypes.AuditLogTransaction) time.Time {
+	return time.Unix(0, tx.UnixTimestamp()).UTC()
+}
+
+// highestSeverityMessage returns the data of the message with the highest severity, the first
+// one among the messages with the same severity, nil if there are no messages.
+func highestSeverityMessage(al plugintypes.AuditLog) plugintypes.AuditLogMessageData {
+	var highest plugintypes.AuditLogMessageData
+	for _, msg := range al.Messages() {
+		data := msg.Data()
+		if data == nil {
+			continue
+		}
+		// Lower values are more severe, emergency being 0.
+		if highest == nil || data.Severity() < highest.Severity() {
+			highest = data
+		}
+	}
+	return highest
+}
+
+// messageTags returns the tags of the matched rules, without duplicates.
+func messageTags(al plugintypes.AuditLog) []string {
+	var tags []string
+	seen := map[string]struct{}{}
+	for _, msg := range al.Messages() {
+		data := msg.Data()
+		if data == nil {
+			continue
+		}
+		for _, tag := range data.Tags() {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// header returns the first value of the header, matched case-insensitively.
+func header(headers map[string][]string, name string) string {
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// request returns the request of the transaction, nil if not part of the audit log.
+func request(tx plugintypes.AuditLogTransaction) plugintypes.AuditLogTransactionRequest {
+	if !tx.HasRequest() {
+		return nil
+	}
+	return tx.Request()
+}
+
+// response returns the response of the transaction, nil if not part of the audit log.
+func response(tx plugintypes.AuditLogTransaction) plugintypes.AuditLogTransactionResponse {
+	if !tx.HasResponse() {
+		return nil
+	}
+	return tx.Response()
+}
+
+// severityOrDefault returns the severity of the message, def if there is no message.
+func severityOrDefault(data plugintypes.AuditLogMessageData, def ctypes.RuleSeverity) ctypes.RuleSeverity {
+	if data == nil {
+		return def
+	}
+	return data.Severity()
+}
+
+// hasProducer tells whether the audit log has the producer, logged with the trailer part.
+func hasProducer(al plugintypes.AuditLog) bool {
+	for _, part := range al.Parts() {
+		if part == ctypes.AuditLogPartAuditLogTrailer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+func TestFormatters(t *testing.T) {
+	formatters := map[string]plugintypes.AuditLogFormatter{
+		"ecs":     ecsFormatter{},
+		"cef":     cefFormatter{},
+		"rfc5424": rfc5424Formatter{},
+	}
+	auditLogs := map[string]plugintypes.AuditLog{
+		"blocked": blockedAuditLog(),
+		"passed":  passedAuditLog(),
+	}
+
+	// The formatters of non JSON formats add the proxy attributes themselves.
+	SetAttributesLookup(func(txID string) []Attribute {
+		if txID != "abc123" {
+			return nil
+		}
+		return []Attribute{{Name: "xds.route_name", Value: "login"}, {Name: "upstream.address", Value: "10.0.0.3:80"}}
+	})
+	defer SetAttributesLookup(nil)
+
+	for formatterName, formatter := range formatters {
+		for logName, al := range auditLogs {
+			t.Run(formatterName+"/"+logName, func(t *testing.T) {
+				out, err := formatter.Format(al)
+				require.NoError(t, err)
+
+				golden := filepath.Join("testdata", formatterName+"_"+logName+".golden")
+				if *updateGolden {
+					require.NoError(t, os.WriteFile(golden, out, 0644))
+				}
+				expected, err := os.ReadFile(golden)
+				require.NoError(t, err)
+				require.Equal(t, string(expected), string(out))
+			})
+		}
+	}
+}
+
+func blockedAuditLog() plugintypes.AuditLog {
+	return &testAuditLog{
+		parts: ctypes.AuditLogParts("ABFHZ"),
+		tx: &testTransaction{
+			unixTimestamp: time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC).UnixNano(),
+			id:            "abc123",
+			clientIP:      "10.0.0.1",
+			clientPort:    54321,
+			hostIP:        "10.0.0.2",
+			hostPort:      8080,
+			serverID:      "example.com",
+			interrupted:   true,
+			request: &testRequest{
+				method:   "POST",
+				protocol: "HTTP/1.1",
+				uri:      "/login?user=admin&q=1' OR '1'='1",
+				headers: map[string][]string{
+					"user-agent":   {"curl/8.0"},
+					"content-type": {"application/x-www-form-urlencoded"},
+				},
+				body:   "user=admin",
+				length: 42,
+			},
+			response: &testResponse{
+				protocol: "HTTP/1.1",
+				status:   403,
+				headers:  map[string][]string{"content-type": {"text/html"}},
+			},
+			producer: &testProducer{version: "3.3.3", rulesets: []string{"OWASP_CRS/4.0.0"}},
+		},
+		messages: []plugintypes.AuditLogMessage{
+			&testMessage{data: &testMessageData{
+				id:       942100,
+				msg:      "SQL Injection Attack Detected via libinjection",
+				data:     "Matched Data: s&1c found within ARGS:q: 1' OR '1'='1",
+				severity: ctypes.RuleSeverityCritical,
+				file:     "REQUEST-942-APPLICATION-ATTACK-SQLI.conf",
+				line:     46,
+				tags:     []string{"attack-sqli", "paranoia-level/1"},
+			}},
+			&testMessage{data: &testMessageData{
+				id:       949110,
+				msg:      "Inbound Anomaly Score Exceeded | Total Score: 5",
+				data:     "",
+				severity: ctypes.RuleSeverityEmergency,
+				file:     "REQUEST-949-BLOCKING-EVALUATION.conf",
+				line:     222,
+				tags:     []string{"anomaly-evaluation", "paranoia-level/1"},
+			}},
+		},
+	}
+}
+
+func passedAuditLog() plugintypes.AuditLog {
+	return &testAuditLog{
+		parts: ctypes.AuditLogParts("AB"),
+		tx: &testTransaction{
+			unixTimestamp: time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC).UnixNano(),
+			id:            "def456",
+			clientIP:      "10.0.0.1",
+			clientPort:    54322,
+			request: &testRequest{
+				method:   "GET",
+				protocol: "HTTP/2.0",
+				uri:      "/hello",
+				headers:  map[string][]string{":authority": {"localhost"}},
+			},
+		},
+	}
+}
+
+type testAuditLog struct {
+	parts    ctypes.AuditLogParts
+	tx       *testTransaction
+	messages []plugintypes.AuditLogMessage
+}
+
+func (l *testAuditLog) Parts() ctypes.AuditLogParts                  { return l.parts }
+func (l *testAuditLog) Transaction() plugintypes.AuditLogTransaction { return l.tx }
+func (l *testAuditLog) Messages() []plugintypes.AuditLogMessage      { return l.messages }
+
+type testTransaction struct {
+	unixTimestamp int64
+	id            string
+	clientIP      string
+	clientPort    int
+	hostIP        string
+	hostPort      int
+	serverID      string
+	interrupted   bool
+	request       *testRequest
+	response      *testResponse
+	producer      *testProducer
+}
+
+func (tx *testTransaction) Timestamp() string {
+	return time.Unix(0, tx.unixTimestamp).UTC().Format("2006/01/02 15:04:05")
+}
+func (tx *testTransaction) UnixTimestamp() int64 { return tx.unixTimestamp }
+func (tx *testTransaction) ID() string           { return tx.id }
+func (tx *testTransaction) ClientIP() string     { return tx.clientIP }
+func (tx *testTransaction) ClientPort() int      { return tx.clientPort }
+func (tx *testTransaction) HostIP() string       { return tx.hostIP }
+func (tx *testTransaction) HostPort() int        { return tx.hostPort }
+func (tx *testTransaction) ServerID() string     { return tx.serverID }
+func (tx *testTransaction) Request() plugintypes.AuditLogTransactionRequest {
+	return tx.request
+}
+func (tx *testTransaction) HasRequest() bool { return tx.request != nil }
+func (tx *testTransaction) Response() plugintypes.AuditLogTransactionResponse {
+	return tx.response
+}
+func (tx *testTransaction) HasResponse() bool { return tx.response != nil }
+func (tx *testTransaction) Producer() plugintypes.AuditLogTransactionProducer {
+	return tx.producer
+}
+func (tx *testTransaction) HighestSeverity() string { return "" }
+func (tx *testTransaction) IsInterrupted() bool     { return tx.interrupted }
+
+type testRequest struct {
+	plugintypes.AuditLogTransactionRequest
+	method   string
+	protocol string
+	uri      string
+	headers  map[string][]string
+	body     string
+	length   int32
+}
+
+func (r *testRequest) Method() string               { return r.method }
+func (r *testRequest) Protocol() string             { return r.protocol }
+func (r *testRequest) URI() string                  { return r.uri }
+func (r *testRequest) Headers() map[string][]string { return r.headers }
+func (r *testRequest) Body() string                 { return r.body }
+func (r *testRequest) Length() int32                { return r.length }
+
+type testResponse struct {
+	protocol string
+	status   int
+	headers  map[string][]string
+	body     string
+}
+
+func (r *testResponse) Protocol() string             { return r.protocol }
+func (r *testResponse) Status() int                  { return r.status }
+func (r *testResponse) Headers() map[string][]string { return r.headers }
+func (r *testResponse) Body() string                 { return r.body }
+
+type testProducer struct {
+	plugintypes.AuditLogTransactionProducer
+	version  string
+	rulesets []string
+}
+
+func (p *testProducer) Version() string    { return p.version }
+func (p *testProducer) Rulesets() []string { return p.rulesets }
+
+type testMessage struct {
+	plugintypes.AuditLogMessage
+	data *testMessageData
+}
+
+func (m *testMessage) Message() string                       { return m.data.msg }
+func (m *testMessage) Data() plugintypes.AuditLogMessageData { return m.data }
+
+type testMessageData struct {
+	plugintypes.AuditLogMessageData
+	id       int
+	msg      string
+	data     string
+	severity ctypes.RuleSeverity
+	file     string
+	line     int
+	tags     []string
+}
+
+func (d *testMessageData) ID() int                       { return d.id }
+func (d *testMessageData) Msg() string                   { return d.msg }
+func (d *testMessageData) Data() string                  { return d.data }
+func (d *testMessageData) Severity() ctypes.RuleSeverity { return d.severity }
+func (d *testMessageData) File() string                  { return d.file }
+func (d *testMessageData) Line() int                     { return d.line }
+func (d *testMessageData) Ver() string                   { return "" }
+func (d *testMessageData) Tags() []string                { return d.tags }
@@ -0,0 +1,127 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// GRPCExportPath is the path of the method receiving the audit logs, see auditlog.proto.
+const GRPCExportPath = "/coraza.auditlog.v1.AuditLogService/Export"
+
+// gRPC status codes worth retrying, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	grpcStatusOK                = 0
+	grpcStatusDeadlineExceeded  = 4
+	grpcStatusResourceExhausted = 8
+	grpcStatusAborted           = 10
+	grpcStatusUnavailable       = 14
+)
+
+// NewGRPCCollector creates a collector sending the batches to the Export method of a gRPC
+// AuditLogService (see auditlog.proto). The proxy-wasm SDK does not support gRPC calls, hence
+// the unary call is framed over proxywasm.DispatchHttpCall and the cluster of the collector must
+// use HTTP/2. Batches failed with a transient gRPC status are retried while other failures are
+// dropped. A nil metrics ignores the outcome of the entries.
+func NewGRPCCollector(cfg CollectorConfig, metrics Metrics) *Collector {
+	cfg.Path = GRPCExportPath
+	return newCollector(cfg, grpcProtocol{}, metrics)
+}
+
+type grpcProtocol struct{}
+
+func (grpcProtocol) headers() [][2]string {
+	return [][2]string{
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	}
+}
+
+// encode encodes an ExportAuditLogsRequest message framed as a gRPC uncompressed message.
+func (grpcProtocol) encode(entries [][]byte) []byte {
+	size := 0
+	for _, entry := range entries {
+		size += 1 + varintSize(uint64(len(entry))) + len(entry)
+	}
+
+	msg := make([]byte, 5, 5+size)
+	// The first byte is the compressed flag, followed by the length of the message.
+	binary.BigEndian.PutUint32(msg[1:], uint32(size))
+	for _, entry := range entries {
+		// Field 1 (entries), wire type 2 (length-delimited).
+		msg = append(msg, 1<<3|2)
+		msg = binary.AppendUvarint(msg, uint64(len(entry)))
+		msg = append(msg, entry...)
+	}
+	return msg
+}
+
+func (grpcProtocol) outcome(numHeaders, numTrailers int) (callOutcome, string) {
+	if numHeaders == 0 {
+		return callFailed, "none"
+	}
+
+	headers, err := proxywasm.GetHttpCallResponseHeaders()
+	if err != nil {
+		proxywasm.LogWarnf("Failed to get the response headers of the audit log collector: %v", err)
+	}
+	if status, _ := responseHeader(headers, ":status"); status != "200" {
+		if len(status) == 3 && status[0] == '4' {
+			return callRejected, status
+		}
+		return callFailed, status
+	}
+
+	// The gRPC status is sent in the trailers, or in the headers of trailers-only responses.
+	grpcStatus, ok := responseHeader(headers, "grpc-status")
+	if !ok && numTrailers > 0 {
+		trailers, err := proxywasm.GetHttpCallResponseTrailers()
+		if err != nil {
+			proxywasm.LogWarnf("Failed to get the response trailers of the audit log collector: %v", err)
+		}
+		grpcStatus, ok = responseHeader(trailers, "grpc-status")
+	}
+	if !ok {
+		return callFailed, "missing grpc-status"
+	}
+
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		return callFailed, "grpc-status " + grpcStatus
+	}
+	switch code {
+	case grpcStatusOK:
+		return callSucceeded, "grpc-status " + grpcStatus
+	case grpcStatusDeadlineExceeded, grpcStatusResourceExhausted, grpcStatusAborted, grpcStatusUnavailable:
+		return callFailed, "grpc-status " + grpcStatus
+	default:
+		return callRejected, "grpc-status " + grpcStatus
+	}
+}
+
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// RegisterGRPCWriter registers the "grpc" audit log writer, which ships the audit logs
+// through the given collector. A nil collector makes the writer fail at initialization,
+// as the collector is not configured.
+func RegisterGRPCWriter(collector *Collector) {
+	plugins.RegisterAuditLogWriter("grpc", func() plugintypes.AuditLogWriter {
+		if collector == nil {
+			return &sinkWriter{}
+		}
+		return &sinkWriter{sink: collector}
+	})
+}
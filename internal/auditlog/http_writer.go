@@ -0,0 +1,65 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// NewHTTPCollector creates a collector POSTing the batches to an HTTP endpoint, one entry per
+// line. Batches failed with a 5xx status are retried while batches failed with a 4xx status are
+// dropped. A nil metrics ignores the outcome of the entries.
+func NewHTTPCollector(cfg CollectorConfig, metrics Metrics) *Collector {
+	return newCollector(cfg, httpProtocol{}, metrics)
+}
+
+type httpProtocol struct{}
+
+func (httpProtocol) headers() [][2]string {
+	return [][2]string{{"content-type", "application/x-ndjson"}}
+}
+
+func (httpProtocol) encode(entries [][]byte) []byte {
+	return bytes.Join(entries, []byte{'\n'})
+}
+
+func (httpProtocol) outcome(numHeaders, _ int) (callOutcome, string) {
+	status := 0
+	if numHeaders > 0 {
+		headers, err := proxywasm.GetHttpCallResponseHeaders()
+		if err != nil {
+			proxywasm.LogWarnf("Failed to get the response headers of the audit log collector: %v", err)
+		}
+		if rawStatus, ok := responseHeader(headers, ":status"); ok {
+			status, _ = strconv.Atoi(rawStatus)
+		}
+	}
+
+	switch {
+	case status >= 200 && status < 300:
+		return callSucceeded, strconv.Itoa(status)
+	case status >= 400 && status < 500:
+		return callRejected, strconv.Itoa(status)
+	default:
+		// 5xx statuses and failed requests (e.g. timeouts) are retried.
+		return callFailed, strconv.Itoa(status)
+	}
+}
+
+// RegisterHTTPWriter registers the "http" audit log writer, which ships the audit logs
+// through the given collector. A nil collector makes the writer fail at initialization,
+// as the collector is not configured.
+func RegisterHTTPWriter(collector *Collector) {
+	plugins.RegisterAuditLogWriter("http", func() plugintypes.AuditLogWriter {
+		if collector == nil {
+			return &sinkWriter{}
+		}
+		return &sinkWriter{sink: collector}
+	})
+}
@@ -0,0 +1,250 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/redact"
+)
+
+var redactionPolicy *redact.Policy
+
+// SetRedactionPolicy sets the policy redacting the audit logs of all the writers registered by
+// this package before they are formatted. A nil policy disables the redaction.
+func SetRedactionPolicy(p *redact.Policy) {
+	redactionPolicy = p
+}
+
+// formatRedacted formats the audit log redacted according to the redaction policy. The
+// formatters only see redacted data and, as some of them marshal the audit log as is, JSON
+// entries are redacted once formatted as well.
+func formatRedacted(formatter plugintypes.AuditLogFormatter, al plugintypes.AuditLog) ([]byte, error) {
+	if redactionPolicy == nil {
+		return formatter.Format(al)
+	}
+
+	redacted := &redactedAuditLog{
+		AuditLog:        al,
+		policy:          redactionPolicy,
+		sensitiveValues: sensitiveValues(al, redactionPolicy),
+	}
+	bts, err := formatter.Format(redacted)
+	if err != nil || !json.Valid(bts) {
+		return bts, err
+	}
+	return redacted.redactJSONEntry(bts)
+}
+
+// sensitiveValues collects the values of the sensitive headers and arguments of the transaction,
+// which are redacted wherever they appear, e.g. in the data of the matched rules.
+func sensitiveValues(al plugintypes.AuditLog, p *redact.Policy) []string {
+	var values []string
+	tx := al.Transaction()
+	if tx == nil {
+		return nil
+	}
+
+	if req := tx.Request(); req != nil {
+		for name, vs := range req.Headers() {
+			if p.IsSensitiveHeader(name) {
+				values = append(values, vs...)
+			}
+		}
+		if args := req.Args(); args != nil {
+			for _, arg := range args.FindAll() {
+				if p.IsSensitiveArg(arg.Key()) {
+					values = append(values, arg.Value())
+				}
+			}
+		}
+	}
+
+	if res := tx.Response(); res != nil {
+		for name, vs := range res.Headers() {
+			if p.IsSensitiveHeader(name) {
+				values = append(values, vs...)
+			}
+		}
+	}
+	return values
+}
+
+type redactedAuditLog struct {
+	plugintypes.AuditLog
+	policy          *redact.Policy
+	sensitiveValues []string
+}
+
+func (l *redactedAuditLog) redact(s string) string {
+	return l.policy.String(s, l.sensitiveValues...)
+}
+
+func (l *redactedAuditLog) Transaction() plugintypes.AuditLogTransaction {
+	tx := l.AuditLog.Transaction()
+	if tx == nil {
+		return nil
+	}
+	return &redactedTransaction{AuditLogTransaction: tx, log: l}
+}
+
+func (l *redactedAuditLog) Messages() []plugintypes.AuditLogMessage {
+	msgs := l.AuditLog.Messages()
+	redacted := make([]plugintypes.AuditLogMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		redacted = append(redacted, &redactedMessage{AuditLogMessage: msg, log: l})
+	}
+	return redacted
+}
+
+// MarshalJSON marshals the wrapped audit log, as the "json" formatter marshals it as is
+// rather than through the accessors.
+func (l *redactedAuditLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.AuditLog)
+}
+
+func (l *redactedAuditLog) redactJSONEntry(entry []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(entry))
+	// Numbers are kept as they are rather than converted to floats.
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	bts, err := json.Marshal(l.redactJSON("", v))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasSuffix(entry, []byte{'\n'}) {
+		bts = append(bts, '\n')
+	}
+	return bts, nil
+}
+
+func (l *redactedAuditLog) redactJSON(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if key == "headers" && l.policy.IsSensitiveHeader(k) {
+				v[k] = []string{l.policy.Replacement()}
+				continue
+			}
+			v[k] = l.redactJSON(k, field)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = l.redactJSON(key, item)
+		}
+		return v
+	case string:
+		return l.redact(v)
+	default:
+		return v
+	}
+}
+
+type redactedTransaction struct {
+	plugintypes.AuditLogTransaction
+	log *redactedAuditLog
+}
+
+func (t *redactedTransaction) Request() plugintypes.AuditLogTransactionRequest {
+	req := t.AuditLogTransaction.Request()
+	if req == nil {
+		return nil
+	}
+	return &redactedRequest{AuditLogTransactionRequest: req, log: t.log}
+}
+
+func (t *redactedTransaction) Response() plugintypes.AuditLogTransactionResponse {
+	res := t.AuditLogTransaction.Response()
+	if res == nil {
+		return nil
+	}
+	return &redactedResponse{AuditLogTransactionResponse: res, log: t.log}
+}
+
+type redactedRequest struct {
+	plugintypes.AuditLogTransactionRequest
+	log *redactedAuditLog
+}
+
+func (r *redactedRequest) URI() string {
+	return r.log.redact(r.AuditLogTransactionRequest.URI())
+}
+
+func (r *redactedRequest) Headers() map[string][]string {
+	return redactHeaders(r.log, r.AuditLogTransactionRequest.Headers())
+}
+
+func (r *redactedRequest) Body() string {
+	return r.log.redact(r.AuditLogTransactionRequest.Body())
+}
+
+type redactedResponse struct {
+	plugintypes.AuditLogTransactionResponse
+	log *redactedAuditLog
+}
+
+func (r *redactedResponse) Headers() map[string][]string {
+	return redactHeaders(r.log, r.AuditLogTransactionResponse.Headers())
+}
+
+func (r *redactedResponse) Body() string {
+	return r.log.redact(r.AuditLogTransactionResponse.Body())
+}
+
+func redactHeaders(l *redactedAuditLog, headers map[string][]string) map[string][]string {
+	redacted := l.policy.Headers(headers)
+	for name, values := range redacted {
+		if l.policy.IsSensitiveHeader(name) {
+			continue
+		}
+		redactedValues := make([]string, len(values))
+		for i, v := range values {
+			redactedValues[i] = l.redact(v)
+		}
+		redacted[name] = redactedValues
+	}
+	return redacted
+}
+
+type redactedMessage struct {
+	plugintypes.AuditLogMessage
+	log *redactedAuditLog
+}
+
+func (m *redactedMessage) Message() string {
+	return m.log.redact(m.AuditLogMessage.Message())
+}
+
+func (m *redactedMessage) Data() plugintypes.AuditLogMessageData {
+	data := m.AuditLogMessage.Data()
+	if data == nil {
+		return nil
+	}
+	return &redactedMessageData{AuditLogMessageData: data, log: m.log}
+}
+
+type redactedMessageData struct {
+	plugintypes.AuditLogMessageData
+	log *redactedAuditLog
+}
+
+func (d *redactedMessageData) Msg() string {
+	return d.log.redact(d.AuditLogMessageData.Msg())
+}
+
+func (d *redactedMessageData) Data() string {
+	return d.log.redact(d.AuditLogMessageData.Data())
+}
+
+func (d *redactedMessageData) Raw() string {
+	return d.log.redact(d.AuditLogMessageData.Raw())
+}
@@ -0,0 +1,155 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+const (
+	// rfc5424Facility is the "log audit" facility.
+	rfc5424Facility = 13
+	// rfc5424SDID identifies the structured data of the transaction. 32473 is the private
+	// enterprise number reserved for documentation by RFC 5612, as Coraza has none assigned.
+	rfc5424SDID = "coraza@32473"
+	// rfc5424AttributesSDID identifies the structured data of the proxy attributes.
+	rfc5424AttributesSDID = "envoy@32473"
+	// rfc5424TimeFormat is the timestamp format of RFC 5424, which allows up to microseconds.
+	rfc5424TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// rfc5424Formatter formats the audit logs as RFC 5424 syslog messages, one line per
+// transaction. The severity of the message is the highest severity of the matched rules, which
+// share the syslog severity levels, or info if no rule matched.
+type rfc5424Formatter struct{}
+
+var (
+	rfc5424ParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`, "\n", " ", "\r", " ")
+	rfc5424MsgEscaper   = strings.NewReplacer("\n", " ", "\r", " ")
+)
+
+func (rfc5424Formatter) Format(al plugintypes.AuditLog) ([]byte, error) {
+	tx := al.Transaction()
+	severity := severityOrDefault(highestSeverityMessage(al), ctypes.RuleSeverityInfo)
+
+	var b strings.Builder
+	b.WriteByte('<')
+	b.WriteString(strconv.Itoa(rfc5424Facility*8 + severity.Int()))
+	b.WriteString(">1 ")
+	b.WriteString(timestamp(tx).Format(rfc5424TimeFormat))
+	b.WriteByte(' ')
+	b.WriteString(rfc5424Header(tx.ServerID(), 255))
+	b.WriteString(" coraza - audit ")
+
+	sd := rfc5424StructuredData{b: &b}
+	b.WriteString("[" + rfc5424SDID)
+	sd.add("tx_id", tx.ID())
+	sd.add("client_ip", tx.ClientIP())
+	sd.addInt("client_port", tx.ClientPort())
+	sd.add("host_ip", tx.HostIP())
+	sd.addInt("host_port", tx.HostPort())
+	if req := request(tx); req != nil {
+		sd.add("method", req.Method())
+		sd.add("uri", req.URI())
+		sd.add("protocol", req.Protocol())
+	}
+	if res := response(tx); res != nil {
+		sd.addInt("status", res.Status())
+	}
+	sd.add("interrupted", strconv.FormatBool(tx.IsInterrupted()))
+
+	var ruleIDs, msgs []string
+	for _, msg := range al.Messages() {
+		data := msg.Data()
+		if data == nil {
+			continue
+		}
+		ruleIDs = append(ruleIDs, strconv.Itoa(data.ID()))
+		msgs = append(msgs, "[id \""+strconv.Itoa(data.ID())+"\"] "+data.Msg())
+	}
+	sd.add("rule_ids", strings.Join(ruleIDs, ","))
+	b.WriteByte(']')
+
+	if attributes := lookupAttributes(tx); len(attributes) > 0 {
+		b.WriteString("[" + rfc5424AttributesSDID)
+		for _, attr := range attributes {
+			sd.add(rfc5424ParamName(attr.Name), attr.Value)
+		}
+		b.WriteByte(']')
+	}
+	b.WriteByte(' ')
+
+	switch {
+	case len(msgs) > 0:
+		b.WriteString(rfc5424MsgEscaper.Replace(strings.Join(msgs, "; ")))
+	case tx.IsInterrupted():
+		b.WriteString("Transaction blocked")
+	default:
+		b.WriteString("Transaction passed")
+	}
+
+	return []byte(b.String()), nil
+}
+
+func (rfc5424Formatter) MIME() string {
+	return "text/plain"
+}
+
+// rfc5424Header returns a header field of at most maxLen printable ASCII characters,
+// "-" (the nil value) if empty.
+func rfc5424Header(value string, maxLen int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	return value
+}
+
+// rfc5424ParamName returns a valid structured data parameter name, at most 32 printable ASCII
+// characters other than '=', ' ', ']' and '"'.
+func rfc5424ParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	return rfc5424Header(name, 32)
+}
+
+// rfc5424StructuredData writes the parameters of a structured data element, skipping the
+// empty values.
+type rfc5424StructuredData struct {
+	b *strings.Builder
+}
+
+func (sd *rfc5424StructuredData) add(name, value string) {
+	if value == "" {
+		return
+	}
+	sd.b.WriteByte(' ')
+	sd.b.WriteString(name)
+	sd.b.WriteString(`="`)
+	sd.b.WriteString(rfc5424ParamEscaper.Replace(value))
+	sd.b.WriteByte('"')
+}
+
+func (sd *rfc5424StructuredData) addInt(name string, value int) {
+	if value == 0 {
+		return
+	}
+	sd.add(name, strconv.Itoa(value))
+}
@@ -5,23 +5,86 @@ package auditlog
 
 import (
 	"io"
+	"strconv"
+	"unicode/utf8"
 
 	"github.com/corazawaf/coraza/v3/experimental/plugins"
 	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 )
 
+// DefaultSerialPrefix is the prefix added by default to the audit logs printed to the proxy-wasm log.
+const DefaultSerialPrefix = "AuditLog:"
+
+type serialOptions struct {
+	prefix      string
+	log         func(string)
+	maxLineSize int
+}
+
+// SerialOption configures the "serial" audit log writer.
+type SerialOption func(*serialOptions)
+
+// WithPrefix sets the prefix differentiating the audit logs from other logs.
+func WithPrefix(prefix string) SerialOption {
+	return func(o *serialOptions) {
+		o.prefix = prefix
+	}
+}
+
+// WithLogFunc sets the function printing the audit logs, e.g. proxywasm.LogWarn to print
+// them at warn level.
+func WithLogFunc(log func(string)) SerialOption {
+	return func(o *serialOptions) {
+		o.log = log
+	}
+}
+
+// WithMaxLineSize sets the maximum size of the printed lines, entries exceeding it are split
+// into chunks. Zero disables the splitting.
+func WithMaxLineSize(size int) SerialOption {
+	return func(o *serialOptions) {
+		o.maxLineSize = size
+	}
+}
+
 // RegisterProxyWasmSerialWriter overrides the default "Serial" audit log writer (see https://github.com/corazawaf/coraza/blob/main/internal/auditlog/init_tinygo.go)
-// in order to print audit logs to the proxy-wasm log as info messages with a prefix to differentiate them from other logs.
-func RegisterProxyWasmSerialWriter() {
+// in order to print audit logs to the proxy-wasm log, by default as info messages, with a prefix to differentiate them from other logs.
+func RegisterProxyWasmSerialWriter(opts ...SerialOption) {
+	options := newSerialOptions(opts)
 	plugins.RegisterAuditLogWriter("serial", func() plugintypes.AuditLogWriter {
-		return &wasmSerial{}
+		return &wasmSerial{options: options}
 	})
 }
 
+func newSerialOptions(opts []SerialOption) serialOptions {
+	options := serialOptions{
+		prefix: DefaultSerialPrefix,
+		log:    proxywasm.LogInfo,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// print prints an entry to the proxy-wasm log adding the prefix, "AuditLog:" by default, split
+// into chunks identified by id if it exceeds the maximum line size.
+func (o serialOptions) print(entry []byte, id string) {
+	if o.maxLineSize <= 0 || len(o.prefix)+len(entry) <= o.maxLineSize {
+		o.log(o.prefix + string(entry))
+		return
+	}
+
+	for _, chunk := range splitEntry(entry, o.prefix, id, o.maxLineSize) {
+		o.log(chunk)
+	}
+}
+
 type wasmSerial struct {
 	io.Closer
 	formatter plugintypes.AuditLogFormatter
+	options   serialOptions
 }
 
 func (s *wasmSerial) Init(cfg plugintypes.AuditLogConfig) error {
@@ -34,7 +97,7 @@ func (s *wasmSerial) Write(al plugintypes.AuditLog) error {
 		return nil
 	}
 
-	bts, err := s.formatter.Format(al)
+	bts, err := formatEntry(s.formatter, al)
 	if err != nil {
 		return err
 	}
@@ -42,9 +105,59 @@ func (s *wasmSerial) Write(al plugintypes.AuditLog) error {
 	if len(bts) == 0 {
 		return nil
 	}
-	// Print the audit log to the proxy-wasm log as an info message adding an "AuditLog:" prefix.
-	proxywasm.LogInfo("AuditLog:" + string(bts))
+
+	s.options.print(bts, al.Transaction().ID())
 	return nil
 }
 
 func (s *wasmSerial) Close() error { return nil }
+
+// splitEntry splits an entry into lines of maxLineSize at most, each one being
+// "<prefix>[<tx id> <part>/<total>] <chunk>" so that the entry can be reassembled downstream
+// concatenating the chunks of the transaction in order. Chunks are not split inside UTF-8
+// sequences.
+func splitEntry(entry []byte, prefix string, txID string, maxLineSize int) []string {
+	// The size of the headers depends on the number of chunks, which depends on the size of
+	// the headers. A larger total can only lead to more chunks, hence this converges.
+	total := 1
+	for {
+		chunks := chunkEntry(entry, prefix, txID, total, maxLineSize)
+		if len(chunks) == total {
+			return chunks
+		}
+		total = len(chunks)
+	}
+}
+
+func chunkEntry(entry []byte, prefix string, txID string, total int, maxLineSize int) []string {
+	var chunks []string
+	for len(entry) > 0 {
+		header := chunkHeader(prefix, txID, len(chunks)+1, total)
+		end := maxLineSize - len(header)
+		if end < utf8.UTFMax {
+			// The line size is exceeded rather than looping forever.
+			end = utf8.UTFMax
+		}
+		if end >= len(entry) {
+			end = len(entry)
+		} else if runeEnd := lastRuneStart(entry, end); runeEnd > 0 {
+			end = runeEnd
+		}
+		chunks = append(chunks, header+string(entry[:end]))
+		entry = entry[end:]
+	}
+	return chunks
+}
+
+// lastRuneStart returns the last index not greater than end starting a UTF-8 sequence,
+// zero if there is none.
+func lastRuneStart(b []byte, end int) int {
+	for end > 0 && !utf8.RuneStart(b[end]) {
+		end--
+	}
+	return end
+}
+
+func chunkHeader(prefix string, txID string, part, total int) string {
+	return prefix + "[" + txID + " " + strconv.Itoa(part) + "/" + strconv.Itoa(total) + "] "
+}
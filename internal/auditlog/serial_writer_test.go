@@ -0,0 +1,40 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitEntry(t *testing.T) {
+	testCases := map[string]struct {
+		entry       string
+		maxLineSize int
+	}{
+		"ascii":                  {entry: strings.Repeat("0123456789", 30), maxLineSize: 64},
+		"multibyte":              {entry: strings.Repeat("ñandú ☃ ", 40), maxLineSize: 50},
+		"header digits increase": {entry: strings.Repeat("a", 1000), maxLineSize: 40},
+	}
+
+	for name, tCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			chunks := splitEntry([]byte(tCase.entry), "AuditLog:", "abc", tCase.maxLineSize)
+			require.Greater(t, len(chunks), 1)
+
+			var reassembled strings.Builder
+			for i, chunk := range chunks {
+				require.LessOrEqual(t, len(chunk), tCase.maxLineSize)
+				header := chunkHeader("AuditLog:", "abc", i+1, len(chunks))
+				require.True(t, strings.HasPrefix(chunk, header), chunk)
+				require.True(t, utf8.ValidString(chunk), chunk)
+				reassembled.WriteString(strings.TrimPrefix(chunk, header))
+			}
+			require.Equal(t, tCase.entry, reassembled.String())
+		})
+	}
+}
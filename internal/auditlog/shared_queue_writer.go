@@ -0,0 +1,98 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// SharedQueue is a sink enqueuing the entries into a proxy-wasm shared queue, registered
+// by the aggregator VM of the given VM ID. The queue is resolved lazily, as the aggregator
+// might not have registered it yet when the entries start being written.
+type SharedQueue struct {
+	vmID     string
+	name     string
+	id       uint32
+	resolved bool
+	metrics  Metrics
+}
+
+var _ Sink = (*SharedQueue)(nil)
+
+// NewSharedQueue creates a sink for the queue of the given name. A nil metrics ignores the
+// outcome of the entries.
+func NewSharedQueue(vmID, name string, metrics Metrics) *SharedQueue {
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	return &SharedQueue{vmID: vmID, name: name, metrics: metrics}
+}
+
+func (q *SharedQueue) Enqueue(entry []byte) {
+	if !q.resolved {
+		id, err := proxywasm.ResolveSharedQueue(q.vmID, q.name)
+		if err != nil {
+			proxywasm.LogWarnf("Failed to resolve the audit log shared queue %q: %v", q.name, err)
+			q.metrics.CountAuditLogsDropped(DropReasonQueueUnavailable, 1)
+			return
+		}
+		q.id, q.resolved = id, true
+	}
+
+	if err := proxywasm.EnqueueSharedQueue(q.id, entry); err != nil {
+		proxywasm.LogWarnf("Failed to enqueue the audit log into the shared queue %q: %v", q.name, err)
+		q.metrics.CountAuditLogsDropped(DropReasonQueueUnavailable, 1)
+		if err == types.ErrorStatusNotFound {
+			// The aggregator VM might have been restarted, hence the queue is resolved again.
+			q.resolved = false
+		}
+	}
+}
+
+// RegisterSharedQueueWriter registers the "shared_queue" audit log writer, which enqueues
+// the audit logs into the given shared queue to be delivered by an aggregator VM. A nil
+// queue makes the writer fail at initialization, as the queue is not configured.
+func RegisterSharedQueueWriter(queue *SharedQueue) {
+	plugins.RegisterAuditLogWriter("shared_queue", func() plugintypes.AuditLogWriter {
+		if queue == nil {
+			return &sinkWriter{}
+		}
+		return &sinkWriter{sink: queue}
+	})
+}
+
+// SharedQueueAggregator drains a shared queue registered by this VM, handing the
+// entries over to a sink.
+type SharedQueueAggregator struct {
+	queueID  uint32
+	maxDrain int
+	sink     Sink
+}
+
+// NewSharedQueueAggregator registers the shared queue of the given name. At most maxDrain
+// entries are handed over to the sink on each drain.
+func NewSharedQueueAggregator(name string, maxDrain int, sink Sink) (*SharedQueueAggregator, error) {
+	queueID, err := proxywasm.RegisterSharedQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedQueueAggregator{queueID: queueID, maxDrain: maxDrain, sink: sink}, nil
+}
+
+// Drain hands the queued entries over to the sink.
+func (a *SharedQueueAggregator) Drain() {
+	for i := 0; i < a.maxDrain; i++ {
+		entry, err := proxywasm.DequeueSharedQueue(a.queueID)
+		if err != nil {
+			if err != types.ErrorStatusEmpty {
+				proxywasm.LogWarnf("Failed to dequeue from the audit log shared queue: %v", err)
+			}
+			return
+		}
+		a.sink.Enqueue(entry)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package auditlog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// Reasons for which audit log entries are dropped.
+const (
+	DropReasonQueueFull        = "queue_full"
+	DropReasonRejected         = "rejected"
+	DropReasonRetriesExhausted = "retries_exhausted"
+	DropReasonQueueUnavailable = "queue_unavailable"
+)
+
+// Sink receives the formatted audit log entries to be delivered.
+type Sink interface {
+	Enqueue(entry []byte)
+}
+
+// Metrics is notified about the outcome of the audit log entries handled by the sinks.
+type Metrics interface {
+	CountAuditLogsSent(n int)
+	CountAuditLogsDropped(reason string, n int)
+	CountAuditLogsRetried(n int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) CountAuditLogsSent(int) {}
+
+func (noopMetrics) CountAuditLogsDropped(string, int) {}
+
+func (noopMetrics) CountAuditLogsRetried(int) {}
+
+// LogSink prints the entries to the proxy-wasm log as the "serial" writer does, with the same
+// options. The transaction of the entries being unknown, the entries split into chunks are
+// identified by their sequence number instead.
+type LogSink struct {
+	options serialOptions
+	entries uint64
+}
+
+// NewLogSink returns a sink printing the entries to the proxy-wasm log, by default as info
+// messages with an "AuditLog:" prefix.
+func NewLogSink(opts ...SerialOption) *LogSink {
+	return &LogSink{options: newSerialOptions(opts)}
+}
+
+func (s *LogSink) Enqueue(entry []byte) {
+	s.entries++
+	s.options.print(entry, strconv.FormatUint(s.entries, 10))
+}
+
+// sinkWriter is an audit log writer handing the formatted entries over to a sink.
+type sinkWriter struct {
+	io.Closer
+	formatter plugintypes.AuditLogFormatter
+	sink      Sink
+}
+
+func (w *sinkWriter) Init(cfg plugintypes.AuditLogConfig) error {
+	if w.sink == nil {
+		return errors.New("audit log sink is not configured")
+	}
+	w.formatter = cfg.Formatter
+	return nil
+}
+
+func (w *sinkWriter) Write(al plugintypes.AuditLog) error {
+	if w.formatter == nil {
+		return nil
+	}
+
+	bts, err := formatEntry(w.formatter, al)
+	if err != nil {
+		return err
+	}
+
+	if len(bts) == 0 {
+		return nil
+	}
+	w.sink.Enqueue(bytes.TrimRight(bts, "\n"))
+	return nil
+}
+
+func (w *sinkWriter) Close() error { return nil }
@@ -0,0 +1,459 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package grpcbody decodes the bodies of gRPC and gRPC-Web requests, made of length-prefixed
+// protobuf messages, into arguments the rules can inspect, as the JSON body processor does for
+// JSON documents. The messages are decoded according to a protobuf descriptor set, the fields not
+// described being named after their numbers. The protobuf runtime is not used, it does not fit
+// the constraints of the plugin.
+package grpcbody
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ArgumentPrefix prefixes the names of the arguments decoded from the messages, e.g.
+// grpc.user.name, like "json" prefixes the ones of the JSON body processor.
+const ArgumentPrefix = "grpc"
+
+// maxDepth bounds the nesting of the messages decoded.
+const maxDepth = 32
+
+// frameHeaderSize is the size of the prefix of the gRPC messages: the flags followed by the
+// length of the message.
+const frameHeaderSize = 5
+
+const (
+	frameFlagCompressed = 0x01
+	// frameFlagTrailers flags the gRPC-Web frames carrying the trailers of the responses.
+	frameFlagTrailers = 0x80
+)
+
+// ErrCompressed is returned when a message is compressed, its fields are not decoded.
+var ErrCompressed = errors.New("compressed messages are not supported")
+
+var errTruncated = errors.New("truncated message")
+
+// Protobuf wire types, see https://protobuf.dev/programming-guides/encoding/#structure.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field types and labels of FieldDescriptorProto, see google/protobuf/descriptor.proto.
+const (
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+
+	labelRepeated = 3
+)
+
+type field struct {
+	name     string
+	typ      uint64
+	repeated bool
+	typeName string
+	message  *message
+}
+
+type message struct {
+	fields map[uint64]*field
+}
+
+// Descriptors holds the messages of a protobuf descriptor set, indexed by the paths of the
+// gRPC methods they are the input of. A nil Descriptors decodes every field by its number.
+type Descriptors struct {
+	methods map[string]*message
+}
+
+// ParseDescriptorSet parses a serialized FileDescriptorSet, as output by
+// protoc --descriptor_set_out --include_imports.
+func ParseDescriptorSet(data []byte) (*Descriptors, error) {
+	messages := map[string]*message{}
+	inputTypes := map[string]string{}
+	err := readFields(data, func(v wireValue) error {
+		if v.num != 1 || v.typ != wireBytes { // file
+			return nil
+		}
+		return parseFile(v.bytes, messages, inputTypes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, msg := range messages {
+		for _, f := range msg.fields {
+			if f.typ != typeMessage {
+				continue
+			}
+			if f.message = messages[f.typeName]; f.message == nil {
+				return nil, fmt.Errorf("unknown type %q of field %s.%s", f.typeName, name[1:], f.name)
+			}
+		}
+	}
+
+	d := &Descriptors{methods: make(map[string]*message, len(inputTypes))}
+	for path, inputType := range inputTypes {
+		if d.methods[path] = messages[inputType]; d.methods[path] == nil {
+			return nil, fmt.Errorf("unknown input type %q of method %s", inputType, path)
+		}
+	}
+	return d, nil
+}
+
+// parseFile parses a FileDescriptorProto, adding its messages, indexed by their fully-qualified
+// names (e.g. .pkg.Message), and the input types of its methods, indexed by their paths.
+func parseFile(data []byte, messages map[string]*message, inputTypes map[string]string) error {
+	var pkg string
+	var messageTypes, services [][]byte
+	err := readFields(data, func(v wireValue) error {
+		if v.typ != wireBytes {
+			return nil
+		}
+		switch v.num {
+		case 2:
+			pkg = string(v.bytes)
+		case 4:
+			messageTypes = append(messageTypes, v.bytes)
+		case 6:
+			services = append(services, v.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scope := "."
+	if pkg != "" {
+		scope += pkg + "."
+	}
+	for _, data := range messageTypes {
+		if err := parseMessage(data, scope, messages); err != nil {
+			return err
+		}
+	}
+	for _, data := range services {
+		if err := parseService(data, pkg, inputTypes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMessage parses a DescriptorProto and its nested types.
+func parseMessage(data []byte, scope string, messages map[string]*message) error {
+	msg := &message{fields: map[uint64]*field{}}
+	var name string
+	var nestedTypes [][]byte
+	err := readFields(data, func(v wireValue) error {
+		if v.typ != wireBytes {
+			return nil
+		}
+		switch v.num {
+		case 1:
+			name = string(v.bytes)
+		case 2:
+			number, f, err := parseField(v.bytes)
+			if err != nil {
+				return err
+			}
+			msg.fields[number] = f
+		case 3:
+			nestedTypes = append(nestedTypes, v.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fullName := scope + name
+	messages[fullName] = msg
+	for _, data := range nestedTypes {
+		if err := parseMessage(data, fullName+".", messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseField parses a FieldDescriptorProto.
+func parseField(data []byte) (uint64, *field, error) {
+	var number uint64
+	f := &field{}
+	err := readFields(data, func(v wireValue) error {
+		switch {
+		case v.num == 1 && v.typ == wireBytes:
+			f.name = string(v.bytes)
+		case v.num == 3 && v.typ == wireVarint:
+			number = v.varint
+		case v.num == 4 && v.typ == wireVarint:
+			f.repeated = v.varint == labelRepeated
+		case v.num == 5 && v.typ == wireVarint:
+			f.typ = v.varint
+		case v.num == 6 && v.typ == wireBytes:
+			f.typeName = string(v.bytes)
+		}
+		return nil
+	})
+	return number, f, err
+}
+
+// parseService parses a ServiceDescriptorProto, adding the input types of its methods.
+func parseService(data []byte, pkg string, inputTypes map[string]string) error {
+	var name string
+	var methods [][]byte
+	err := readFields(data, func(v wireValue) error {
+		if v.typ != wireBytes {
+			return nil
+		}
+		switch v.num {
+		case 1:
+			name = string(v.bytes)
+		case 2:
+			methods = append(methods, v.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	service := name
+	if pkg != "" {
+		service = pkg + "." + name
+	}
+	for _, data := range methods {
+		var methodName, inputType string
+		err := readFields(data, func(v wireValue) error {
+			switch {
+			case v.num == 1 && v.typ == wireBytes:
+				methodName = string(v.bytes)
+			case v.num == 2 && v.typ == wireBytes:
+				inputType = string(v.bytes)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		inputTypes["/"+service+"/"+methodName] = inputType
+	}
+	return nil
+}
+
+// Decode decodes the messages of the body of a request to the gRPC method with the given
+// path, e.g. /pkg.Service/Method, calling add for each of their fields. The fields of the
+// repeated fields are suffixed by their index, e.g. grpc.tags.0, and the messages of the
+// client streams are added under the same names. gRPC-Web trailers frames are skipped.
+func (d *Descriptors) Decode(path string, body []byte, add func(name, value string)) error {
+	var msg *message
+	if d != nil {
+		msg = d.methods[path]
+	}
+
+	for len(body) > 0 {
+		if len(body) < frameHeaderSize {
+			return errTruncated
+		}
+		flags := body[0]
+		size := binary.BigEndian.Uint32(body[1:frameHeaderSize])
+		body = body[frameHeaderSize:]
+		if uint64(size) > uint64(len(body)) {
+			return errTruncated
+		}
+		payload := body[:size]
+		body = body[size:]
+
+		if flags&frameFlagTrailers != 0 {
+			continue
+		}
+		if flags&frameFlagCompressed != 0 {
+			return ErrCompressed
+		}
+		if err := decodeMessage(ArgumentPrefix, msg, payload, 0, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeMessage(prefix string, msg *message, data []byte, depth int, add func(name, value string)) error {
+	if depth >= maxDepth {
+		return fmt.Errorf("messages nested deeper than %d", maxDepth)
+	}
+
+	var indexes map[uint64]int
+	nextName := func(num uint64, f *field) string {
+		name := prefix + "." + f.name
+		if !f.repeated {
+			return name
+		}
+		if indexes == nil {
+			indexes = map[uint64]int{}
+		}
+		index := indexes[num]
+		indexes[num]++
+		return name + "." + strconv.Itoa(index)
+	}
+
+	return readFields(data, func(v wireValue) error {
+		var f *field
+		if msg != nil {
+			f = msg.fields[v.num]
+		}
+		if f == nil || f.typ == typeGroup {
+			add(prefix+"."+strconv.FormatUint(v.num, 10), unknownValue(v))
+			return nil
+		}
+
+		switch {
+		case f.typ == typeMessage && v.typ == wireBytes:
+			return decodeMessage(nextName(v.num, f), f.message, v.bytes, depth+1, add)
+		case f.typ == typeString || f.typ == typeBytes || f.typ == typeMessage:
+			add(nextName(v.num, f), unknownValue(v))
+		case v.typ == wireBytes:
+			// Packed repeated scalars.
+			num := v.num
+			return readPacked(f.typ, v.bytes, func(v wireValue) {
+				add(nextName(num, f), scalarValue(f.typ, v))
+			})
+		default:
+			add(nextName(v.num, f), scalarValue(f.typ, v))
+		}
+		return nil
+	})
+}
+
+// scalarValue formats a numeric or boolean value according to the type of its field.
+func scalarValue(typ uint64, v wireValue) string {
+	switch typ {
+	case typeDouble:
+		return strconv.FormatFloat(math.Float64frombits(v.varint), 'g', -1, 64)
+	case typeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(v.varint))), 'g', -1, 32)
+	case typeInt64, typeSfixed64:
+		return strconv.FormatInt(int64(v.varint), 10)
+	case typeInt32, typeSfixed32, typeEnum:
+		return strconv.FormatInt(int64(int32(v.varint)), 10)
+	case typeSint32, typeSint64:
+		return strconv.FormatInt(int64(v.varint>>1)^-int64(v.varint&1), 10)
+	case typeBool:
+		return strconv.FormatBool(v.varint != 0)
+	default:
+		return strconv.FormatUint(v.varint, 10)
+	}
+}
+
+// unknownValue formats a value regardless of the type of its field.
+func unknownValue(v wireValue) string {
+	if v.typ == wireBytes {
+		return string(v.bytes)
+	}
+	return strconv.FormatUint(v.varint, 10)
+}
+
+// wireValue is a field of an encoded message. The values of the varint and fixed-size fields
+// are held by varint, the ones of the length-delimited fields by bytes.
+type wireValue struct {
+	num    uint64
+	typ    uint64
+	varint uint64
+	bytes  []byte
+}
+
+// readFields calls fn for each field of an encoded message.
+func readFields(data []byte, fn func(v wireValue) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+
+		v := wireValue{num: tag >> 3, typ: tag & 7}
+		switch v.typ {
+		case wireVarint:
+			if v.varint, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+		case wireFixed64:
+			if n = 8; len(data) < n {
+				return errTruncated
+			}
+			v.varint = binary.LittleEndian.Uint64(data)
+		case wireFixed32:
+			if n = 4; len(data) < n {
+				return errTruncated
+			}
+			v.varint = uint64(binary.LittleEndian.Uint32(data))
+		case wireBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return errTruncated
+			}
+			v.bytes = data[m : m+int(size)]
+			n = m + int(size)
+		default:
+			return fmt.Errorf("unsupported wire type %d", v.typ)
+		}
+		data = data[n:]
+
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPacked calls fn for each value of a packed repeated field of the given type.
+func readPacked(typ uint64, data []byte, fn func(v wireValue)) error {
+	for len(data) > 0 {
+		var v wireValue
+		switch typ {
+		case typeDouble, typeFixed64, typeSfixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			v.varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case typeFloat, typeFixed32, typeSfixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			v.varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			var n int
+			if v.varint, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		}
+		fn(v)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package grpcbody
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoDescriptorSet describes testdata/echo.proto.
+//
+//go:embed testdata/echo.pb
+var echoDescriptorSet []byte
+
+const echoPath = "/echo.v1.EchoService/Echo"
+
+func varintField(num int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num)<<3|wireVarint), v)
+}
+
+func bytesField(num int, v []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func fixed64Field(num int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func frame(flags byte, fields ...[]byte) []byte {
+	var msg []byte
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	b := binary.BigEndian.AppendUint32([]byte{flags}, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+type arg struct {
+	name  string
+	value string
+}
+
+func decode(t *testing.T, d *Descriptors, path string, body []byte) ([]arg, error) {
+	t.Helper()
+	var args []arg
+	err := d.Decode(path, body, func(name, value string) {
+		args = append(args, arg{name, value})
+	})
+	return args, err
+}
+
+func TestDecode(t *testing.T) {
+	d, err := ParseDescriptorSet(echoDescriptorSet)
+	require.NoError(t, err)
+
+	negative := int64(-3)
+	request := frame(0,
+		bytesField(1, []byte("hello")),
+		bytesField(2, append(bytesField(1, []byte("yogi")), varintField(2, 7)...)), // 7 is the zigzag encoding of -4
+		bytesField(3, []byte("a")),
+		bytesField(3, []byte("b")),
+		bytesField(4, append(binary.AppendUvarint(nil, 1), binary.AppendUvarint(nil, uint64(negative))...)),
+		varintField(5, 1),
+		fixed64Field(6, math.Float64bits(0.5)),
+		bytesField(9, []byte("unknown")),
+	)
+
+	testCases := map[string]struct {
+		descriptors *Descriptors
+		path        string
+		body        []byte
+		expected    []arg
+		expectedErr error
+	}{
+		"described method": {
+			descriptors: d,
+			path:        echoPath,
+			body:        request,
+			expected: []arg{
+				{"grpc.message", "hello"},
+				{"grpc.user.name", "yogi"},
+				{"grpc.user.age", "-4"},
+				{"grpc.tags.0", "a"},
+				{"grpc.tags.1", "b"},
+				{"grpc.codes.0", "1"},
+				{"grpc.codes.1", "-3"},
+				{"grpc.urgent", "true"},
+				{"grpc.ratio", "0.5"},
+				{"grpc.9", "unknown"},
+			},
+		},
+		"unknown method": {
+			descriptors: d,
+			path:        "/echo.v1.EchoService/Unknown",
+			body:        frame(0, bytesField(1, []byte("hello")), varintField(5, 1)),
+			expected:    []arg{{"grpc.1", "hello"}, {"grpc.5", "1"}},
+		},
+		"no descriptors": {
+			path:     echoPath,
+			body:     frame(0, bytesField(1, []byte("hello"))),
+			expected: []arg{{"grpc.1", "hello"}},
+		},
+		"client stream": {
+			descriptors: d,
+			path:        echoPath,
+			body:        append(frame(0, bytesField(1, []byte("hello"))), frame(0, bytesField(1, []byte("world")))...),
+			expected:    []arg{{"grpc.message", "hello"}, {"grpc.message", "world"}},
+		},
+		"gRPC-Web trailers": {
+			descriptors: d,
+			path:        echoPath,
+			body:        append(frame(0, bytesField(1, []byte("hello"))), frame(frameFlagTrailers, []byte("grpc-status:0\r\n"))...),
+			expected:    []arg{{"grpc.message", "hello"}},
+		},
+		"compressed message": {
+			descriptors: d,
+			path:        echoPath,
+			body:        frame(frameFlagCompressed, []byte{0x1f, 0x8b}),
+			expectedErr: ErrCompressed,
+		},
+		"truncated frame": {
+			descriptors: d,
+			path:        echoPath,
+			body:        frame(0, bytesField(1, []byte("hello")))[:8],
+			expectedErr: errTruncated,
+		},
+		"truncated field": {
+			descriptors: d,
+			path:        echoPath,
+			body:        frame(0, bytesField(1, []byte("hello"))[:4]),
+			expectedErr: errTruncated,
+		},
+	}
+
+	for name, tCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			args, err := decode(t, tCase.descriptors, tCase.path, tCase.body)
+			if tCase.expectedErr != nil {
+				require.ErrorIs(t, err, tCase.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tCase.expected, args)
+		})
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	d, err := ParseDescriptorSet(echoDescriptorSet)
+	require.NoError(t, err)
+
+	// The user is nested at depth 1, followed by its managers.
+	user := bytesField(1, []byte("yogi"))
+	for i := 1; i < maxDepth-1; i++ {
+		user = bytesField(3, user)
+	}
+	_, err = decode(t, d, echoPath, frame(0, bytesField(2, user)))
+	require.NoError(t, err)
+
+	_, err = decode(t, d, echoPath, frame(0, bytesField(2, bytesField(3, user))))
+	require.EqualError(t, err, "messages nested deeper than 32")
+}
+
+func TestParseDescriptorSet(t *testing.T) {
+	_, err := ParseDescriptorSet([]byte{0x0a, 0x05})
+	require.ErrorIs(t, err, errTruncated)
+
+	// A file whose message refers to a type not included in the set.
+	file := append(bytesField(2, []byte("pkg")), bytesField(4, append(bytesField(1, []byte("Msg")),
+		bytesField(2, append(append(append(bytesField(1, []byte("other")), varintField(3, 1)...), varintField(5, typeMessage)...), bytesField(6, []byte(".pkg.Other"))...))...))...)
+	_, err = ParseDescriptorSet(bytesField(1, file))
+	require.EqualError(t, err, `unknown type ".pkg.Other" of field pkg.Msg.other`)
+}
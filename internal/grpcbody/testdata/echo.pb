@@ -0,0 +1,19 @@
+
+
+
+echo.protoecho.v1"
+EchoRequest
+message (	Rmessage-
+user (2.echo.v1.EchoRequest.UserRuser
+tags (	Rtags
+codes (Rcodes
+urgent (Rurgent
+ratio (Rratioa
+User
+name (	Rname
+age (Rage3
+manager (2.echo.v1.EchoRequest.UserRmanager"(
+EchoResponse
+message (	Rmessage2B
+EchoService3
+Echo.echo.v1.EchoRequest.echo.v1.EchoResponsebproto3
\ No newline at end of file
@@ -0,0 +1,133 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package redact implements the redaction of sensitive data from the audit logs and the
+// logs of the matched rules, before they leave the plugin.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultReplacement replaces the redacted data unless configured otherwise.
+const DefaultReplacement = "[REDACTED]"
+
+// minValueLength is the minimum length of the sensitive values replaced wherever they appear.
+// Shorter values are hardly secrets and replacing them would garble the logs.
+const minValueLength = 4
+
+// Policy tells which data is sensitive: the values of the headers and the arguments with the
+// given names, and the data matching the given patterns.
+type Policy struct {
+	headers     map[string]struct{}
+	args        map[string]struct{}
+	formArgsRx  *regexp.Regexp
+	jsonArgsRx  *regexp.Regexp
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+// NewPolicy creates a redaction policy. Header and argument names are case-insensitive, an
+// empty replacement defaults to DefaultReplacement.
+func NewPolicy(headers []string, args []string, patterns []string, replacement string) (*Policy, error) {
+	p := &Policy{
+		headers:     make(map[string]struct{}, len(headers)),
+		args:        make(map[string]struct{}, len(args)),
+		replacement: replacement,
+	}
+	if p.replacement == "" {
+		p.replacement = DefaultReplacement
+	}
+
+	for _, h := range headers {
+		p.headers[strings.ToLower(h)] = struct{}{}
+	}
+
+	if len(args) > 0 {
+		quotedArgs := make([]string, 0, len(args))
+		for _, a := range args {
+			p.args[strings.ToLower(a)] = struct{}{}
+			quotedArgs = append(quotedArgs, regexp.QuoteMeta(a))
+		}
+		names := strings.Join(quotedArgs, "|")
+		// Arguments are redacted in URL-encoded data (e.g. the query), in "k=v," lists and in
+		// JSON objects.
+		p.formArgsRx = regexp.MustCompile(`(?i)((?:^|[?&;,\s])(?:` + names + `)=)[^&;,\s"]*`)
+		p.jsonArgsRx = regexp.MustCompile(`(?i)("(?:` + names + `)"\s*:\s*)(?:"(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+	}
+
+	for _, pattern := range patterns {
+		rx, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		p.patterns = append(p.patterns, rx)
+	}
+
+	return p, nil
+}
+
+// Replacement returns the string replacing the redacted data.
+func (p *Policy) Replacement() string {
+	return p.replacement
+}
+
+// IsSensitiveHeader tells whether the values of the header have to be redacted.
+func (p *Policy) IsSensitiveHeader(name string) bool {
+	_, ok := p.headers[strings.ToLower(name)]
+	return ok
+}
+
+// IsSensitiveArg tells whether the values of the argument have to be redacted.
+func (p *Policy) IsSensitiveArg(name string) bool {
+	_, ok := p.args[strings.ToLower(name)]
+	return ok
+}
+
+// Headers returns a copy of the headers with the values of the sensitive ones redacted.
+func (p *Policy) Headers(headers map[string][]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+
+	redacted := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		if p.IsSensitiveHeader(name) {
+			redactedValues := make([]string, len(values))
+			for i := range values {
+				redactedValues[i] = p.replacement
+			}
+			values = redactedValues
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// String redacts the sensitive data of a string: the given sensitive values (e.g. the values
+// of the sensitive headers of the transaction), the values of the sensitive arguments and the
+// data matching the patterns.
+func (p *Policy) String(s string, sensitiveValues ...string) string {
+	for _, v := range sensitiveValues {
+		if len(v) >= minValueLength && v != p.replacement {
+			s = strings.ReplaceAll(s, v, p.replacement)
+		}
+	}
+
+	if p.formArgsRx != nil {
+		s = p.formArgsRx.ReplaceAllString(s, "${1}"+escapeTemplate(p.replacement))
+		s = p.jsonArgsRx.ReplaceAllString(s, "${1}"+escapeTemplate(`"`+p.replacement+`"`))
+	}
+
+	for _, rx := range p.patterns {
+		s = rx.ReplaceAllLiteralString(s, p.replacement)
+	}
+	return s
+}
+
+// escapeTemplate escapes s to be used literally in a regexp replacement template.
+func escapeTemplate(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
@@ -0,0 +1,52 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package redact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestString(t *testing.T) {
+	p, err := NewPolicy([]string{"Authorization"}, []string{"password", "api_key"}, []string{`eyJ[\w-]+\.[\w-]+\.[\w-]+`}, "")
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		input           string
+		sensitiveValues []string
+		expected        string
+	}{
+		"query":            {input: "/login?user=foo&password=bar&next=/", expected: "/login?user=foo&password=[REDACTED]&next=/"},
+		"args list":        {input: "user=foo,PASSWORD=bar,", expected: "user=foo,PASSWORD=[REDACTED],"},
+		"json string":      {input: `{"user":"foo","password":"b\"ar"}`, expected: `{"user":"foo","password":"[REDACTED]"}`},
+		"json number":      {input: `{"api_key": 1234}`, expected: `{"api_key": "[REDACTED]"}`},
+		"similar arg name": {input: "old_password=bar", expected: "old_password=bar"},
+		"pattern":          {input: "Bearer eyJhbGc.eyJzdWIi.c2lnbmF0dXJl", expected: "Bearer [REDACTED]"},
+		"sensitive values": {input: "Matched s3cr3t within ARGS", sensitiveValues: []string{"s3cr3t"}, expected: "Matched [REDACTED] within ARGS"},
+		"short values":     {input: "a b c", sensitiveValues: []string{"b"}, expected: "a b c"},
+	}
+
+	for name, tCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tCase.expected, p.String(tCase.input, tCase.sensitiveValues...))
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	p, err := NewPolicy([]string{"authorization"}, nil, nil, "***")
+	require.NoError(t, err)
+
+	headers := map[string][]string{
+		"Authorization": {"Bearer foo", "Basic bar"},
+		"Accept":        {"*/*"},
+	}
+	require.Equal(t, map[string][]string{
+		"Authorization": {"***", "***"},
+		"Accept":        {"*/*"},
+	}, p.Headers(headers))
+	// The headers are copied rather than modified.
+	require.Equal(t, "Bearer foo", headers["Authorization"][0])
+}
@@ -55,7 +55,8 @@ func runCorazaE2e(envoyHost, httpbinHost string) error {
 // It is meant to check that HTTP2 request payloads with trailers are scanned at phase 2 before being sent to upstream.
 // This might happen because the end_of_stream parameter from OnHttpRequestBody is never set to true in HTTP2 if trailers
 // are available. In order to mitigate this, OnHttp[Request|Response]Trailers callbacks have been implemented as an enforcement
-// point of the body phase rules.
+// point of the body phase rules. The request trailers, e.g. smuggling a payload, are also inspected by the body phase rules
+// as request headers.
 // The test expects Coraza to enforce the interruption (403) during phase="http_request_body" and not phase="http_response_headers",
 // which would mean that the payload was sent to upstream before being scanned and was blocked on the way back.
 func runHttpTrailerE2e(envoyHost string) error {
@@ -100,32 +101,51 @@ func runHttpTrailerE2e(envoyHost string) error {
 		return fmt.Errorf("timeout waiting for Envoy")
 	}
 
-	// Run the actual test.
-	req, err := http.NewRequest("POST", "https://"+envoyHost, strings.NewReader("{\"foo\": \"<script foo>\"}"))
-	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+	// Run the actual tests: the payload is either sent in the body, followed by a trailer, or in the trailer itself.
+	tests := []struct {
+		name    string
+		body    string
+		trailer http.Header
+	}{
+		{
+			name:    "payload in the body",
+			body:    "{\"foo\": \"<script foo>\"}",
+			trailer: http.Header{"Custom-Trailer": {"This is a custom trailer"}},
+		},
+		{
+			name:    "payload in the trailer",
+			body:    "{\"foo\": \"bar\"}",
+			trailer: http.Header{"X-Smuggled": {"<script foo>"}},
+		},
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Trailer = http.Header{"Custom-Trailer": {"This is a custom trailer"}}
+	for i, test := range tests {
+		req, err := http.NewRequest("POST", "https://"+envoyHost, strings.NewReader(test.body))
+		if err != nil {
+			return fmt.Errorf("creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Trailer = test.trailer
 
-	resp, err := client.Do(req)
-	if err != nil {
-		sh.RunV("docker", "compose", "-f", dockerComposeFilePath, "logs", "envoy")
-		return fmt.Errorf("sending request: %w", err)
-	}
-	defer resp.Body.Close()
+		resp, err := client.Do(req)
+		if err != nil {
+			sh.RunV("docker", "compose", "-f", dockerComposeFilePath, "logs", "envoy")
+			return fmt.Errorf("%s: sending request: %w", test.name, err)
+		}
+		resp.Body.Close()
 
-	output, err := sh.Output("docker", "compose", "-f", dockerComposeFilePath, "logs", "envoy")
-	if err != nil {
-		return fmt.Errorf("getting envoy logs: %w", err)
-	}
+		output, err := sh.Output("docker", "compose", "-f", dockerComposeFilePath, "logs", "envoy")
+		if err != nil {
+			return fmt.Errorf("getting envoy logs: %w", err)
+		}
 
-	// The request is expected to be blocked at phase 2, before reaching the backend.
-	if resp.StatusCode != http.StatusForbidden {
-		return fmt.Errorf("unexpected status code: got %d, want %d", resp.StatusCode, http.StatusForbidden)
-	}
-	if !strings.Contains(output, "phase=\"http_request_body\"") {
-		return fmt.Errorf("expected phase=\"http_request_body\" in envoy logs transaction interrupted line, got:\n%s", output)
+		// The request is expected to be blocked at phase 2, before reaching the backend.
+		if resp.StatusCode != http.StatusForbidden {
+			return fmt.Errorf("%s: unexpected status code: got %d, want %d", test.name, resp.StatusCode, http.StatusForbidden)
+		}
+		// The logs of the previous tests are included.
+		if strings.Count(output, "phase=\"http_request_body\"") <= i {
+			return fmt.Errorf("%s: expected phase=\"http_request_body\" in envoy logs transaction interrupted line, got:\n%s", test.name, output)
+		}
 	}
 	fmt.Printf("✅ HTTP trailer test passed\n")
 
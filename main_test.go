@@ -5,16 +5,25 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 
@@ -560,76 +569,92 @@ func TestLifecycle(t *testing.T) {
 	})
 }
 
-func TestBadConfig(t *testing.T) {
+func TestResponseBodyInterruption(t *testing.T) {
+	respBody := []byte(`Hello, yogi!`)
+
 	tests := []struct {
-		name string
-		conf string
-		msg  string
+		name                 string
+		interruption         string
+		chunked              bool
+		responseHdrsAction   types.Action
+		responseBodyAction   types.Action
+		expectedStatus       int
+		expectedBody         string
+		expectedRespHeaders  [][2]string
+		unexpectedRespHeader string
 	}{
 		{
-			name: "bad json",
-			conf: "{",
-			msg:  `Failed to parse plugin configuration:`,
+			name:                "replace, fixed length",
+			interruption:        `{"body": "{\"error\":\"blocked\"}", "content_type": "application/json"}`,
+			responseHdrsAction:  types.ActionPause,
+			responseBodyAction:  types.ActionContinue,
+			expectedBody:        `{"error":"blocked"}`,
+			expectedRespHeaders: [][2]string{{":status", "403"}, {"content-length", "19"}, {"content-type", "application/json"}},
 		},
-	}
-
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-			t.Run(tt.name, func(t *testing.T) {
-				opt := proxytest.
-					NewEmulatorOption().
-					WithVMContext(vm).
-					WithPluginConfiguration([]byte(tt.conf))
-
-				host, reset := proxytest.NewHostEmulator(opt)
-				defer reset()
-
-				require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
-
-				logs := strings.Join(host.GetCriticalLogs(), "\n")
-				require.Contains(t, logs, tt.msg)
-			})
-		}
-	})
-}
-
-func TestBadRequest(t *testing.T) {
-	tests := []struct {
-		name    string
-		reqHdrs [][2]string
-		msg     string
-	}{
 		{
-			name: "missing path",
-			reqHdrs: [][2]string{
-				{":method", "GET"},
-				{":authority", "localhost"},
-			},
-			msg: "Failed to get :path",
+			name:                "replace, configured status",
+			interruption:        `{"status": 451}`,
+			responseHdrsAction:  types.ActionPause,
+			responseBodyAction:  types.ActionContinue,
+			expectedRespHeaders: [][2]string{{":status", "451"}, {"content-length", "0"}},
 		},
 		{
-			name: "missing method",
-			reqHdrs: [][2]string{
-				{":path", "/hello"},
-				{":authority", "localhost"},
-			},
-			msg: "Failed to get :method",
+			name:                 "replace, chunked",
+			interruption:         `{"strategy": "replace", "body": "blocked"}`,
+			chunked:              true,
+			responseHdrsAction:   types.ActionPause,
+			responseBodyAction:   types.ActionContinue,
+			expectedBody:         "blocked",
+			expectedRespHeaders:  [][2]string{{":status", "403"}, {"content-type", "text/plain"}},
+			unexpectedRespHeader: "content-length",
 		},
 		{
-			name: "missing method and path",
-			reqHdrs: [][2]string{
-				{":authority", "localhost"},
-			},
-			msg: "Failed to get :method",
+			name:                "truncate, fixed length",
+			interruption:        `{"strategy": "truncate"}`,
+			responseHdrsAction:  types.ActionContinue,
+			responseBodyAction:  types.ActionContinue,
+			expectedRespHeaders: [][2]string{{":status", "200"}, {"content-length", "12"}},
+		},
+		{
+			name:                 "truncate, chunked",
+			interruption:         `{"strategy": "truncate"}`,
+			chunked:              true,
+			responseHdrsAction:   types.ActionContinue,
+			responseBodyAction:   types.ActionContinue,
+			unexpectedRespHeader: "content-length",
+		},
+		{
+			name:               "abort, fixed length",
+			interruption:       `{"strategy": "abort"}`,
+			responseHdrsAction: types.ActionPause,
+			responseBodyAction: types.ActionPause,
+			expectedStatus:     403,
+		},
+		{
+			name:               "abort, chunked",
+			interruption:       `{"strategy": "abort"}`,
+			chunked:            true,
+			responseHdrsAction: types.ActionPause,
+			responseBodyAction: types.ActionPause,
+			expectedStatus:     403,
 		},
 	}
 
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-			t.Run(tt.name, func(t *testing.T) {
-				conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecResponseBodyAccess On",
+						"SecResponseBodyMimeType text/plain",
+						"SecRule RESPONSE_BODY \"@contains yogi\" \"id:101,phase:4,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"response_body_interruption": %s
+				}`, tt.interruption)
+
 				opt := proxytest.
 					NewEmulatorOption().
 					WithVMContext(vm).
@@ -641,44 +666,88 @@ func TestBadRequest(t *testing.T) {
 				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
 
 				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true))
 
-				action := host.CallOnRequestHeaders(id, tt.reqHdrs, false)
-				require.Equal(t, types.ActionContinue, action)
+				respHdrs := [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+				}
+				if !tt.chunked {
+					respHdrs = append(respHdrs, [2]string{"content-length", strconv.Itoa(len(respBody))})
+				}
+				require.Equal(t, tt.responseHdrsAction, host.CallOnResponseHeaders(id, respHdrs, false))
+				require.Equal(t, types.ActionPause, host.CallOnResponseBody(id, respBody[:6], false))
+				require.Equal(t, tt.responseBodyAction, host.CallOnResponseBody(id, respBody[6:], true))
 
-				logs := strings.Join(host.GetErrorLogs(), "\n")
-				require.Contains(t, logs, tt.msg)
+				host.CompleteHttpContext(id)
+
+				if tt.expectedStatus != 0 {
+					localResponse := host.GetSentLocalResponse(id)
+					require.NotNil(t, localResponse)
+					require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
+					return
+				}
+
+				require.Nil(t, host.GetSentLocalResponse(id))
+				require.Equal(t, tt.expectedBody, string(host.GetCurrentResponseBody(id)))
+				respHeaders := host.GetCurrentResponseHeaders(id)
+				for _, h := range tt.expectedRespHeaders {
+					require.Contains(t, respHeaders, h)
+				}
+				if tt.unexpectedRespHeader != "" {
+					for _, h := range respHeaders {
+						require.NotEqual(t, tt.unexpectedRespHeader, h[0])
+					}
+				}
 			})
-		}
-	})
+		})
+	}
 }
 
-func TestBadResponse(t *testing.T) {
+func TestGRPCInterruption(t *testing.T) {
 	tests := []struct {
-		name     string
-		reqHdrs  [][2]string
-		respHdrs [][2]string
-		msg      string
+		name               string
+		contentType        string
+		interruption       string
+		expectedGRPCStatus int32
+		expectedMessage    string
 	}{
 		{
-			name: "missing path",
-			respHdrs: [][2]string{
-				{"content-length", "12"},
-				{":authority", "localhost"},
-			},
-			reqHdrs: [][2]string{
-				{":path", "/hello"},
-				{":method", "GET"},
-				{":authority", "localhost"},
-			},
-			msg: "Failed to get :status",
+			name:               "gRPC request, default status",
+			contentType:        "application/grpc",
+			expectedGRPCStatus: 7,
+		},
+		{
+			name:               "gRPC request, configured status and message",
+			contentType:        "application/grpc+proto",
+			interruption:       `, "grpc_interruption": {"status": 16, "message": "blocked by WAF"}`,
+			expectedGRPCStatus: 16,
+			expectedMessage:    "blocked by WAF",
+		},
+		{
+			name:               "HTTP request",
+			contentType:        "application/json",
+			interruption:       `, "grpc_interruption": {"status": 16, "message": "blocked by WAF"}`,
+			expectedGRPCStatus: -1,
 		},
 	}
 
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-			t.Run(tt.name, func(t *testing.T) {
-				conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRule REQUEST_URI \"@contains admin\" \"id:101,phase:1,deny,status:403\""
+					]},
+					"default_directives": "default"%s
+				}`, tt.interruption)
+
 				opt := proxytest.
 					NewEmulatorOption().
 					WithVMContext(vm).
@@ -690,134 +759,213 @@ func TestBadResponse(t *testing.T) {
 				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
 
 				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionPause, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin.Service/Delete"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}, false))
 
-				host.CallOnRequestHeaders(id, tt.reqHdrs, false)
-
-				action := host.CallOnResponseHeaders(id, tt.respHdrs, false)
-				require.Equal(t, types.ActionContinue, action)
+				host.CompleteHttpContext(id)
 
-				logs := strings.Join(host.GetErrorLogs(), "\n")
-				require.Contains(t, logs, tt.msg)
+				localResponse := host.GetSentLocalResponse(id)
+				require.NotNil(t, localResponse)
+				require.EqualValues(t, 403, localResponse.StatusCode)
+				require.Equal(t, tt.expectedGRPCStatus, localResponse.GRPCStatus)
+				require.Equal(t, tt.expectedMessage, string(localResponse.Data))
 			})
-		}
-	})
+		})
+	}
 }
 
-func TestPerAuthorityDirectives(t *testing.T) {
+func TestGRPCBodyDecoding(t *testing.T) {
+	descriptorSet, err := os.ReadFile(filepath.Join("internal", "grpcbody", "testdata", "echo.pb"))
+	require.NoError(t, err)
+
+	// EchoRequest{message: "hello", user: {name: <name>}}, framed as an uncompressed gRPC message.
+	echoRequest := func(name string) []byte {
+		user := append([]byte{0x0a, byte(len(name))}, name...)
+		msg := append([]byte{0x0a, 0x05}, "hello"...)
+		msg = append(append(msg, 0x12, byte(len(user))), user...)
+		return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+	}
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
 	tests := []struct {
-		name                    string
-		reqHdrs                 [][2]string
-		conf                    string
-		localResponseIsNil      bool
-		localResponseStatusCode int
+		name              string
+		contentType       string
+		contentEncoding   string
+		body              []byte
+		requestBodyAction types.Action
 	}{
 		{
-			name: "authority exist on per_authority_directives",
-			reqHdrs: [][2]string{
-				{":path", "/rs1"},
-				{":method", "GET"},
-				{":authority", "foo.example.com"},
-			},
-			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
-			localResponseStatusCode: 403,
+			name:              "gRPC, safe",
+			contentType:       "application/grpc",
+			body:              echoRequest("yogi"),
+			requestBodyAction: types.ActionContinue,
 		},
 		{
-			name: "authority exist on per_authority_directives but calling allowed path",
-			reqHdrs: [][2]string{
-				{":path", "/admin"},
-				{":method", "GET"},
-				{":authority", "foo.example.com"},
-			},
-			conf:               `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
-			localResponseIsNil: true,
+			name:              "gRPC, attack",
+			contentType:       "application/grpc",
+			body:              echoRequest("<script>"),
+			requestBodyAction: types.ActionPause,
 		},
 		{
-			name: "authority not exist on per_authority_directives",
-			reqHdrs: [][2]string{
-				{":path", "/admin"},
-				{":method", "GET"},
-				{":authority", "bar.example.com"},
-			},
-			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
-			localResponseStatusCode: 403,
+			name:              "gRPC-Web text, attack",
+			contentType:       "application/grpc-web-text",
+			body:              []byte(base64.StdEncoding.EncodeToString(echoRequest("<script>"))),
+			requestBodyAction: types.ActionPause,
 		},
 		{
-			name: "authority not exist on per_authority_directives and no default",
-			reqHdrs: [][2]string{
-				{":path", "/admin"},
-				{":method", "GET"},
-				{":authority", "bar.example.com"},
-			},
-			conf:               `{"directives_map": {"rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "per_authority_directives":{"foo.example.com":"rs1"}}`,
-			localResponseIsNil: true,
+			name:              "gRPC-Web, gzip-encoded attack",
+			contentType:       "application/grpc-web+proto",
+			contentEncoding:   "gzip",
+			body:              gzipped(echoRequest("<script>")),
+			requestBodyAction: types.ActionPause,
 		},
 		{
-			name: "authority not exist on per_authority_directives but calling allowed value",
-			reqHdrs: [][2]string{
-				{":path", "/rs1"},
-				{":method", "GET"},
-				{":authority", "bar.example.com"},
-			},
-			conf:               `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
-			localResponseIsNil: true,
+			name:              "gRPC-Web text, gzip-encoded attack",
+			contentType:       "application/grpc-web-text",
+			contentEncoding:   "gzip",
+			body:              gzipped([]byte(base64.StdEncoding.EncodeToString(echoRequest("<script>")))),
+			requestBodyAction: types.ActionPause,
+		},
+		{
+			name:              "gRPC-Web, gzip-encoded safe",
+			contentType:       "application/grpc-web",
+			contentEncoding:   "gzip",
+			body:              gzipped(echoRequest("yogi")),
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "not gRPC",
+			contentType:       "application/octet-stream",
+			body:              echoRequest("<script>"),
+			requestBodyAction: types.ActionContinue,
 		},
 	}
 
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-			t.Run(tt.name, func(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecRule ARGS_POST:grpc.user.name \"@contains <script>\" \"id:101,phase:2,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"grpc_body_decoding": {"descriptor_set": %q},
+					"request_body_decompression": {}
+				}`, base64.StdEncoding.EncodeToString(descriptorSet))
+
 				opt := proxytest.
 					NewEmulatorOption().
 					WithVMContext(vm).
-					WithPluginConfiguration([]byte(tt.conf))
+					WithPluginConfiguration([]byte(conf))
 
 				host, reset := proxytest.NewHostEmulator(opt)
 				defer reset()
 
 				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
 
+				headers := [][2]string{
+					{":path", "/echo.v1.EchoService/Echo"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}
+				if tt.contentEncoding != "" {
+					headers = append(headers, [2]string{"content-encoding", tt.contentEncoding})
+				}
+
 				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, headers, false))
+				require.Equal(t, types.ActionPause, host.CallOnRequestBody(id, tt.body[:4], false))
+				require.Equal(t, tt.requestBodyAction, host.CallOnRequestBody(id, tt.body[4:], true))
 
-				host.CallOnRequestHeaders(id, tt.reqHdrs, false)
 				host.CompleteHttpContext(id)
 
-				pluginResp := host.GetSentLocalResponse(id)
-
-				if tt.localResponseIsNil {
-					require.Nil(t, pluginResp)
-					return
+				if tt.requestBodyAction == types.ActionPause {
+					require.NotNil(t, host.GetSentLocalResponse(id))
+				} else {
+					require.Nil(t, host.GetSentLocalResponse(id))
 				}
-
-				require.NotNil(t, pluginResp)
-				require.EqualValues(t, tt.localResponseStatusCode, pluginResp.StatusCode)
 			})
-		}
-	})
+		})
+	}
 }
 
-func TestEmptyBody(t *testing.T) {
-	testCases := []struct {
-		title                 string
-		isRespBodyProcessable bool
+func TestTrailers(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestTrailers   [][2]string
+		responseTrailers  [][2]string
+		requestBodyAction types.Action
+		responseBodyPhase bool
+		// The multiphase evaluation matches REQUEST_HEADERS and RESPONSE_HEADERS along with the
+		// headers phases, before the trailers are received.
+		disableWithMultiphase bool
 	}{
 		{
-			title:                 "Response body processable",
-			isRespBodyProcessable: true,
+			name:              "safe trailers",
+			requestTrailers:   [][2]string{{"x-checksum", "abc"}},
+			responseTrailers:  [][2]string{{"grpc-status", "0"}},
+			requestBodyAction: types.ActionContinue,
 		},
 		{
-			title:                 "Response body NOT processable",
-			isRespBodyProcessable: false,
+			name:                  "request trailer matched as a header",
+			requestTrailers:       [][2]string{{"x-payload", "<script>"}},
+			requestBodyAction:     types.ActionPause,
+			disableWithMultiphase: true,
+		},
+		{
+			name:              "header smuggled as a request trailer",
+			requestTrailers:   [][2]string{{"Content-Length", "0"}},
+			requestBodyAction: types.ActionPause,
+		},
+		{
+			name:                  "response trailer matched as a header",
+			responseTrailers:      [][2]string{{"grpc-message", "at org.example.Service.secret(Service.java:42)"}},
+			requestBodyAction:     types.ActionContinue,
+			responseBodyPhase:     true,
+			disableWithMultiphase: true,
 		},
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.title, func(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.disableWithMultiphase && multiphaseEvaluation {
+				t.Skip("not compatible with multiphaseEvaluation")
+			}
 			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := `
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecResponseBodyAccess On",
+						"SecResponseBodyMimeType text/plain",
+						"SecRule REQUEST_HEADERS \"@contains <script>\" \"id:101,phase:2,deny,status:403\"",
+						"SecRule TX:request_trailer_names \"@within content-length host transfer-encoding\" \"id:102,phase:2,deny,status:400\"",
+						"SecRule RESPONSE_HEADERS:grpc-message \"@contains .java:\" \"id:103,phase:4,deny,status:500\""
+					]},
+					"default_directives": "default"
+				}`
+
 				opt := proxytest.
 					NewEmulatorOption().
 					WithVMContext(vm).
-					WithPluginConfiguration([]byte(`{"directives_map": {"default": [ "SecRequestBodyAccess On", "SecResponseBodyAccess On", "SecResponseBodyMimeType text/plain"]}, "default_directives": "default"}`))
+					WithPluginConfiguration([]byte(conf))
 
 				host, reset := proxytest.NewHostEmulator(opt)
 				defer reset()
@@ -825,111 +973,604 @@ func TestEmptyBody(t *testing.T) {
 				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
 
 				id := host.InitializeHttpContext()
-				host.CallOnRequestHeaders(id, [][2]string{
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
 					{":path", "/hello"},
-					{":method", "GET"},
+					{":method", "POST"},
 					{":authority", "localhost"},
-				}, false)
-				action := host.CallOnRequestBody(id, []byte{}, false)
-				require.Equal(t, types.ActionPause, action)
-				action = host.CallOnRequestBody(id, []byte{}, true)
-				require.Equal(t, types.ActionContinue, action)
+				}, false))
+				require.Equal(t, types.ActionPause, host.CallOnRequestBody(id, []byte("name=yogi"), false))
+				require.Equal(t, tt.requestBodyAction, host.CallOnRequestTrailers(id, tt.requestTrailers))
+				if tt.requestBodyAction == types.ActionPause {
+					require.NotNil(t, host.GetSentLocalResponse(id))
+					host.CompleteHttpContext(id)
+					return
+				}
 
-				if tc.isRespBodyProcessable {
-					host.CallOnResponseHeaders(id, [][2]string{
-						{":status", "200"},
-						{"content-length", "0"},
-						{"content-type", "text/plain"}}, false)
+				host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}, {"content-type", "text/plain"}}, false)
+				host.CallOnResponseBody(id, []byte("Hello"), false)
+				host.CallOnResponseTrailers(id, tt.responseTrailers)
+				host.CompleteHttpContext(id)
 
-					action = host.CallOnResponseBody(id, []byte{}, false)
-					require.Equal(t, types.ActionPause, action)
-					action = host.CallOnResponseBody(id, []byte{}, true)
-					require.Equal(t, types.ActionContinue, action)
+				if tt.responseBodyPhase {
+					localResponse := host.GetSentLocalResponse(id)
+					require.Nil(t, localResponse)
+					// Without response_body_interruption, the buffered body is replaced with null bytes.
+					require.Equal(t, bytes.Repeat([]byte("\x00"), len("Hello")), host.GetCurrentResponseBody(id))
+					value, err := host.GetCounterMetric("waf_filter.tx.interruptions_ruleid=103_phase=http_response_body")
+					require.NoError(t, err)
+					require.Equal(t, uint64(1), value)
+					return
+				}
+				require.Nil(t, host.GetSentLocalResponse(id))
+			})
+		})
+	}
+}
+
+func TestHTTP2HeaderNormalization(t *testing.T) {
+	// The same request and response, as sent over HTTP/1.1 and HTTP/2, must be seen identically by the rules.
+	exchanges := []struct {
+		protocol        string
+		requestHeaders  [][2]string
+		responseHeaders [][2]string
+	}{
+		{
+			protocol: "HTTP/1.1",
+			requestHeaders: [][2]string{
+				{":path", "/hello"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+				{"cookie", "a=1; b=2"},
+				{"accept", "*/*"},
+			},
+			responseHeaders: [][2]string{{":status", "200"}, {"content-type", "text/plain"}},
+		},
+		{
+			protocol: "HTTP/2",
+			requestHeaders: [][2]string{
+				{":method", "GET"},
+				{":scheme", "https"},
+				{":authority", "localhost"},
+				{":path", "/hello"},
+				{"cookie", "a=1"},
+				{"accept", "*/*"},
+				{"cookie", "b=2"},
+			},
+			responseHeaders: [][2]string{{":status", "200"}, {"content-type", "text/plain"}},
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecAuditEngine On",
+				"SecAuditLogFormat JSON",
+				"SecAuditLogParts ABFZ",
+				"SecRule REQUEST_HEADERS_NAMES \"@beginsWith :\" \"id:101,phase:1,deny,status:400\"",
+				"SecRule &REQUEST_HEADERS:cookie \"!@eq 1\" \"id:102,phase:1,deny,status:400\"",
+				"SecRule REQUEST_COOKIES:b \"!@streq 2\" \"id:103,phase:1,deny,status:400\"",
+				"SecRule RESPONSE_HEADERS_NAMES \"@beginsWith :\" \"id:104,phase:3,deny,status:500\""
+			]},
+			"default_directives": "default"
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for _, exchange := range exchanges {
+			require.NoError(t, host.SetProperty([]string{"request", "protocol"}, []byte(exchange.protocol)))
+			id := host.InitializeHttpContext()
+			require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, exchange.requestHeaders, true), exchange.protocol)
+			require.Equal(t, types.ActionContinue, host.CallOnResponseHeaders(id, exchange.responseHeaders, true), exchange.protocol)
+			host.CompleteHttpContext(id)
+			require.Nil(t, host.GetSentLocalResponse(id), exchange.protocol)
+		}
+
+		type headers struct {
+			Request struct {
+				Headers map[string][]string `json:"headers"`
+			} `json:"request"`
+			Response struct {
+				Headers map[string][]string `json:"headers"`
+			} `json:"response"`
+		}
+		var audited []headers
+		for _, l := range host.GetInfoLogs() {
+			if entry, ok := strings.CutPrefix(l, "AuditLog:"); ok {
+				var e struct {
+					Transaction headers `json:"transaction"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(entry), &e), entry)
+				audited = append(audited, e.Transaction)
+			}
+		}
+		require.Len(t, audited, len(exchanges))
+		require.Equal(t, []string{"a=1; b=2"}, audited[0].Request.Headers["cookie"])
+		require.Equal(t, audited[0], audited[1])
+	})
+}
+
+func TestRequestBodyDecompression(t *testing.T) {
+	compress := func(encoding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w interface {
+			Write([]byte) (int, error)
+			Close() error
+		}
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		}
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	attack := []byte("name=<script>alert(1)</script>")
+
+	tests := []struct {
+		name              string
+		contentEncoding   string
+		body              []byte
+		limitAction       string
+		decompression     string
+		requestBodyAction types.Action
+		expectedStatus    int
+		expectedError     bool
+	}{
+		{
+			name:              "gzip, safe",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", []byte("name=yogi")),
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "gzip, attack",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", attack),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    403,
+		},
+		{
+			name:              "deflate, attack",
+			contentEncoding:   "deflate",
+			body:              compress("deflate", attack),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    403,
+		},
+		{
+			name:              "brotli, attack",
+			contentEncoding:   "br",
+			body:              compress("br", attack),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    403,
+		},
+		{
+			name:              "several encodings, attack",
+			contentEncoding:   "deflate, gzip",
+			body:              compress("gzip", compress("deflate", attack)),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    403,
+		},
+		{
+			name:              "identity, safe",
+			contentEncoding:   "identity",
+			body:              []byte("name=yogi"),
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "decompression bomb, rejected",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", bytes.Repeat([]byte("a"), 1024*1024)),
+			limitAction:       "Reject",
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    413,
+		},
+		{
+			name:              "decompression bomb, partially processed",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", bytes.Repeat([]byte("a"), 1024*1024)),
+			limitAction:       "ProcessPartial",
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "compression ratio exceeded, rejected",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", bytes.Repeat([]byte("a"), 32*1024)),
+			limitAction:       "Reject",
+			decompression:     `{"max_ratio": 10}`,
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    413,
+		},
+		{
+			name:              "decompressed size exceeded, partially processed",
+			contentEncoding:   "gzip",
+			body:              compress("gzip", append([]byte("name=yogi&pad="+strings.Repeat("a", 4096)+"&"), attack...)),
+			limitAction:       "ProcessPartial",
+			decompression:     `{"max_size": 1024}`,
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "attack beyond the limit, partially processed",
+			contentEncoding:   "br",
+			body:              compress("br", append([]byte("name=yogi&pad="+strings.Repeat("a", 128*1024)+"&"), attack...)),
+			limitAction:       "ProcessPartial",
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			name:              "invalid data",
+			contentEncoding:   "gzip",
+			body:              []byte("name=<script>"),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    400,
+			expectedError:     true,
+		},
+		{
+			name:              "unsupported encoding",
+			contentEncoding:   "zstd",
+			body:              []byte("name=yogi"),
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    400,
+			expectedError:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limitAction := tt.limitAction
+			if limitAction == "" {
+				limitAction = "Reject"
+			}
+			decompression := tt.decompression
+			if decompression == "" {
+				decompression = "{}"
+			}
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecRequestBodyLimit 65536",
+						"SecRequestBodyLimitAction %s",
+						"SecRule REQUEST_HEADERS:Content-Type \"@rx ^application/x-www-form-urlencoded\" \"id:100,phase:1,pass,nolog,ctl:requestBodyProcessor=URLENCODED\"",
+						"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+						"SecRule ARGS_POST:name \"@contains <script>\" \"id:102,phase:2,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"request_body_decompression": %s
+				}`, limitAction, decompression)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+					{"content-encoding", tt.contentEncoding},
+				}, false))
+				require.Equal(t, types.ActionPause, host.CallOnRequestBody(id, tt.body[:4], false))
+				require.Equal(t, tt.requestBodyAction, host.CallOnRequestBody(id, tt.body[4:], true))
+
+				if tt.expectedStatus != 0 {
+					localResponse := host.GetSentLocalResponse(id)
+					require.NotNil(t, localResponse)
+					require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
 				} else {
-					// If the ResponseBodyMimeType is not matched, we should just continue and not store the body
-					action = host.CallOnResponseBody(id, []byte{}, false)
-					require.Equal(t, types.ActionContinue, action)
-					action = host.CallOnResponseBody(id, []byte{}, true)
-					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					// The upstream receives the original body.
+					require.Equal(t, tt.body, host.GetCurrentRequestBody(id))
 				}
-				logs := strings.Join(host.GetCriticalLogs(), "\n")
-				require.Empty(t, logs)
+
+				_, err := host.GetCounterMetric("waf_filter.tx.request_body_decompression_error")
+				if tt.expectedError {
+					require.NoError(t, err)
+				} else {
+					require.Error(t, err)
+				}
+
+				host.CompleteHttpContext(id)
 			})
 		})
 	}
 }
 
-func TestLogError(t *testing.T) {
-	reqHdrs := [][2]string{
-		{":path", "/hello"},
-		{":method", "GET"},
-		{":authority", "localhost"},
-		{"X-CRS-Test", "for the win!"},
+func TestRequestBodyDecompressionWithCRS(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte("name=yogi&comment=" + strings.Repeat("a", 256*1024)))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	body := buf.Bytes()
+
+	tests := []struct {
+		limitAction       string
+		requestBodyAction types.Action
+		expectedStatus    int
+	}{
+		{
+			// A legitimate body exceeding SecRequestBodyLimit is not reported as a request body error.
+			limitAction:       "ProcessPartial",
+			requestBodyAction: types.ActionContinue,
+		},
+		{
+			limitAction:       "Reject",
+			requestBodyAction: types.ActionPause,
+			expectedStatus:    413,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.limitAction, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				// The CRS restricts the Content-Encoding request header, allowed along with the decompression.
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"Include @recommended-conf",
+						"SecRuleEngine On",
+						"SecRequestBodyLimitAction %s",
+						"Include @crs-setup-conf",
+						"SecAction \"id:900250,phase:1,pass,nolog,setvar:'tx.restricted_headers_basic=/proxy/ /lock-token/ /content-range/ /if/ /x-http-method-override/ /x-http-method/ /x-method-override/ /x-middleware-subrequest/'\"",
+						"Include @owasp_crs/*.conf"
+					]},
+					"default_directives": "default",
+					"request_body_decompression": {}
+				}`, tt.limitAction)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/comments"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"user-agent", "gotest"},
+					{"accept", "*/*"},
+					{"content-type", "application/x-www-form-urlencoded"},
+					{"content-encoding", "gzip"},
+				}, false))
+				require.Equal(t, tt.requestBodyAction, host.CallOnRequestBody(id, body, true))
+
+				localResponse := host.GetSentLocalResponse(id)
+				if tt.expectedStatus != 0 {
+					require.NotNil(t, localResponse)
+					require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
+				} else {
+					require.Nil(t, localResponse)
+					require.Equal(t, body, host.GetCurrentRequestBody(id))
+				}
+				require.NotContains(t, strings.Join(host.GetCriticalLogs(), "\n"), `[id "200002"]`)
+
+				_, err := host.GetCounterMetric("waf_filter.tx.request_body_decompression_error")
+				require.Error(t, err)
+
+				host.CompleteHttpContext(id)
+			})
+		})
+	}
+}
+
+func TestRequestBodyIncrementalDecompression(t *testing.T) {
+	flated := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
 	}
+	// Random data is not compressible, the compressed body being larger than the body limit.
+	random := make([]byte, 512*1024)
+	_, _ = rand.New(rand.NewSource(1)).Read(random)
+	// Empty stored blocks yield no data, the decompressor consuming them all at once.
+	emptyBlocks := bytes.Repeat([]byte{0x00, 0x00, 0x00, 0xff, 0xff}, 80*1024)
 
 	tests := []struct {
-		severity int
-		logs     func(host proxytest.HostEmulator) []string
+		name            string
+		body            []byte
+		chunks          int
+		expectedActions []types.Action
+		expectedStatus  int
 	}{
 		{
-			severity: 0,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetCriticalLogs()
-			},
+			name:            "body limit reached before the end",
+			body:            flated(random),
+			chunks:          4,
+			expectedActions: []types.Action{types.ActionPause, types.ActionPause},
+			expectedStatus:  413,
 		},
 		{
-			severity: 1,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetCriticalLogs()
-			},
+			name:            "decompression restarted at the end",
+			body:            append(emptyBlocks, flated([]byte("name=<script>alert(1)</script>"))...),
+			chunks:          2,
+			expectedActions: []types.Action{types.ActionPause, types.ActionPause},
+			expectedStatus:  403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := `
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecRequestBodyLimit 65536",
+						"SecRequestBodyLimitAction Reject",
+						"SecRule ARGS_POST:name \"@contains <script>\" \"id:102,phase:2,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"request_body_decompression": {}
+				}`
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+					{"content-encoding", "deflate"},
+				}, false))
+
+				chunkSize := len(tt.body)/tt.chunks + 1
+				for i, action := range tt.expectedActions {
+					chunk := tt.body[i*chunkSize : min((i+1)*chunkSize, len(tt.body))]
+					eos := (i+1)*chunkSize >= len(tt.body)
+					require.Equal(t, action, host.CallOnRequestBody(id, chunk, eos), "chunk %d", i)
+				}
+
+				localResponse := host.GetSentLocalResponse(id)
+				require.NotNil(t, localResponse)
+				require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
+
+				_, err := host.GetCounterMetric("waf_filter.tx.request_body_decompression_error")
+				require.Error(t, err)
+
+				host.CompleteHttpContext(id)
+			})
+		})
+	}
+}
+
+func TestResponseBodyDecompression(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name            string
+		body            []byte
+		limitAction     string
+		decompression   string
+		expectedError   bool
+		expectInterrupt bool
+	}{
+		{
+			name: "safe",
+			body: gzipped([]byte("Hello, yogi!")),
 		},
 		{
-			severity: 2,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetCriticalLogs()
-			},
+			name:            "leak",
+			body:            gzipped([]byte("You have an error in your SQL syntax")),
+			expectInterrupt: true,
 		},
 		{
-			severity: 3,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetErrorLogs()
-			},
+			name:        "decompression bomb, partially processed",
+			body:        gzipped(bytes.Repeat([]byte("a"), 1024*1024)),
+			limitAction: "ProcessPartial",
 		},
 		{
-			severity: 4,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetWarnLogs()
-			},
+			name:            "decompression bomb, rejected",
+			body:            gzipped(bytes.Repeat([]byte("a"), 1024*1024)),
+			limitAction:     "Reject",
+			expectInterrupt: true,
 		},
 		{
-			severity: 5,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetInfoLogs()
-			},
+			name:            "decompressed size exceeded, rejected",
+			body:            gzipped(bytes.Repeat([]byte("a"), 4096)),
+			limitAction:     "Reject",
+			decompression:   `{"max_size": 1024}`,
+			expectInterrupt: true,
 		},
 		{
-			severity: 6,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetInfoLogs()
-			},
+			name:          "compression ratio exceeded, partially processed",
+			body:          gzipped([]byte(strings.Repeat("a", 32*1024) + "You have an error in your SQL syntax")),
+			limitAction:   "ProcessPartial",
+			decompression: `{"max_ratio": 10}`,
 		},
 		{
-			severity: 7,
-			logs: func(host proxytest.HostEmulator) []string {
-				return host.GetDebugLogs()
-			},
+			name:        "leak beyond the limit, partially processed",
+			body:        gzipped([]byte(strings.Repeat("a", 128*1024) + "You have an error in your SQL syntax")),
+			limitAction: "ProcessPartial",
+		},
+		{
+			// The body is inspected as it is.
+			name:            "invalid data",
+			body:            []byte("You have an error in your SQL syntax"),
+			expectedError:   true,
+			expectInterrupt: true,
 		},
 	}
-	vmTest(t, func(t *testing.T, vm types.VMContext) {
-		for _, tc := range tests {
-			tt := tc
-			t.Run(fmt.Sprintf("severity %d", tt.severity), func(t *testing.T) {
-				conf := fmt.Sprintf(`{"directives_map": {"default": ["SecRule REQUEST_HEADERS:X-CRS-Test \"@rx ^.*$\" \"id:999999,phase:1,log,severity:%d,msg:'%%{MATCHED_VAR}',pass,t:none\""]}, "default_directives": "default"}`, tt.severity)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limitAction := tt.limitAction
+			if limitAction == "" {
+				limitAction = "ProcessPartial"
+			}
+			decompression := tt.decompression
+			if decompression == "" {
+				decompression = "{}"
+			}
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecResponseBodyAccess On",
+						"SecResponseBodyMimeType text/plain",
+						"SecResponseBodyLimit 65536",
+						"SecResponseBodyLimitAction %s",
+						"SecRule RESPONSE_BODY \"@contains SQL syntax\" \"id:101,phase:4,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"response_body_decompression": %s,
+					"response_body_interruption": {}
+				}`, limitAction, decompression)
 
 				opt := proxytest.
 					NewEmulatorOption().
 					WithVMContext(vm).
-					WithPluginConfiguration([]byte(strings.TrimSpace(conf)))
+					WithPluginConfiguration([]byte(conf))
 
 				host, reset := proxytest.NewHostEmulator(opt)
 				defer reset()
@@ -937,14 +1578,2016 @@ func TestLogError(t *testing.T) {
 				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
 
 				id := host.InitializeHttpContext()
-				action := host.CallOnRequestHeaders(id, reqHdrs, false)
-				require.Equal(t, types.ActionContinue, action)
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true))
 
-				logs := strings.Join(tt.logs(host), "\n")
-				require.Contains(t, logs, "for the win!")
+				require.Equal(t, types.ActionPause, host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+					{"content-encoding", "gzip"},
+					{"content-length", strconv.Itoa(len(tt.body))},
+				}, false))
+				require.Equal(t, types.ActionPause, host.CallOnResponseBody(id, tt.body[:4], false))
+				require.Equal(t, types.ActionContinue, host.CallOnResponseBody(id, tt.body[4:], true))
+
+				host.CompleteHttpContext(id)
+
+				require.Nil(t, host.GetSentLocalResponse(id))
+				respHeaders := host.GetCurrentResponseHeaders(id)
+				if tt.expectInterrupt {
+					// The safe body replacing the response is not encoded.
+					require.Empty(t, host.GetCurrentResponseBody(id))
+					require.Contains(t, respHeaders, [2]string{"content-length", "0"})
+					for _, h := range respHeaders {
+						require.NotEqual(t, "content-encoding", h[0])
+					}
+				} else {
+					// The client receives the original body.
+					require.Equal(t, tt.body, host.GetCurrentResponseBody(id))
+					require.Contains(t, respHeaders, [2]string{"content-encoding", "gzip"})
+				}
+
+				_, err := host.GetCounterMetric("waf_filter.tx.response_body_decompression_error")
+				if tt.expectedError {
+					require.NoError(t, err)
+				} else {
+					require.Error(t, err)
+				}
 			})
-		}
-	})
+		})
+	}
+}
+
+func TestRequestBodyStreaming(t *testing.T) {
+	tests := []struct {
+		name                    string
+		path                    string
+		contentType             string
+		chunks                  []string
+		responseStartedAt       int
+		expectedActions         []types.Action
+		expectedLastBody        string
+		expectedStatus          int
+		expectedLateCounter     uint64
+		expectedUnenforcedCount uint64
+	}{
+		{
+			name:              "safe chunks",
+			path:              "/upload",
+			chunks:            []string{"Hello, ", "yogi ", "bear!"},
+			responseStartedAt: -1,
+			expectedActions:   []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody:  "bear!",
+		},
+		{
+			name:              "payload in the first chunk",
+			path:              "/upload",
+			chunks:            []string{"the evil-payload", "is uploaded"},
+			responseStartedAt: -1,
+			expectedActions:   []types.Action{types.ActionPause},
+			expectedStatus:    403,
+		},
+		{
+			name:                "payload in a later chunk",
+			path:                "/upload",
+			chunks:              []string{"Hello, ", "the evil-payload ", "is uploaded"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause},
+			expectedStatus:      403,
+			expectedLateCounter: 1,
+		},
+		{
+			name:                "payload crossing chunks",
+			path:                "/upload",
+			chunks:              []string{"Hello, the evil-", "payload is uploaded"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause},
+			expectedStatus:      403,
+			expectedLateCounter: 1,
+		},
+		{
+			name:              "rule excluded in the request headers phase",
+			path:              "/excluded",
+			chunks:            []string{"Hello, ", "the evil-payload ", "is uploaded"},
+			responseStartedAt: -1,
+			expectedActions:   []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody:  "is uploaded",
+		},
+		{
+			name:                    "response already started",
+			path:                    "/upload",
+			chunks:                  []string{"Hello, ", "the evil-payload ", "is uploaded"},
+			responseStartedAt:       1,
+			expectedActions:         []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody:        "is uploaded",
+			expectedUnenforcedCount: 1,
+		},
+		{
+			name:                "urlencoded argument crossing chunks",
+			path:                "/upload",
+			contentType:         "application/x-www-form-urlencoded",
+			chunks:              []string{"name=yogi&pay", "load=evil%2Darg&x=1"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause},
+			expectedStatus:      403,
+			expectedLateCounter: 1,
+		},
+		{
+			name:                "urlencoded argument ending the body",
+			path:                "/upload",
+			contentType:         "application/x-www-form-urlencoded",
+			chunks:              []string{"name=yogi&payload=evil", "-arg"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause},
+			expectedStatus:      403,
+			expectedLateCounter: 1,
+		},
+		{
+			name:              "safe urlencoded arguments",
+			path:              "/upload",
+			contentType:       "application/x-www-form-urlencoded",
+			chunks:            []string{"name=yogi&payload=evil", "&arg=1"},
+			responseStartedAt: -1,
+			expectedActions:   []types.Action{types.ActionContinue, types.ActionContinue},
+			expectedLastBody:  "&arg=1",
+		},
+		{
+			// The look-behind holding the payload is not scored again with the next chunks.
+			name:                "anomaly score of the look-behind added once",
+			path:                "/upload",
+			chunks:              []string{"xx sneaky", "ab", "cd", "sneaky!"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue, types.ActionPause},
+			expectedStatus:      406,
+			expectedLateCounter: 1,
+		},
+		{
+			name:                "anomaly score accumulated across chunks",
+			path:                "/upload",
+			chunks:              []string{"sneaky pad pad pad ", "sneaky pad pad pad ", "is uploaded"},
+			responseStartedAt:   -1,
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause},
+			expectedStatus:      406,
+			expectedLateCounter: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := `
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecRule REQUEST_HEADERS:x-test \"@streq yes\" \"id:101,phase:1,pass,log\"",
+						"SecRule REQUEST_URI \"@beginsWith /excluded\" \"id:102,phase:1,pass,nolog,ctl:ruleRemoveById=201\"",
+						"SecRule REQUEST_BODY \"@contains evil-payload\" \"id:201,phase:2,deny,status:403,log\"",
+						"SecRule ARGS_POST:payload \"@streq evil-arg\" \"id:202,phase:2,deny,status:403,log\"",
+						"SecRule REQUEST_BODY \"@contains sneaky\" \"id:203,phase:2,pass,nolog,setvar:tx.score=+1\"",
+						"SecRule TX:score \"@ge 2\" \"id:204,phase:2,deny,status:406,log\""
+					]},
+					"default_directives": "default",
+					"directives_settings": {"default": {"request_body_streaming": {"look_behind": 8}}}
+				}`
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				require.Contains(t, strings.Join(host.GetWarnLogs(), "\n"), "inspected as raw data")
+
+				contentType := tt.contentType
+				if contentType == "" {
+					contentType = "application/octet-stream"
+				}
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", contentType},
+					{"x-test", "yes"},
+				}, false))
+
+				for i, action := range tt.expectedActions {
+					if i == tt.responseStartedAt {
+						require.Equal(t, types.ActionContinue, host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}, {"content-type", "text/plain"}}, false))
+					}
+					eos := i == len(tt.chunks)-1
+					require.Equal(t, action, host.CallOnRequestBody(id, []byte(tt.chunks[i]), eos), "chunk %d", i)
+				}
+
+				localResponse := host.GetSentLocalResponse(id)
+				if tt.expectedStatus != 0 {
+					require.NotNil(t, localResponse)
+					require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
+				} else {
+					require.Nil(t, localResponse)
+					require.Equal(t, tt.expectedLastBody, string(host.GetCurrentRequestBody(id)))
+				}
+
+				host.CompleteHttpContext(id)
+
+				// The request headers rules are logged once, not for each chunk.
+				require.Equal(t, 1, strings.Count(strings.Join(host.GetCriticalLogs(), "\n"), `[id "101"]`))
+
+				for name, expected := range map[string]uint64{
+					"waf_filter.tx.request_body_late_interruption":       tt.expectedLateCounter,
+					"waf_filter.tx.request_body_unenforced_interruption": tt.expectedUnenforcedCount,
+				} {
+					value, err := host.GetCounterMetric(name)
+					if expected == 0 {
+						require.Error(t, err, name)
+						continue
+					}
+					require.NoError(t, err, name)
+					require.Equal(t, expected, value, name)
+				}
+			})
+		})
+	}
+}
+
+func TestResponseBodyStreaming(t *testing.T) {
+	tests := []struct {
+		name                string
+		lookBehind          int
+		interruption        string
+		chunks              []string
+		expectedActions     []types.Action
+		expectedLastBody    string
+		expectedInterrupted bool
+		// expectedStatus is the status of the local response sent by the abort strategy.
+		expectedStatus int
+		// expectedAuditedRule is the body rule explaining the audit log entry of a chunk.
+		expectedAuditedRule int
+	}{
+		{
+			name:             "safe chunks",
+			lookBehind:       8,
+			chunks:           []string{"Hello, ", "yogi ", "bear!"},
+			expectedActions:  []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody: "bear!",
+			// The rule matching yogi does not block, it is audited nonetheless.
+			expectedAuditedRule: 402,
+		},
+		{
+			name:                "pattern in a chunk",
+			lookBehind:          8,
+			chunks:              []string{"Hello, ", "the secret-token ", "is leaked"},
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody:    "",
+			expectedInterrupted: true,
+			expectedAuditedRule: 401,
+		},
+		{
+			name:                "pattern in the second chunk, truncated",
+			lookBehind:          8,
+			interruption:        `{"strategy": "truncate"}`,
+			chunks:              []string{"Hello, ", "the secret-token ", "is leaked"},
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionContinue, types.ActionContinue},
+			expectedLastBody:    "",
+			expectedInterrupted: true,
+			expectedAuditedRule: 401,
+		},
+		{
+			name:                "pattern in the second chunk, aborted",
+			lookBehind:          8,
+			interruption:        `{"strategy": "abort"}`,
+			chunks:              []string{"Hello, ", "the secret-token ", "is leaked"},
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionPause, types.ActionContinue},
+			expectedLastBody:    "",
+			expectedInterrupted: true,
+			expectedStatus:      403,
+			expectedAuditedRule: 401,
+		},
+		{
+			name:                "pattern crossing chunks",
+			lookBehind:          8,
+			chunks:              []string{"Hello, the secret-", "token is leaked"},
+			expectedActions:     []types.Action{types.ActionContinue, types.ActionContinue},
+			expectedLastBody:    "",
+			expectedInterrupted: true,
+			expectedAuditedRule: 401,
+		},
+		{
+			name:             "pattern crossing chunks without look-behind",
+			lookBehind:       0,
+			chunks:           []string{"Hello, the secret-", "token is leaked"},
+			expectedActions:  []types.Action{types.ActionContinue, types.ActionContinue},
+			expectedLastBody: "token is leaked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interruption := ""
+			if tt.interruption != "" {
+				interruption = `, "response_body_interruption": ` + tt.interruption
+			}
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecResponseBodyAccess On",
+						"SecResponseBodyMimeType text/plain",
+						"SecAuditEngine RelevantOnly",
+						"SecAuditLogFormat JSON",
+						"SecAuditLogParts ABHKZ",
+						"SecRule RESPONSE_HEADERS:content-type \"@streq text/plain\" \"id:301,phase:3,pass,nolog\"",
+						"SecRule RESPONSE_HEADERS:content-type \"@streq text/plain\" \"id:302,phase:3,pass,log\"",
+						"SecRule RESPONSE_BODY \"@contains secret-token\" \"id:401,phase:4,deny,log\"",
+						"SecRule RESPONSE_BODY \"@contains yogi\" \"id:402,phase:4,pass,log\""
+					]},
+					"default_directives": "default",
+					"directives_settings": {"default": {"response_body_streaming": {"look_behind": %d}}}%s
+				}`, tt.lookBehind, interruption)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true))
+
+				// The response headers are not held when streaming.
+				require.Equal(t, types.ActionContinue, host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+				}, false))
+
+				for i, chunk := range tt.chunks {
+					eos := i == len(tt.chunks)-1
+					require.Equal(t, tt.expectedActions[i], host.CallOnResponseBody(id, []byte(chunk), eos), "chunk %d", i)
+					if i == 0 {
+						// The first chunk is released untouched.
+						require.Equal(t, chunk, string(host.GetCurrentResponseBody(id)))
+					}
+				}
+				require.Equal(t, tt.expectedLastBody, string(host.GetCurrentResponseBody(id)))
+				if localResponse := host.GetSentLocalResponse(id); tt.expectedStatus != 0 {
+					require.NotNil(t, localResponse)
+					require.EqualValues(t, tt.expectedStatus, localResponse.StatusCode)
+				} else {
+					require.Nil(t, localResponse)
+				}
+
+				host.CompleteHttpContext(id)
+
+				logs := strings.Join(host.GetCriticalLogs(), "\n")
+				// The response headers rules are logged once, not for each chunk.
+				require.Equal(t, 1, strings.Count(logs, `[id "302"]`))
+				if tt.expectedInterrupted {
+					require.Contains(t, logs, `[id "401"]`)
+					require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"), "Transaction interrupted")
+				} else {
+					require.NotContains(t, logs, `[id "401"]`)
+					inspectedChunks, err := host.GetCounterMetric("waf_filter.tx.response_body_inspected_chunks")
+					require.NoError(t, err)
+					require.Equal(t, uint64(len(tt.chunks)), inspectedChunks)
+				}
+
+				// The chunk matching a body rule has its own audit log entry.
+				var auditLogs []string
+				for _, l := range host.GetInfoLogs() {
+					if entry, ok := strings.CutPrefix(l, "AuditLog:"); ok {
+						auditLogs = append(auditLogs, entry)
+					}
+				}
+				for _, id := range []int{401, 402} {
+					audited := false
+					for _, entry := range auditLogs {
+						audited = audited || strings.Contains(entry, fmt.Sprintf(`"id":%d,`, id))
+					}
+					require.Equal(t, id == tt.expectedAuditedRule, audited, "audit log entry of rule %d", id)
+				}
+			})
+		})
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		msg  string
+	}{
+		{
+			name: "bad json",
+			conf: "{",
+			msg:  `Failed to parse plugin configuration:`,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(tt.conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+
+				logs := strings.Join(host.GetCriticalLogs(), "\n")
+				require.Contains(t, logs, tt.msg)
+			})
+		}
+	})
+}
+
+func TestBadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		reqHdrs [][2]string
+		msg     string
+	}{
+		{
+			name: "missing path",
+			reqHdrs: [][2]string{
+				{":method", "GET"},
+				{":authority", "localhost"},
+			},
+			msg: "Failed to get :path",
+		},
+		{
+			name: "missing method",
+			reqHdrs: [][2]string{
+				{":path", "/hello"},
+				{":authority", "localhost"},
+			},
+			msg: "Failed to get :method",
+		},
+		{
+			name: "missing method and path",
+			reqHdrs: [][2]string{
+				{":authority", "localhost"},
+			},
+			msg: "Failed to get :method",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+
+				action := host.CallOnRequestHeaders(id, tt.reqHdrs, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				logs := strings.Join(host.GetErrorLogs(), "\n")
+				require.Contains(t, logs, tt.msg)
+			})
+		}
+	})
+}
+
+func TestBadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		reqHdrs  [][2]string
+		respHdrs [][2]string
+		msg      string
+	}{
+		{
+			name: "missing path",
+			respHdrs: [][2]string{
+				{"content-length", "12"},
+				{":authority", "localhost"},
+			},
+			reqHdrs: [][2]string{
+				{":path", "/hello"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			},
+			msg: "Failed to get :status",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `{"directives_map": {"default": []}, "default_directives": "default"}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+
+				host.CallOnRequestHeaders(id, tt.reqHdrs, false)
+
+				action := host.CallOnResponseHeaders(id, tt.respHdrs, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				logs := strings.Join(host.GetErrorLogs(), "\n")
+				require.Contains(t, logs, tt.msg)
+			})
+		}
+	})
+}
+
+func TestPerAuthorityDirectives(t *testing.T) {
+	tests := []struct {
+		name                    string
+		reqHdrs                 [][2]string
+		conf                    string
+		localResponseIsNil      bool
+		localResponseStatusCode int
+	}{
+		{
+			name: "authority exist on per_authority_directives",
+			reqHdrs: [][2]string{
+				{":path", "/rs1"},
+				{":method", "GET"},
+				{":authority", "foo.example.com"},
+			},
+			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
+			localResponseStatusCode: 403,
+		},
+		{
+			name: "authority exist on per_authority_directives but calling allowed path",
+			reqHdrs: [][2]string{
+				{":path", "/admin"},
+				{":method", "GET"},
+				{":authority", "foo.example.com"},
+			},
+			conf:               `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
+			localResponseIsNil: true,
+		},
+		{
+			name: "authority not exist on per_authority_directives",
+			reqHdrs: [][2]string{
+				{":path", "/admin"},
+				{":method", "GET"},
+				{":authority", "bar.example.com"},
+			},
+			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
+			localResponseStatusCode: 403,
+		},
+		{
+			name: "authority not exist on per_authority_directives and no default",
+			reqHdrs: [][2]string{
+				{":path", "/admin"},
+				{":method", "GET"},
+				{":authority", "bar.example.com"},
+			},
+			conf:               `{"directives_map": {"rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "per_authority_directives":{"foo.example.com":"rs1"}}`,
+			localResponseIsNil: true,
+		},
+		{
+			name: "authority not exist on per_authority_directives but calling allowed value",
+			reqHdrs: [][2]string{
+				{":path", "/rs1"},
+				{":method", "GET"},
+				{":authority", "bar.example.com"},
+			},
+			conf:               `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
+			localResponseIsNil: true,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(tt.conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+
+				host.CallOnRequestHeaders(id, tt.reqHdrs, false)
+				host.CompleteHttpContext(id)
+
+				pluginResp := host.GetSentLocalResponse(id)
+
+				if tt.localResponseIsNil {
+					require.Nil(t, pluginResp)
+					return
+				}
+
+				require.NotNil(t, pluginResp)
+				require.EqualValues(t, tt.localResponseStatusCode, pluginResp.StatusCode)
+			})
+		}
+	})
+}
+
+func TestBodyInspectionMetrics(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(`{"directives_map": {"default": [ "SecRuleEngine On", "SecRequestBodyAccess On", "SecRequestBodyLimit 10", "SecRequestBodyLimitAction ProcessPartial", "SecResponseBodyAccess On", "SecResponseBodyLimit 20", "SecResponseBodyLimitAction ProcessPartial", "SecResponseBodyMimeType text/plain"]}, "default_directives": "default"}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "POST"},
+			{":authority", "localhost"},
+			{"content-type", "text/plain"},
+		}, false)
+		action := host.CallOnRequestBody(id, []byte("animal=bear&food=honey"), true)
+		require.Equal(t, types.ActionContinue, action)
+
+		host.CallOnResponseHeaders(id, [][2]string{
+			{":status", "200"},
+			{"content-type", "text/plain"},
+		}, false)
+		action = host.CallOnResponseBody(id, []byte("Hello, yogi!"), true)
+		require.Equal(t, types.ActionContinue, action)
+		host.CompleteHttpContext(id)
+
+		value, err := host.GetCounterMetric("waf_filter.tx.request_body_inspected_bytes")
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), value)
+
+		value, err = host.GetCounterMetric("waf_filter.tx.request_body_limit_reached")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), value)
+
+		value, err = host.GetCounterMetric("waf_filter.tx.response_body_inspected_bytes")
+		require.NoError(t, err)
+		require.Equal(t, uint64(12), value)
+
+		_, err = host.GetCounterMetric("waf_filter.tx.response_body_limit_reached")
+		require.Error(t, err)
+
+		// A response without body makes the response body phase to be evaluated late, at OnHttpStreamDone.
+		id = host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+		host.CallOnResponseHeaders(id, [][2]string{
+			{":status", "204"},
+		}, true)
+		host.CompleteHttpContext(id)
+
+		value, err = host.GetCounterMetric("waf_filter.tx.response_body_late_processing")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), value)
+	})
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(`
+			{
+				"directives_map": {
+					"rs1": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""],
+					"rs2": ["SecRuleEngine On"],
+					"rs3": ["SecRuleEngine On"]
+				},
+				"default_directives": "rs1",
+				"per_authority_directives": {"foo.example.com": "rs2"},
+				"runtime_metrics_period": "5s"
+			}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.Equal(t, uint32(5000), host.GetTickPeriod())
+
+		value, err := host.GetGaugeMetric("waf_filter.wafs.loaded")
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), value)
+
+		host.Tick()
+		value, err = host.GetGaugeMetric("waf_filter.runtime.heap_sys_bytes")
+		require.NoError(t, err)
+		require.NotZero(t, value)
+
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+
+		value, err = host.GetGaugeMetric("waf_filter.tx.active")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), value)
+
+		host.CompleteHttpContext(id)
+
+		value, err = host.GetGaugeMetric("waf_filter.tx.active")
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), value)
+	})
+}
+
+func TestRuntimeMetricsPublishedByOneVM(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(`
+			{
+				"directives_map": {"rs1": ["SecRuleEngine On"]},
+				"default_directives": "rs1",
+				"runtime_metrics_period": "5s"
+			}`))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		// Another VM holds the lease, this one does not publish the runtime gauges.
+		require.NoError(t, proxywasm.SetSharedData("coraza.runtime_metrics.publisher",
+			[]byte(fmt.Sprintf("other %d", time.Now().Add(time.Hour).UnixNano())), 0))
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		host.Tick()
+		_, err := host.GetGaugeMetric("waf_filter.runtime.heap_sys_bytes")
+		require.Error(t, err)
+
+		// The lease expired, e.g. the other VM has been stopped.
+		_, cas, err := proxywasm.GetSharedData("coraza.runtime_metrics.publisher")
+		require.NoError(t, err)
+		require.NoError(t, proxywasm.SetSharedData("coraza.runtime_metrics.publisher", []byte("other 0"), cas))
+		host.Tick()
+		value, err := host.GetGaugeMetric("waf_filter.runtime.heap_sys_bytes")
+		require.NoError(t, err)
+		require.NotZero(t, value)
+	})
+}
+func TestEmptyBody(t *testing.T) {
+	testCases := []struct {
+		title                 string
+		isRespBodyProcessable bool
+	}{
+		{
+			title:                 "Response body processable",
+			isRespBodyProcessable: true,
+		},
+		{
+			title:                 "Response body NOT processable",
+			isRespBodyProcessable: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.title, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(`{"directives_map": {"default": [ "SecRequestBodyAccess On", "SecResponseBodyAccess On", "SecResponseBodyMimeType text/plain"]}, "default_directives": "default"}`))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, false)
+				action := host.CallOnRequestBody(id, []byte{}, false)
+				require.Equal(t, types.ActionPause, action)
+				action = host.CallOnRequestBody(id, []byte{}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				if tc.isRespBodyProcessable {
+					host.CallOnResponseHeaders(id, [][2]string{
+						{":status", "200"},
+						{"content-length", "0"},
+						{"content-type", "text/plain"}}, false)
+
+					action = host.CallOnResponseBody(id, []byte{}, false)
+					require.Equal(t, types.ActionPause, action)
+					action = host.CallOnResponseBody(id, []byte{}, true)
+					require.Equal(t, types.ActionContinue, action)
+				} else {
+					// If the ResponseBodyMimeType is not matched, we should just continue and not store the body
+					action = host.CallOnResponseBody(id, []byte{}, false)
+					require.Equal(t, types.ActionContinue, action)
+					action = host.CallOnResponseBody(id, []byte{}, true)
+					require.Equal(t, types.ActionContinue, action)
+				}
+				logs := strings.Join(host.GetCriticalLogs(), "\n")
+				require.Empty(t, logs)
+			})
+		})
+	}
+}
+
+func TestLogError(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"X-CRS-Test", "for the win!"},
+	}
+
+	tests := []struct {
+		severity int
+		logs     func(host proxytest.HostEmulator) []string
+	}{
+		{
+			severity: 0,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetCriticalLogs()
+			},
+		},
+		{
+			severity: 1,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetCriticalLogs()
+			},
+		},
+		{
+			severity: 2,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetCriticalLogs()
+			},
+		},
+		{
+			severity: 3,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetErrorLogs()
+			},
+		},
+		{
+			severity: 4,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetWarnLogs()
+			},
+		},
+		{
+			severity: 5,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetInfoLogs()
+			},
+		},
+		{
+			severity: 6,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetInfoLogs()
+			},
+		},
+		{
+			severity: 7,
+			logs: func(host proxytest.HostEmulator) []string {
+				return host.GetDebugLogs()
+			},
+		},
+	}
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(fmt.Sprintf("severity %d", tt.severity), func(t *testing.T) {
+				conf := fmt.Sprintf(`{"directives_map": {"default": ["SecRule REQUEST_HEADERS:X-CRS-Test \"@rx ^.*$\" \"id:999999,phase:1,log,severity:%d,msg:'%%{MATCHED_VAR}',pass,t:none\""]}, "default_directives": "default"}`, tt.severity)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(strings.TrimSpace(conf)))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, reqHdrs, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				logs := strings.Join(tt.logs(host), "\n")
+				require.Contains(t, logs, "for the win!")
+			})
+		}
+	})
+}
+
+func TestLogErrorJSON(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello?name=panda"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"X-CRS-Test", "for the win!"},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `{"directives_map": {"default": ["SecRule REQUEST_HEADERS:X-CRS-Test \"@rx ^.*$\" \"id:999999,phase:1,log,severity:2,tag:'test',msg:'%{MATCHED_VAR}',logdata:'some data',pass,t:none\""]}, "default_directives": "default", "rule_log_format": "json"}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, reqHdrs, false)
+		require.Equal(t, types.ActionContinue, action)
+
+		logs := host.GetCriticalLogs()
+		require.Len(t, logs, 1)
+
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(logs[0]), &entry))
+		require.EqualValues(t, 999999, entry["rule_id"])
+		require.Equal(t, "for the win!", entry["message"])
+		require.Equal(t, "critical", entry["severity"])
+		require.Equal(t, []interface{}{"test"}, entry["tags"])
+		require.Equal(t, "some data", entry["data"])
+		require.Equal(t, "/hello?name=panda", entry["uri"])
+		require.Equal(t, "localhost", entry["authority"])
+		require.Equal(t, "default", entry["directives"])
+		require.NotEmpty(t, entry["transaction_id"])
+		require.EqualValues(t, id, entry["context_id"])
+
+		matchedData, ok := entry["matched_data"].([]interface{})
+		require.True(t, ok)
+		require.Len(t, matchedData, 1)
+		require.Equal(t, map[string]interface{}{
+			"variable": "REQUEST_HEADERS",
+			"key":      "x-crs-test",
+			"value":    "for the win!",
+		}, matchedData[0])
+	})
+}
+
+func TestRuleLogLevels(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"X-CRS-Test", "for the win!"},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		rule := `SecRule REQUEST_HEADERS:X-CRS-Test \"@rx ^.*$\" \"id:999999,phase:1,log,severity:2,msg:'%{MATCHED_VAR}',pass,t:none\"`
+		conf := fmt.Sprintf(`
+		{
+			"directives_map": {"default": ["%s"], "quiet": ["%s"]},
+			"default_directives": "default",
+			"per_authority_directives": {"quiet.example.com": "quiet"},
+			"directives_settings": {"quiet": {"rule_log_levels": {"critical": "debug"}}}
+		}`, rule, rule)
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, false))
+		require.Len(t, host.GetCriticalLogs(), 1)
+
+		id = host.InitializeHttpContext()
+		quietReqHdrs := append([][2]string{}, reqHdrs...)
+		quietReqHdrs[2] = [2]string{":authority", "quiet.example.com"}
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, quietReqHdrs, false))
+		require.Len(t, host.GetCriticalLogs(), 1)
+		require.Contains(t, strings.Join(host.GetDebugLogs(), "\n"), "for the win!")
+	})
+}
+
+func TestEnrichRequest(t *testing.T) {
+	tests := []struct {
+		name            string
+		authority       string
+		body            string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:      "headers only",
+			authority: "localhost",
+			expectedHeaders: map[string]string{
+				"x-waf-transaction-id": "tx1",
+				"x-waf-anomaly-score":  "3",
+				"x-waf-matched-rules":  "101",
+			},
+		},
+		{
+			name:      "body",
+			authority: "localhost",
+			body:      "animal=bear",
+			expectedHeaders: map[string]string{
+				"x-waf-transaction-id": "tx1",
+				"x-waf-anomaly-score":  "8",
+				"x-waf-matched-rules":  "101,102",
+			},
+		},
+		{
+			name:            "not enriched",
+			authority:       "other.example.com",
+			body:            "animal=bear",
+			expectedHeaders: map[string]string{"x-waf-anomaly-score": "1000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				rules := `
+					"SecRuleEngine On",
+					"SecRequestBodyAccess On",
+					"SecAction \"id:100,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=0\"",
+					"SecRule REQUEST_METHOD \"@streq POST\" \"id:101,phase:1,pass,log,setvar:tx.blocking_inbound_anomaly_score=+3\"",
+					"SecRule ARGS_POST:animal \"@streq bear\" \"id:102,phase:2,pass,log,setvar:tx.blocking_inbound_anomaly_score=+5\""`
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [%s], "other": [%s]},
+					"default_directives": "default",
+					"per_authority_directives": {"other.example.com": "other"},
+					"directives_settings": {"default": {"enrich_request": true}},
+					"transaction_id": {"header": "x-request-id"}
+				}`, rules, rules)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				reqHdrs := [][2]string{
+					{":path", "/hello"},
+					{":method", "POST"},
+					{":authority", tt.authority},
+					{"content-type", "application/x-www-form-urlencoded"},
+					{"x-request-id", "tx1"},
+					// Supplied by the client, removed in enrich mode.
+					{"x-waf-anomaly-score", "1000"},
+				}
+				if tt.body == "" {
+					require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, true))
+				} else {
+					action := host.CallOnRequestHeaders(id, reqHdrs, false)
+					if tt.authority == "localhost" {
+						// The headers are held until the body has been inspected.
+						require.Equal(t, types.ActionPause, action)
+					} else {
+						require.Equal(t, types.ActionContinue, action)
+					}
+					require.Equal(t, types.ActionContinue, host.CallOnRequestBody(id, []byte(tt.body), true))
+				}
+
+				headers := map[string]string{}
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					if strings.HasPrefix(h[0], "x-waf-") {
+						headers[h[0]] = h[1]
+					}
+				}
+				require.Equal(t, tt.expectedHeaders, headers)
+			})
+		})
+	}
+}
+
+func TestRuleLogRateLimit(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"X-CRS-Test", "for the win!"},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRule REQUEST_HEADERS:X-CRS-Test \"@rx ^.*$\" \"id:999999,phase:1,log,severity:2,msg:'%{MATCHED_VAR}',pass,t:none\""]},
+			"default_directives": "default",
+			"runtime_metrics_period": "0s",
+			"rule_log_rate_limit": {"per_rule": {"rate": 0.001, "burst": 2}, "summary_period": "5s"}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.Equal(t, uint32(5000), host.GetTickPeriod())
+
+		for i := 0; i < 5; i++ {
+			id := host.InitializeHttpContext()
+			require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, false))
+			host.CompleteHttpContext(id)
+		}
+		require.Len(t, host.GetCriticalLogs(), 2)
+
+		host.Tick()
+		require.Contains(t, host.GetWarnLogs(), "3 rule log messages suppressed by rate limiting")
+	})
+}
+
+func TestDebugTrace(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceHeader string
+		traced      bool
+	}{
+		{
+			name:        "matching secret",
+			traceHeader: "s3cr3t",
+			traced:      true,
+		},
+		{
+			name:        "wrong secret",
+			traceHeader: "guess",
+			traced:      false,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecRule REQUEST_HEADERS:X-Coraza-Debug \"@rx .\" \"id:101,phase:1,deny\""]},
+			"default_directives": "default",
+			"debug_trace": {"header": "X-Coraza-Debug", "secret": "s3cr3t"}
+		}`
+
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-coraza-debug", tt.traceHeader},
+				}, false)
+
+				// The trigger header is removed before being inspected.
+				require.Equal(t, types.ActionContinue, action)
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					require.NotEqual(t, "x-coraza-debug", h[0])
+				}
+
+				traced := strings.Contains(strings.Join(host.GetInfoLogs(), "\n"), "debug_trace=true")
+				require.Equal(t, tt.traced, traced)
+
+				host.CompleteHttpContext(id)
+			})
+		}
+	})
+}
+
+func TestTransactionID(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		requestID  string
+		property   string
+		expectedID string
+	}{
+		{
+			name:       "header",
+			source:     `{"header": "X-Request-Id"}`,
+			expectedID: "abc-123",
+		},
+		{
+			name:       "property",
+			source:     `{"property": "request.id"}`,
+			property:   "def-456",
+			expectedID: "def-456",
+		},
+		{
+			name:   "missing property",
+			source: `{"property": "request.id"}`,
+		},
+		{
+			name:      "oversized header",
+			source:    `{"header": "X-Request-Id"}`,
+			requestID: strings.Repeat("a", 129),
+		},
+		{
+			name:      "header with control characters",
+			source:    `{"header": "X-Request-Id"}`,
+			requestID: "abc\x1b[31m-123",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": ["SecRuleEngine On"]},
+					"default_directives": "default",
+					"transaction_id": %s
+				}`, tt.source)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				if tt.property != "" {
+					require.NoError(t, host.SetProperty([]string{"request", "id"}, []byte(tt.property)))
+				}
+
+				requestID := "abc-123"
+				if tt.requestID != "" {
+					requestID = tt.requestID
+				}
+				reqHdrs := [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-request-id", requestID},
+				}
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, false))
+
+				// A transaction using the same ID while the first one is in-flight gets a generated one.
+				otherID := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(otherID, reqHdrs, false))
+
+				host.CompleteHttpContext(id)
+				host.CompleteHttpContext(otherID)
+
+				var finishedTXs []string
+				for _, l := range host.GetInfoLogs() {
+					if strings.HasPrefix(l, "Finished") {
+						finishedTXs = append(finishedTXs, l)
+					}
+				}
+				require.Len(t, finishedTXs, 2)
+				if tt.expectedID != "" {
+					require.Contains(t, finishedTXs[0], fmt.Sprintf("tx_id=%q", tt.expectedID))
+				} else {
+					require.NotContains(t, finishedTXs[0], requestID)
+				}
+				require.NotContains(t, finishedTXs[1], fmt.Sprintf("tx_id=%q", tt.expectedID))
+			})
+		}
+	})
+}
+
+func TestAuditLogSerial(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecAuditEngine On", "SecAuditLogFormat JSON", "SecAuditLogParts ABZ"]},
+			"default_directives": "default",
+			"audit_log_serial": {"prefix": "WAFAudit:", "log_level": "warn", "max_line_size": 128}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true))
+		host.CompleteHttpContext(id)
+
+		var chunks []string
+		for _, l := range host.GetWarnLogs() {
+			if strings.HasPrefix(l, "WAFAudit:") {
+				chunks = append(chunks, l)
+			}
+		}
+		require.Greater(t, len(chunks), 1)
+
+		var entry strings.Builder
+		for i, chunk := range chunks {
+			require.LessOrEqual(t, len(chunk), 128)
+			_, data, found := strings.Cut(chunk, fmt.Sprintf(" %d/%d] ", i+1, len(chunks)))
+			require.True(t, found, chunk)
+			entry.WriteString(data)
+		}
+		require.True(t, json.Valid([]byte(entry.String())), entry.String())
+	})
+}
+
+func TestAuditLogFormats(t *testing.T) {
+	testCases := map[string]func(t *testing.T, entry string){
+		"ECS": func(t *testing.T, entry string) {
+			require.True(t, json.Valid([]byte(entry)), entry)
+			require.Contains(t, entry, `"ecs":{"version":"8.11.0"}`)
+			require.Contains(t, entry, `"action":"blocked"`)
+		},
+		"CEF": func(t *testing.T, entry string) {
+			require.True(t, strings.HasPrefix(entry, "CEF:0|OWASP|Coraza|"), entry)
+			require.Contains(t, entry, "|101|admin|")
+			require.Contains(t, entry, "act=blocked")
+		},
+		"RFC5424": func(t *testing.T, entry string) {
+			require.True(t, strings.HasPrefix(entry, "<106>1 "), entry)
+			require.Contains(t, entry, `interrupted="true"`)
+			require.Contains(t, entry, `[id "101"] admin`)
+		},
+	}
+
+	for format, check := range testCases {
+		t.Run(format, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecAuditEngine RelevantOnly",
+						"SecAuditLogFormat %s",
+						"SecAuditLogParts ABHKZ",
+						"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny,log,severity:critical,msg:'admin'\""
+					]},
+					"default_directives": "default"
+				}`, format)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionPause, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true))
+				host.CompleteHttpContext(id)
+
+				var entries []string
+				for _, l := range host.GetInfoLogs() {
+					if entry, ok := strings.CutPrefix(l, "AuditLog:"); ok {
+						entries = append(entries, entry)
+					}
+				}
+				require.Len(t, entries, 1)
+				check(t, entries[0])
+			})
+		})
+	}
+}
+
+func TestEnvoyAttributes(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecAuditEngine On",
+				"SecAuditLogFormat JSON",
+				"SecAuditLogParts ABZ",
+				"SecRule REQUEST_URI \"@streq /hello\" \"id:101,phase:1,log,pass\""
+			]},
+			"default_directives": "default",
+			"rule_log_format": "json",
+			"envoy_attributes": ["xds.route_name", "upstream.address", "node.id"]
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.NoError(t, host.SetProperty([]string{"xds", "route_name"}, []byte("hello_route")))
+
+		id := host.InitializeHttpContext()
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true))
+
+		// The upstream host is only known once the request has been routed.
+		require.NoError(t, host.SetProperty([]string{"upstream", "address"}, []byte("10.0.0.5:8080")))
+		host.CompleteHttpContext(id)
+
+		ruleLogs := strings.Join(host.GetCriticalLogs(), "\n")
+		require.Contains(t, ruleLogs, `"rule_id":101`)
+		require.Contains(t, ruleLogs, `"xds.route_name":"hello_route"`)
+
+		var auditLog, finishedLog string
+		for _, l := range host.GetInfoLogs() {
+			if strings.HasPrefix(l, "AuditLog:") {
+				auditLog = strings.TrimPrefix(l, "AuditLog:")
+			}
+			if strings.HasPrefix(l, "Finished") {
+				finishedLog = l
+			}
+		}
+		require.True(t, json.Valid([]byte(auditLog)), auditLog)
+		require.True(t, strings.HasPrefix(auditLog, `{"envoy":{"xds.route_name":"hello_route","upstream.address":"10.0.0.5:8080"},"transaction":`), auditLog)
+		require.Contains(t, finishedLog, `xds.route_name="hello_route"`)
+		require.Contains(t, finishedLog, `upstream.address="10.0.0.5:8080"`)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		peerAddress    string
+		forwardedFor   string
+		expectClientIP string
+		// expectForwarded tells whether the client address is expected from the header.
+		expectForwarded bool
+	}{
+		{
+			name:            "request forwarded by a trusted proxy",
+			peerAddress:     "10.0.0.1:8000",
+			forwardedFor:    "203.0.113.7, 10.0.0.2",
+			expectClientIP:  "203.0.113.7",
+			expectForwarded: true,
+		},
+		{
+			name:           "header set by an untrusted peer",
+			peerAddress:    "198.51.100.1:8000",
+			forwardedFor:   "203.0.113.7",
+			expectClientIP: "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := `
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecAuditEngine On",
+						"SecAuditLogFormat JSON",
+						"SecAuditLogParts ABZ",
+						"SecRule TX:peer_address \"@ipMatch 10.0.0.0/8\" \"id:101,phase:1,pass,log,msg:'Forwarded by a trusted proxy'\"",
+						"SecRule REMOTE_ADDR \"@ipMatch 203.0.113.0/24\" \"id:102,phase:1,deny,status:403\""
+					]},
+					"default_directives": "default",
+					"client_ip": {"trusted_proxies": ["10.0.0.0/8"]}
+				}`
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+				require.NoError(t, host.SetProperty([]string{"source", "address"}, []byte(tt.peerAddress)))
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/hello"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-forwarded-for", tt.forwardedFor},
+				}, true)
+				host.CompleteHttpContext(id)
+
+				// The client address is blocked, the peer address matched as TX:peer_address.
+				ruleLogs := strings.Join(host.GetCriticalLogs(), "\n")
+				if tt.expectForwarded {
+					require.NotNil(t, host.GetSentLocalResponse(id))
+					require.Contains(t, ruleLogs, "[id \"101\"]")
+				} else {
+					require.Nil(t, host.GetSentLocalResponse(id))
+					require.NotContains(t, ruleLogs, "[id \"101\"]")
+				}
+
+				var auditLog string
+				for _, l := range host.GetInfoLogs() {
+					if entry, ok := strings.CutPrefix(l, "AuditLog:"); ok {
+						auditLog = entry
+					}
+				}
+				require.True(t, json.Valid([]byte(auditLog)), auditLog)
+				require.Contains(t, auditLog, `"client_ip":"`+tt.expectClientIP+`"`)
+				if tt.expectForwarded {
+					require.True(t, strings.HasPrefix(auditLog, `{"envoy":{"source.address":"`+tt.peerAddress+`"},"transaction":`), auditLog)
+				} else {
+					require.True(t, strings.HasPrefix(auditLog, `{"transaction":`), auditLog)
+				}
+			})
+		})
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	tests := []struct {
+		name            string
+		path            string
+		requestAction   types.Action
+		expectedVerdict string
+	}{
+		{
+			name:            "passed",
+			path:            "/hello",
+			requestAction:   types.ActionContinue,
+			expectedVerdict: `{"tx_id":"tx1","interrupted":false,"matched_rules":[101],"inbound_anomaly_score":3}`,
+		},
+		{
+			name:            "interrupted",
+			path:            "/admin",
+			requestAction:   types.ActionPause,
+			expectedVerdict: `{"tx_id":"tx1","interrupted":true,"phase":"http_request_headers","rule_id":102,"action":"deny","status":403,"matched_rules":[101,102],"inbound_anomaly_score":3}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := `
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecAction \"id:100,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=0\"",
+						"SecRule REQUEST_METHOD \"@streq GET\" \"id:101,phase:1,pass,log,setvar:tx.blocking_inbound_anomaly_score=+3\"",
+						"SecRule REQUEST_URI \"@streq /admin\" \"id:102,phase:1,deny,status:403,log\""
+					]},
+					"default_directives": "default",
+					"transaction_id": {"header": "x-request-id"},
+					"verdict_property": "coraza_verdict"
+				}`
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, tt.requestAction, host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-request-id", "tx1"},
+				}, true))
+
+				// The verdict is available to the following filters once the request is inspected.
+				raw, err := host.GetProperty([]string{"coraza_verdict"})
+				require.NoError(t, err)
+				require.JSONEq(t, tt.expectedVerdict, string(raw))
+
+				host.CompleteHttpContext(id)
+
+				raw, err = host.GetProperty([]string{"coraza_verdict"})
+				require.NoError(t, err)
+				require.JSONEq(t, tt.expectedVerdict, string(raw))
+			})
+		})
+	}
+}
+
+func TestAuditLogHTTP(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecAuditEngine On", "SecAuditLogType http", "SecAuditLogFormat JSON", "SecAuditLogParts ABZ"]},
+			"default_directives": "default",
+			"runtime_metrics_period": "0s",
+			"audit_log_http": {"cluster": "audit_collector", "path": "/ingest", "headers": {"x-api-key": "foo"}, "batch_size": 2, "max_retries": 1}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.Equal(t, uint32(1000), host.GetTickPeriod())
+
+		// Callouts are dispatched from the plugin context.
+		seenCallouts := 0
+		nextCallout := func() proxytest.HttpCalloutAttribute {
+			t.Helper()
+			callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+			require.Len(t, callouts, seenCallouts+1)
+			seenCallouts++
+			return callouts[seenCallouts-1]
+		}
+		completeRequest := func() {
+			id := host.InitializeHttpContext()
+			require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, true))
+			host.CompleteHttpContext(id)
+		}
+		counter := func(name string) uint64 {
+			value, _ := host.GetCounterMetric(name)
+			return value
+		}
+
+		// Batches are sent on flush.
+		completeRequest()
+		completeRequest()
+		completeRequest()
+		host.Tick()
+		callout := nextCallout()
+		require.Equal(t, "audit_collector", callout.Upstream)
+		require.Contains(t, callout.Headers, [2]string{":path", "/ingest"})
+		require.Contains(t, callout.Headers, [2]string{"x-api-key", "foo"})
+		entries := strings.Split(string(callout.Body), "\n")
+		require.Len(t, entries, 2)
+		for _, entry := range entries {
+			require.True(t, json.Valid([]byte(entry)), entry)
+		}
+
+		// A failed batch is retried on the next flush.
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "503"}}, nil, nil)
+		require.Equal(t, uint64(2), counter("waf_filter.audit_log.retried"))
+		host.Tick()
+		retried := nextCallout()
+		require.Equal(t, callout.Body, retried.Body)
+		host.CallOnHttpCallResponse(retried.CalloutID, [][2]string{{":status", "200"}}, nil, nil)
+		require.Equal(t, uint64(2), counter("waf_filter.audit_log.sent"))
+
+		// Entries are dropped once the retries are exhausted.
+		host.Tick()
+		callout = nextCallout()
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "500"}}, nil, nil)
+		host.Tick()
+		callout = nextCallout()
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "500"}}, nil, nil)
+		require.Equal(t, uint64(1), counter("waf_filter.audit_log.dropped_reason=retries_exhausted"))
+		require.Equal(t, uint64(2), counter("waf_filter.audit_log.sent"))
+	})
+}
+
+func TestAuditLogGRPC(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+	}
+
+	// decodeEntries decodes the entries of the ExportAuditLogsRequest framed in the body.
+	decodeEntries := func(t *testing.T, body []byte) (entries []string) {
+		t.Helper()
+		require.GreaterOrEqual(t, len(body), 5)
+		require.Equal(t, byte(0), body[0])
+		msg := body[5:]
+		require.Equal(t, int(binary.BigEndian.Uint32(body[1:5])), len(msg))
+		for len(msg) > 0 {
+			require.Equal(t, byte(0x0a), msg[0])
+			size, n := binary.Uvarint(msg[1:])
+			require.Greater(t, n, 0)
+			msg = msg[1+n:]
+			entries = append(entries, string(msg[:size]))
+			msg = msg[size:]
+		}
+		return entries
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecAuditEngine On", "SecAuditLogType grpc", "SecAuditLogFormat JSON", "SecAuditLogParts ABZ"]},
+			"default_directives": "default",
+			"runtime_metrics_period": "0s",
+			"audit_log_grpc": {"cluster": "audit_grpc", "batch_size": 2}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for i := 0; i < 3; i++ {
+			id := host.InitializeHttpContext()
+			require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, true))
+			host.CompleteHttpContext(id)
+		}
+		counter := func(name string) uint64 {
+			value, _ := host.GetCounterMetric(name)
+			return value
+		}
+
+		host.Tick()
+		callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+		require.Len(t, callouts, 1)
+		require.Equal(t, "audit_grpc", callouts[0].Upstream)
+		require.Contains(t, callouts[0].Headers, [2]string{":path", "/coraza.auditlog.v1.AuditLogService/Export"})
+		require.Contains(t, callouts[0].Headers, [2]string{"content-type", "application/grpc"})
+		entries := decodeEntries(t, callouts[0].Body)
+		require.Len(t, entries, 2)
+		for _, entry := range entries {
+			require.True(t, json.Valid([]byte(entry)), entry)
+		}
+
+		// Transient gRPC statuses are retried.
+		host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "200"}}, [][2]string{{"grpc-status", "14"}}, nil)
+		require.Equal(t, uint64(2), counter("waf_filter.audit_log.retried"))
+		host.Tick()
+		callouts = host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+		require.Len(t, callouts, 2)
+		require.Equal(t, callouts[0].Body, callouts[1].Body)
+		host.CallOnHttpCallResponse(callouts[1].CalloutID, [][2]string{{":status", "200"}}, [][2]string{{"grpc-status", "0"}}, nil)
+		require.Equal(t, uint64(2), counter("waf_filter.audit_log.sent"))
+
+		// Other statuses, here in a trailers-only response, are dropped.
+		host.Tick()
+		callouts = host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+		require.Len(t, callouts, 3)
+		require.Len(t, decodeEntries(t, callouts[2].Body), 1)
+		host.CallOnHttpCallResponse(callouts[2].CalloutID, [][2]string{{":status", "200"}, {"grpc-status", "3"}}, nil, nil)
+		require.Equal(t, uint64(1), counter("waf_filter.audit_log.dropped_reason=rejected"))
+	})
+}
+
+func TestAuditLogSharedQueue(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		// The same plugin enqueues and drains the audit logs, while in production the queue
+		// is drained by a singleton.
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecAuditEngine On", "SecAuditLogType shared_queue", "SecAuditLogFormat JSON", "SecAuditLogParts ABZ"]},
+			"default_directives": "default",
+			"runtime_metrics_period": "0s",
+			"audit_log_shared_queue": {"name": "audit_logs"},
+			"audit_log_aggregator": {"queue_name": "audit_logs", "drain_period": "2s", "max_drain": 1}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+		require.Equal(t, uint32(2000), host.GetTickPeriod())
+
+		for i := 0; i < 2; i++ {
+			id := host.InitializeHttpContext()
+			require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/hello"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true))
+			host.CompleteHttpContext(id)
+		}
+		require.Equal(t, 2, host.GetQueueSize(0))
+
+		auditLogs := func() (logs []string) {
+			for _, l := range host.GetInfoLogs() {
+				if strings.HasPrefix(l, "AuditLog:") {
+					logs = append(logs, l)
+				}
+			}
+			return logs
+		}
+		require.Empty(t, auditLogs())
+
+		host.Tick()
+		require.Equal(t, 1, host.GetQueueSize(0))
+		require.Len(t, auditLogs(), 1)
+
+		host.Tick()
+		require.Equal(t, 0, host.GetQueueSize(0))
+		require.Len(t, auditLogs(), 2)
+		require.True(t, json.Valid([]byte(strings.TrimPrefix(auditLogs()[1], "AuditLog:"))))
+	})
+}
+
+func TestAuditLogSharedQueueLogSink(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		// The aggregated entries are printed as configured by audit_log_serial.
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecAuditEngine On", "SecAuditLogType shared_queue", "SecAuditLogFormat JSON", "SecAuditLogParts ABZ"]},
+			"default_directives": "default",
+			"runtime_metrics_period": "0s",
+			"audit_log_serial": {"prefix": "CorazaAudit:", "log_level": "warn", "max_line_size": 128},
+			"audit_log_shared_queue": {"name": "audit_logs"},
+			"audit_log_aggregator": {"queue_name": "audit_logs", "drain_period": "2s", "sink": "log"}
+		}`
+
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/hello"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true))
+		host.CompleteHttpContext(id)
+		host.Tick()
+
+		for _, l := range host.GetInfoLogs() {
+			require.False(t, strings.HasPrefix(l, "CorazaAudit:"), l)
+		}
+		var chunks []string
+		for _, l := range host.GetWarnLogs() {
+			if strings.HasPrefix(l, "CorazaAudit:") {
+				chunks = append(chunks, l)
+			}
+		}
+		require.Greater(t, len(chunks), 1)
+
+		var entry strings.Builder
+		for i, chunk := range chunks {
+			require.LessOrEqual(t, len(chunk), 128)
+			header := fmt.Sprintf("CorazaAudit:[1 %d/%d] ", i+1, len(chunks))
+			require.True(t, strings.HasPrefix(chunk, header), chunk)
+			entry.WriteString(strings.TrimPrefix(chunk, header))
+		}
+		require.True(t, json.Valid([]byte(entry.String())), entry.String())
+	})
+}
+
+func TestRedaction(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/hello?password=hunter2secret&card=4111111111111111"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+		{"authorization", "Bearer s3cr3tt0ken"},
+	}
+	secrets := []string{"hunter2secret", "4111111111111111", "s3cr3tt0ken"}
+
+	for _, ruleLogFormat := range []string{"text", "json"} {
+		t.Run(ruleLogFormat, func(t *testing.T) {
+			vmTest(t, func(t *testing.T, vm types.VMContext) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecAuditEngine On",
+						"SecAuditLogFormat JSON",
+						"SecAuditLogParts ABHZ",
+						"SecRule ARGS:password \"@rx .\" \"id:101,phase:1,log,pass,msg:'password'\"",
+						"SecRule REQUEST_HEADERS:authorization \"@rx ^Bearer\" \"id:102,phase:1,log,pass,msg:'token',logdata:'%%{MATCHED_VAR}'\"",
+						"SecRule ARGS:card \"@rx ^[0-9]{16}$\" \"id:103,phase:1,log,pass,msg:'card'\""
+					]},
+					"default_directives": "default",
+					"rule_log_format": %q,
+					"redaction": {"headers": ["Authorization"], "args": ["password"], "patterns": ["\\b[0-9]{13,16}\\b"], "replacement": "***"}
+				}`, ruleLogFormat)
+
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionContinue, host.CallOnRequestHeaders(id, reqHdrs, true))
+				host.CompleteHttpContext(id)
+
+				var auditLog string
+				for _, l := range host.GetInfoLogs() {
+					if strings.HasPrefix(l, "AuditLog:") {
+						auditLog = strings.TrimPrefix(l, "AuditLog:")
+					}
+				}
+				require.True(t, json.Valid([]byte(auditLog)), auditLog)
+				require.Contains(t, auditLog, `"authorization":["***"]`)
+				require.Contains(t, auditLog, "password=***")
+				require.Contains(t, auditLog, "card=***")
+
+				ruleLogs := strings.Join(host.GetCriticalLogs(), "\n")
+				for _, id := range []string{"101", "102", "103"} {
+					require.Contains(t, ruleLogs, id)
+				}
+
+				var logs []string
+				logs = append(logs, host.GetCriticalLogs()...)
+				logs = append(logs, host.GetErrorLogs()...)
+				logs = append(logs, host.GetWarnLogs()...)
+				logs = append(logs, host.GetInfoLogs()...)
+				for _, l := range logs {
+					for _, secret := range secrets {
+						require.NotContains(t, l, secret)
+					}
+				}
+			})
+		})
+	}
 }
 
 func TestParseCRS(t *testing.T) {
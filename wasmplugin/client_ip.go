@@ -0,0 +1,246 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/debuglog"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
+)
+
+const (
+	// defaultClientIPHeader is the header the client address is read from by default.
+	defaultClientIPHeader = "x-forwarded-for"
+	// forwardedHeader is the standard header of the forwarded requests, see RFC 7239.
+	forwardedHeader = "forwarded"
+	// peerAddressVariable is the TX variable holding the address of the immediate peer, once
+	// the client address has been resolved from the forwarding header.
+	peerAddressVariable = "peer_address"
+	// peerAddressAttribute is the proxy attribute of the address of the immediate peer, added
+	// to the audit logs once the client address has been resolved from the forwarding header.
+	peerAddressAttribute = "source.address"
+)
+
+// clientIPConfig configures the resolution of the client address of the requests forwarded
+// by trusted proxies, e.g. load balancers, the immediate peer being otherwise the client.
+type clientIPConfig struct {
+	// header is the header listing the addresses the request has been forwarded for, either
+	// Forwarded or a header with the X-Forwarded-For syntax.
+	header string
+	// trustedProxies are the addresses of the proxies allowed to set the header. The client is
+	// the closest address not belonging to them, unless trustedHops is set.
+	trustedProxies []*net.IPNet
+	// trustedHops is the number of additional trusted proxies in front of this one, the client
+	// being the (trustedHops+1)-th address from the right of the header, as picked by Envoy with
+	// xff_num_trusted_hops.
+	trustedHops int
+}
+
+func parseClientIP(value gjson.Result) (*clientIPConfig, error) {
+	config := &clientIPConfig{
+		header:      strings.ToLower(value.Get("header").String()),
+		trustedHops: int(value.Get("trusted_hops").Int()),
+	}
+	if config.header == "" {
+		config.header = defaultClientIPHeader
+	}
+	if config.trustedHops < 0 {
+		return nil, errors.New("trusted_hops must not be negative")
+	}
+
+	var err error
+	value.Get("trusted_proxies").ForEach(func(_, value gjson.Result) bool {
+		var cidr *net.IPNet
+		if _, cidr, err = net.ParseCIDR(value.String()); err != nil {
+			return false
+		}
+		config.trustedProxies = append(config.trustedProxies, cidr)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.trustedProxies) == 0 && config.trustedHops == 0 {
+		return nil, errors.New("either trusted_proxies or trusted_hops is required")
+	}
+	return config, nil
+}
+
+// resolve returns the client address of a request received from the peer, given the values of
+// the forwarding header. It returns false if the header can not be trusted: the peer is not a
+// trusted proxy, the header lists no more addresses than the trusted hops or an address between
+// the client and the peer is invalid.
+func (c *clientIPConfig) resolve(peerIP string, values []string) (string, int, bool) {
+	if len(c.trustedProxies) > 0 && !c.isTrusted(net.ParseIP(peerIP)) {
+		return "", 0, false
+	}
+
+	var addresses []string
+	for _, value := range values {
+		if c.header == forwardedHeader {
+			addresses = append(addresses, forwardedForAddresses(value)...)
+		} else {
+			addresses = append(addresses, strings.Split(value, ",")...)
+		}
+	}
+	if len(addresses) == 0 {
+		return "", 0, false
+	}
+
+	if c.trustedHops > 0 {
+		// The rightmost address is the peer of the closest trusted proxy.
+		if len(addresses) <= c.trustedHops {
+			return "", 0, false
+		}
+		ip, port := parseForwardedAddress(addresses[len(addresses)-1-c.trustedHops])
+		if ip == nil {
+			return "", 0, false
+		}
+		return ip.String(), port, true
+	}
+
+	// The addresses are appended by each proxy, the closest one being the last.
+	var ip net.IP
+	var port int
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if ip, port = parseForwardedAddress(addresses[i]); ip == nil {
+			return "", 0, false
+		}
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return ip.String(), port, true
+}
+
+func (c *clientIPConfig) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range c.trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedForAddresses returns the for parameter of each element of a Forwarded header value,
+// empty if missing. The quoted values are not expected to contain commas, which IP addresses
+// and ports do not.
+func forwardedForAddresses(value string) []string {
+	elements := strings.Split(value, ",")
+	addresses := make([]string, len(elements))
+	for i, element := range elements {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(name, "for") {
+				addresses[i] = value
+				break
+			}
+		}
+	}
+	return addresses
+}
+
+// parseForwardedAddress parses an address of a forwarding header, possibly quoted and with a
+// port, e.g. 192.0.2.60, "192.0.2.60:4711" or "[2001:db8::1]:4711". It returns a nil IP if the
+// address is not an IP address, e.g. "unknown" or an obfuscated identifier.
+func parseForwardedAddress(address string) (net.IP, int) {
+	address = strings.Trim(strings.TrimSpace(address), `"`)
+
+	host, portStr := address, ""
+	if strings.HasPrefix(address, "[") {
+		end := strings.Index(address, "]")
+		if end < 0 {
+			return nil, 0
+		}
+		host, portStr = address[1:end], strings.TrimPrefix(address[end+1:], ":")
+	} else if strings.Count(address, ":") == 1 {
+		host, portStr, _ = strings.Cut(address, ":")
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		port = 0
+	}
+	return ip, port
+}
+
+// sourceAddress returns the address of the client, resolved from the forwarding header when the
+// request comes from trusted proxies, the immediate peer being otherwise the client. The address
+// is resolved once, the address of the peer being then kept in peerAddress.
+func (ctx *httpContext) sourceAddress(logger debuglog.Logger) (string, int) {
+	if ctx.sourceResolved {
+		return ctx.sourceIP, ctx.sourcePort
+	}
+	ctx.sourceResolved = true
+	ctx.sourceIP, ctx.sourcePort = retrieveAddressInfo(logger, "source")
+	if ctx.clientIP == nil {
+		return ctx.sourceIP, ctx.sourcePort
+	}
+
+	headers, err := proxywasm.GetHttpRequestHeaders()
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed to get request headers to resolve the client address")
+		return ctx.sourceIP, ctx.sourcePort
+	}
+	var values []string
+	for _, h := range headers {
+		if strings.EqualFold(h[0], ctx.clientIP.header) {
+			values = append(values, h[1])
+		}
+	}
+	if len(values) == 0 {
+		return ctx.sourceIP, ctx.sourcePort
+	}
+
+	clientIP, clientPort, ok := ctx.clientIP.resolve(ctx.sourceIP, values)
+	if !ok {
+		logger.Debug().
+			Str("peer_address", ctx.sourceIP).
+			Str("header", ctx.clientIP.header).
+			Msg("Ignoring untrusted client address header")
+		return ctx.sourceIP, ctx.sourcePort
+	}
+	if clientIP == ctx.sourceIP {
+		return ctx.sourceIP, ctx.sourcePort
+	}
+
+	ctx.peerAddress = net.JoinHostPort(ctx.sourceIP, strconv.Itoa(ctx.sourcePort))
+	ctx.sourceIP, ctx.sourcePort = clientIP, clientPort
+	return ctx.sourceIP, ctx.sourcePort
+}
+
+// addPeerAddress keeps the address of the immediate peer, replaced by the client address in
+// REMOTE_ADDR, in the TX:peer_address variable and in the audit logs.
+func (ctx *httpContext) addPeerAddress() {
+	peerIP, _, _ := net.SplitHostPort(ctx.peerAddress)
+	if state, ok := ctx.tx.(plugintypes.TransactionState); ok {
+		state.Variables().TX().Set(peerAddressVariable, []string{peerIP})
+	}
+
+	txCtx, ok := ctx.txLogContexts[ctx.tx.ID()]
+	if !ok || hasAttribute(txCtx.attributes, peerAddressAttribute) {
+		return
+	}
+	field := debuglog.Str(peerAddressAttribute, ctx.peerAddress)
+	txCtx.attributes = append(txCtx.attributes, auditlog.Attribute{Name: peerAddressAttribute, Value: ctx.peerAddress})
+	txCtx.fields = append(txCtx.fields, field)
+	ctx.txLogContexts[ctx.tx.ID()] = txCtx
+	ctx.logger = ctx.logger.With(field)
+}
@@ -5,23 +5,141 @@ package wasmplugin
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
 
+	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/redact"
 )
 
 // pluginConfiguration is a type to represent an example configuration for this wasm plugin.
 type pluginConfiguration struct {
-	directivesMap          DirectivesMap
-	metricLabels           map[string]string
-	defaultDirectives      string
-	perAuthorityDirectives map[string]string
+	directivesMap             DirectivesMap
+	metricLabels              map[string]string
+	defaultDirectives         string
+	perAuthorityDirectives    map[string]string
+	runtimeMetricsPeriod      time.Duration
+	ruleLogFormat             ruleLogFormat
+	ruleLogRateLimit          *ruleLogRateLimitConfig
+	directivesSettings        map[string]directivesSettings
+	debugTrace                *debugTraceConfig
+	clientIP                  *clientIPConfig
+	transactionIDSource       *transactionIDSource
+	auditLogHTTP              *auditLogCollectorConfig
+	auditLogGRPC              *auditLogCollectorConfig
+	auditLogSharedQueue       *auditLogSharedQueueConfig
+	auditLogAggregator        *auditLogAggregatorConfig
+	auditLogSerial            auditLogSerialConfig
+	redaction                 *redact.Policy
+	envoyAttributes           []envoyAttribute
+	verdictProperty           string
+	responseBodyInterruption  *responseBodyInterruptionConfig
+	grpcInterruption          grpcInterruptionConfig
+	grpcBodyDecoding          *grpcBodyDecodingConfig
+	requestBodyDecompression  *bodyDecompressionConfig
+	responseBodyDecompression *bodyDecompressionConfig
+}
+
+// auditLogSerialConfig configures the "serial" audit log writer, printing the audit logs to the proxy log.
+type auditLogSerialConfig struct {
+	prefix      string
+	logLevel    proxyLogLevel
+	maxLineSize int
+}
+
+// auditLogCollectorConfig configures the "http" and "grpc" audit log writers.
+type auditLogCollectorConfig struct {
+	collector     auditlog.CollectorConfig
+	flushInterval time.Duration
+}
+
+// auditLogSharedQueueConfig configures the "shared_queue" audit log writer.
+type auditLogSharedQueueConfig struct {
+	vmID string
+	name string
 }
 
+// auditLogAggregatorConfig configures the draining of the audit log shared queue
+// by the singleton VM.
+type auditLogAggregatorConfig struct {
+	queueName   string
+	drainPeriod time.Duration
+	maxDrain    int
+	sink        string
+}
+
+// envoyAttribute is a proxy property enriching the logs of the transactions, named after its
+// dotted path, e.g. "xds.route_name".
+type envoyAttribute struct {
+	name string
+	path []string
+}
+
+// transactionIDSource tells where the ID of the transactions is taken from, either
+// a request header or a proxy property.
+type transactionIDSource struct {
+	header   string
+	property []string
+}
+
+// directivesSettings holds the plugin settings specific to a set of directives.
+type directivesSettings struct {
+	ruleLogLevels map[ctypes.RuleSeverity]proxyLogLevel
+	// enrichRequest forwards the WAF outcome of the request to the upstream as request headers.
+	enrichRequest bool
+	// requestBodyStreaming and responseBodyStreaming enable the inspection of the bodies chunk by chunk.
+	requestBodyStreaming  *bodyStreamingConfig
+	responseBodyStreaming *bodyStreamingConfig
+	// bodyLimitActions are read from the directives when the bodies are decompressed.
+	bodyLimitActions bodyLimitActions
+}
+
+// streaming tells whether a body is inspected chunk by chunk.
+func (s directivesSettings) streaming() bool {
+	return s.requestBodyStreaming != nil || s.responseBodyStreaming != nil
+}
+
+const (
+	// defaultRuntimeMetricsPeriod is the default period at which the runtime gauges are refreshed.
+	defaultRuntimeMetricsPeriod = 10 * time.Second
+	// defaultRuleLogSummaryPeriod is the default period at which the number of suppressed rule logs is logged.
+	defaultRuleLogSummaryPeriod = 10 * time.Second
+
+	defaultAuditLogHTTPPath               = "/"
+	defaultAuditLogCollectorBatchSize     = 100
+	defaultAuditLogCollectorQueueSize     = 1000
+	defaultAuditLogCollectorMaxRetries    = 3
+	defaultAuditLogCollectorTimeout       = 5 * time.Second
+	defaultAuditLogCollectorFlushInterval = time.Second
+
+	defaultAuditLogQueueName             = "coraza.audit_logs"
+	defaultAuditLogAggregatorDrainPeriod = time.Second
+	defaultAuditLogAggregatorMaxDrain    = 1000
+	auditLogSinkLog                      = "log"
+	auditLogSinkHTTP                     = "http"
+	auditLogSinkGRPC                     = "grpc"
+
+	// minAuditLogSerialMaxLineSize leaves room for the chunk headers.
+	minAuditLogSerialMaxLineSize = 128
+)
+
 type DirectivesMap map[string][]string
 
 func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfiguration, error) {
-	config := pluginConfiguration{}
+	config := pluginConfiguration{
+		runtimeMetricsPeriod: defaultRuntimeMetricsPeriod,
+		auditLogSerial: auditLogSerialConfig{
+			prefix:   auditlog.DefaultSerialPrefix,
+			logLevel: proxyLogLevelInfo,
+		},
+	}
 
 	data = bytes.TrimSpace(data)
 	if len(data) == 0 {
@@ -56,6 +174,172 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 		return true
 	})
 
+	runtimeMetricsPeriod := jsonData.Get("runtime_metrics_period")
+	if runtimeMetricsPeriod.Exists() {
+		period, err := time.ParseDuration(runtimeMetricsPeriod.String())
+		if err != nil {
+			return config, fmt.Errorf("invalid runtime_metrics_period: %v", err)
+		}
+		if period < 0 {
+			return config, fmt.Errorf("invalid runtime_metrics_period: negative duration %q", runtimeMetricsPeriod.String())
+		}
+		config.runtimeMetricsPeriod = period
+	}
+
+	ruleLogFormat, err := parseRuleLogFormat(jsonData.Get("rule_log_format").String())
+	if err != nil {
+		return config, err
+	}
+	config.ruleLogFormat = ruleLogFormat
+
+	ruleLogRateLimit := jsonData.Get("rule_log_rate_limit")
+	if ruleLogRateLimit.Exists() {
+		rateLimitConfig, err := parseRuleLogRateLimit(ruleLogRateLimit)
+		if err != nil {
+			return config, fmt.Errorf("invalid rule_log_rate_limit: %v", err)
+		}
+		config.ruleLogRateLimit = &rateLimitConfig
+	}
+
+	debugTrace := jsonData.Get("debug_trace")
+	if debugTrace.Exists() {
+		debugTraceConfig, err := parseDebugTrace(debugTrace)
+		if err != nil {
+			return config, fmt.Errorf("invalid debug_trace: %v", err)
+		}
+		config.debugTrace = &debugTraceConfig
+	}
+
+	clientIP := jsonData.Get("client_ip")
+	if clientIP.Exists() {
+		clientIPConfig, err := parseClientIP(clientIP)
+		if err != nil {
+			return config, fmt.Errorf("invalid client_ip: %v", err)
+		}
+		config.clientIP = clientIPConfig
+	}
+
+	transactionID := jsonData.Get("transaction_id")
+	if transactionID.Exists() {
+		source, err := parseTransactionIDSource(transactionID)
+		if err != nil {
+			return config, fmt.Errorf("invalid transaction_id: %v", err)
+		}
+		config.transactionIDSource = &source
+	}
+
+	auditLogHTTP := jsonData.Get("audit_log_http")
+	if auditLogHTTP.Exists() {
+		auditLogHTTPConfig, err := parseAuditLogCollector(auditLogHTTP, true)
+		if err != nil {
+			return config, fmt.Errorf("invalid audit_log_http: %v", err)
+		}
+		config.auditLogHTTP = &auditLogHTTPConfig
+	}
+
+	auditLogGRPC := jsonData.Get("audit_log_grpc")
+	if auditLogGRPC.Exists() {
+		auditLogGRPCConfig, err := parseAuditLogCollector(auditLogGRPC, false)
+		if err != nil {
+			return config, fmt.Errorf("invalid audit_log_grpc: %v", err)
+		}
+		config.auditLogGRPC = &auditLogGRPCConfig
+	}
+
+	auditLogSerial := jsonData.Get("audit_log_serial")
+	if auditLogSerial.Exists() {
+		if err := parseAuditLogSerial(auditLogSerial, &config.auditLogSerial); err != nil {
+			return config, fmt.Errorf("invalid audit_log_serial: %v", err)
+		}
+	}
+
+	auditLogSharedQueue := jsonData.Get("audit_log_shared_queue")
+	if auditLogSharedQueue.Exists() {
+		config.auditLogSharedQueue = &auditLogSharedQueueConfig{
+			vmID: auditLogSharedQueue.Get("vm_id").String(),
+			name: auditLogSharedQueue.Get("name").String(),
+		}
+		if config.auditLogSharedQueue.name == "" {
+			config.auditLogSharedQueue.name = defaultAuditLogQueueName
+		}
+	}
+
+	auditLogAggregator := jsonData.Get("audit_log_aggregator")
+	if auditLogAggregator.Exists() {
+		auditLogAggregatorConfig, err := parseAuditLogAggregator(auditLogAggregator)
+		if err != nil {
+			return config, fmt.Errorf("invalid audit_log_aggregator: %v", err)
+		}
+		if auditLogAggregatorConfig.sink == auditLogSinkHTTP && config.auditLogHTTP == nil {
+			return config, errors.New("invalid audit_log_aggregator: http sink requires audit_log_http")
+		}
+		if auditLogAggregatorConfig.sink == auditLogSinkGRPC && config.auditLogGRPC == nil {
+			return config, errors.New("invalid audit_log_aggregator: grpc sink requires audit_log_grpc")
+		}
+		config.auditLogAggregator = &auditLogAggregatorConfig
+	}
+
+	redaction := jsonData.Get("redaction")
+	if redaction.Exists() {
+		policy, err := parseRedaction(redaction)
+		if err != nil {
+			return config, fmt.Errorf("invalid redaction: %v", err)
+		}
+		config.redaction = policy
+	}
+
+	envoyAttributes := jsonData.Get("envoy_attributes")
+	if envoyAttributes.Exists() {
+		attributes, err := parseEnvoyAttributes(envoyAttributes)
+		if err != nil {
+			return config, fmt.Errorf("invalid envoy_attributes: %v", err)
+		}
+		config.envoyAttributes = attributes
+	}
+
+	config.verdictProperty = jsonData.Get("verdict_property").String()
+
+	responseBodyInterruption := jsonData.Get("response_body_interruption")
+	if responseBodyInterruption.Exists() {
+		interruptionConfig, err := parseResponseBodyInterruption(responseBodyInterruption)
+		if err != nil {
+			return config, fmt.Errorf("invalid response_body_interruption: %v", err)
+		}
+		config.responseBodyInterruption = interruptionConfig
+	}
+
+	grpcInterruption, err := parseGRPCInterruption(jsonData.Get("grpc_interruption"))
+	if err != nil {
+		return config, fmt.Errorf("invalid grpc_interruption: %v", err)
+	}
+	config.grpcInterruption = grpcInterruption
+
+	grpcBodyDecoding := jsonData.Get("grpc_body_decoding")
+	if grpcBodyDecoding.Exists() {
+		decodingConfig, err := parseGRPCBodyDecoding(grpcBodyDecoding)
+		if err != nil {
+			return config, fmt.Errorf("invalid grpc_body_decoding: %v", err)
+		}
+		config.grpcBodyDecoding = decodingConfig
+	}
+
+	requestBodyDecompression := jsonData.Get("request_body_decompression")
+	if requestBodyDecompression.Exists() {
+		decompressionConfig, err := parseBodyDecompression(requestBodyDecompression)
+		if err != nil {
+			return config, fmt.Errorf("invalid request_body_decompression: %v", err)
+		}
+		config.requestBodyDecompression = decompressionConfig
+	}
+	responseBodyDecompression := jsonData.Get("response_body_decompression")
+	if responseBodyDecompression.Exists() {
+		decompressionConfig, err := parseBodyDecompression(responseBodyDecompression)
+		if err != nil {
+			return config, fmt.Errorf("invalid response_body_decompression: %v", err)
+		}
+		config.responseBodyDecompression = decompressionConfig
+	}
+
 	defaultDirectives := jsonData.Get("default_directives")
 	if defaultDirectives.Exists() {
 		defaultDirectivesName := defaultDirectives.String()
@@ -95,5 +379,348 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 		}
 	}
 
+	config.directivesSettings = make(map[string]directivesSettings)
+	var settingsErr error
+	jsonData.Get("directives_settings").ForEach(func(key, value gjson.Result) bool {
+		if _, ok := config.directivesMap[key.String()]; !ok {
+			settingsErr = fmt.Errorf("directive map not found for directives settings: %q", key.String())
+			return false
+		}
+
+		settings, err := parseDirectivesSettings(value)
+		if err != nil {
+			settingsErr = fmt.Errorf("invalid settings for directives %q: %v", key.String(), err)
+			return false
+		}
+		if settings.responseBodyStreaming != nil && config.responseBodyInterruption != nil &&
+			config.responseBodyInterruption.strategy == responseBodyInterruptionReplace {
+			// The chunks already released downstream can not be replaced, only dropped.
+			settingsErr = fmt.Errorf("invalid settings for directives %q: response_body_streaming does not support the replace strategy of response_body_interruption", key.String())
+			return false
+		}
+		config.directivesSettings[key.String()] = settings
+		return true
+	})
+	if settingsErr != nil {
+		return config, settingsErr
+	}
+
+	return config, nil
+}
+
+func parseDirectivesSettings(value gjson.Result) (directivesSettings, error) {
+	settings := directivesSettings{}
+
+	var err error
+	ruleLogLevels := value.Get("rule_log_levels")
+	if ruleLogLevels.Exists() {
+		settings.ruleLogLevels = make(map[ctypes.RuleSeverity]proxyLogLevel)
+		ruleLogLevels.ForEach(func(key, value gjson.Result) bool {
+			var severity ctypes.RuleSeverity
+			if severity, err = ctypes.ParseRuleSeverity(key.String()); err != nil {
+				return false
+			}
+			var level proxyLogLevel
+			if level, err = parseProxyLogLevel(value.String()); err != nil {
+				return false
+			}
+			settings.ruleLogLevels[severity] = level
+			return true
+		})
+	}
+
+	if err != nil {
+		return settings, err
+	}
+
+	settings.enrichRequest = value.Get("enrich_request").Bool()
+
+	if requestBodyStreaming := value.Get("request_body_streaming"); requestBodyStreaming.Exists() {
+		if settings.requestBodyStreaming, err = parseBodyStreaming(requestBodyStreaming); err != nil {
+			return settings, fmt.Errorf("invalid request_body_streaming: %v", err)
+		}
+	}
+
+	if responseBodyStreaming := value.Get("response_body_streaming"); responseBodyStreaming.Exists() {
+		if settings.responseBodyStreaming, err = parseBodyStreaming(responseBodyStreaming); err != nil {
+			return settings, fmt.Errorf("invalid response_body_streaming: %v", err)
+		}
+	}
+
+	return settings, nil
+}
+
+func parseDebugTrace(value gjson.Result) (debugTraceConfig, error) {
+	config := debugTraceConfig{
+		header: strings.ToLower(value.Get("header").String()),
+		secret: value.Get("secret").String(),
+	}
+
+	if config.header == "" {
+		return config, errors.New("header is required")
+	}
+
+	var err error
+	value.Get("source_cidrs").ForEach(func(_, value gjson.Result) bool {
+		var cidr *net.IPNet
+		if _, cidr, err = net.ParseCIDR(value.String()); err != nil {
+			return false
+		}
+		config.sourceCIDRs = append(config.sourceCIDRs, cidr)
+		return true
+	})
+	if err != nil {
+		return config, err
+	}
+
+	if config.secret == "" && len(config.sourceCIDRs) == 0 {
+		return config, errors.New("either secret or source_cidrs is required")
+	}
+
+	if config.level, err = parseDebugTraceLevel(value.Get("level").String()); err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
+
+func parseTransactionIDSource(value gjson.Result) (transactionIDSource, error) {
+	header := value.Get("header").String()
+	property := value.Get("property").String()
+
+	switch {
+	case header != "" && property != "":
+		return transactionIDSource{}, errors.New("only one of header or property can be set")
+	case header != "":
+		return transactionIDSource{header: strings.ToLower(header)}, nil
+	case property != "":
+		return transactionIDSource{property: strings.Split(property, ".")}, nil
+	default:
+		return transactionIDSource{}, errors.New("either header or property is required")
+	}
+}
+
+func parseEnvoyAttributes(value gjson.Result) ([]envoyAttribute, error) {
+	if !value.IsArray() {
+		return nil, errors.New("must be a list of property paths")
+	}
+
+	var attributes []envoyAttribute
+	for _, item := range value.Array() {
+		name := item.String()
+		path := strings.Split(name, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid property path %q", name)
+			}
+		}
+		attributes = append(attributes, envoyAttribute{name: name, path: path})
+	}
+	return attributes, nil
+}
+
+func parseAuditLogSerial(value gjson.Result, config *auditLogSerialConfig) error {
+	if prefix := value.Get("prefix"); prefix.Exists() {
+		config.prefix = prefix.String()
+	}
+
+	if logLevel := value.Get("log_level"); logLevel.Exists() {
+		var err error
+		if config.logLevel, err = parseProxyLogLevel(logLevel.String()); err != nil {
+			return fmt.Errorf("log_level: %v", err)
+		}
+	}
+
+	if maxLineSize := value.Get("max_line_size"); maxLineSize.Exists() {
+		config.maxLineSize = int(maxLineSize.Int())
+		if config.maxLineSize != 0 && config.maxLineSize < minAuditLogSerialMaxLineSize {
+			return fmt.Errorf("max_line_size: must be 0 or at least %d", minAuditLogSerialMaxLineSize)
+		}
+	}
+
+	return nil
+}
+
+// parseAuditLogCollector parses the configuration of a collector, the path being configurable
+// only if withPath is true.
+func parseAuditLogCollector(value gjson.Result, withPath bool) (auditLogCollectorConfig, error) {
+	config := auditLogCollectorConfig{
+		collector: auditlog.CollectorConfig{
+			Cluster:    value.Get("cluster").String(),
+			Authority:  value.Get("authority").String(),
+			BatchSize:  defaultAuditLogCollectorBatchSize,
+			QueueSize:  defaultAuditLogCollectorQueueSize,
+			MaxRetries: defaultAuditLogCollectorMaxRetries,
+			Timeout:    defaultAuditLogCollectorTimeout,
+		},
+		flushInterval: defaultAuditLogCollectorFlushInterval,
+	}
+
+	if config.collector.Cluster == "" {
+		return config, errors.New("cluster is required")
+	}
+
+	if withPath {
+		config.collector.Path = defaultAuditLogHTTPPath
+	}
+	if path := value.Get("path"); path.Exists() {
+		if !withPath {
+			return config, errors.New("path: not supported")
+		}
+		config.collector.Path = path.String()
+		if !strings.HasPrefix(config.collector.Path, "/") {
+			return config, fmt.Errorf("path: must start with /: %q", config.collector.Path)
+		}
+	}
+
+	value.Get("headers").ForEach(func(key, value gjson.Result) bool {
+		config.collector.Headers = append(config.collector.Headers, [2]string{strings.ToLower(key.String()), value.String()})
+		return true
+	})
+
+	for name, size := range map[string]*int{
+		"batch_size": &config.collector.BatchSize,
+		"queue_size": &config.collector.QueueSize,
+	} {
+		if v := value.Get(name); v.Exists() {
+			if *size = int(v.Int()); *size < 1 {
+				return config, fmt.Errorf("%s: must be at least 1", name)
+			}
+		}
+	}
+
+	if maxRetries := value.Get("max_retries"); maxRetries.Exists() {
+		if config.collector.MaxRetries = int(maxRetries.Int()); config.collector.MaxRetries < 0 {
+			return config, errors.New("max_retries: must not be negative")
+		}
+	}
+
+	var err error
+	for name, d := range map[string]*time.Duration{
+		"timeout":        &config.collector.Timeout,
+		"flush_interval": &config.flushInterval,
+	} {
+		if v := value.Get(name); v.Exists() {
+			if *d, err = time.ParseDuration(v.String()); err != nil {
+				return config, fmt.Errorf("%s: %v", name, err)
+			}
+			if *d <= 0 {
+				return config, fmt.Errorf("%s: non positive duration %q", name, v.String())
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func parseAuditLogAggregator(value gjson.Result) (auditLogAggregatorConfig, error) {
+	config := auditLogAggregatorConfig{
+		queueName:   value.Get("queue_name").String(),
+		drainPeriod: defaultAuditLogAggregatorDrainPeriod,
+		maxDrain:    defaultAuditLogAggregatorMaxDrain,
+		sink:        value.Get("sink").String(),
+	}
+
+	if config.queueName == "" {
+		config.queueName = defaultAuditLogQueueName
+	}
+
+	switch config.sink {
+	case "":
+		config.sink = auditLogSinkLog
+	case auditLogSinkLog, auditLogSinkHTTP, auditLogSinkGRPC:
+	default:
+		return config, fmt.Errorf("unknown sink: %q", config.sink)
+	}
+
+	var err error
+	if drainPeriod := value.Get("drain_period"); drainPeriod.Exists() {
+		if config.drainPeriod, err = time.ParseDuration(drainPeriod.String()); err != nil {
+			return config, fmt.Errorf("drain_period: %v", err)
+		}
+		if config.drainPeriod <= 0 {
+			return config, fmt.Errorf("drain_period: non positive duration %q", drainPeriod.String())
+		}
+	}
+
+	if maxDrain := value.Get("max_drain"); maxDrain.Exists() {
+		if config.maxDrain = int(maxDrain.Int()); config.maxDrain < 1 {
+			return config, errors.New("max_drain: must be at least 1")
+		}
+	}
+
+	return config, nil
+}
+
+func parseRuleLogRateLimit(value gjson.Result) (ruleLogRateLimitConfig, error) {
+	config := ruleLogRateLimitConfig{
+		summaryPeriod: defaultRuleLogSummaryPeriod,
+	}
+
+	var err error
+	if perRule := value.Get("per_rule"); perRule.Exists() {
+		var bucket tokenBucketConfig
+		if bucket, err = parseTokenBucketConfig(perRule); err != nil {
+			return config, fmt.Errorf("per_rule: %v", err)
+		}
+		config.perRule = &bucket
+	}
+
+	if perClientIP := value.Get("per_client_ip"); perClientIP.Exists() {
+		var bucket tokenBucketConfig
+		if bucket, err = parseTokenBucketConfig(perClientIP); err != nil {
+			return config, fmt.Errorf("per_client_ip: %v", err)
+		}
+		config.perClientIP = &bucket
+	}
+
+	if summaryPeriod := value.Get("summary_period"); summaryPeriod.Exists() {
+		if config.summaryPeriod, err = time.ParseDuration(summaryPeriod.String()); err != nil {
+			return config, fmt.Errorf("summary_period: %v", err)
+		}
+		if config.summaryPeriod <= 0 {
+			return config, fmt.Errorf("summary_period: non positive duration %q", summaryPeriod.String())
+		}
+	}
+
+	return config, nil
+}
+
+func parseTokenBucketConfig(value gjson.Result) (tokenBucketConfig, error) {
+	config := tokenBucketConfig{
+		rate:  value.Get("rate").Float(),
+		burst: value.Get("burst").Float(),
+	}
+
+	if config.rate <= 0 {
+		return config, errors.New("rate must be positive")
+	}
+
+	if !value.Get("burst").Exists() {
+		config.burst = math.Max(config.rate, 1)
+	} else if config.burst < 1 {
+		return config, errors.New("burst must be at least 1")
+	}
+
+	return config, nil
+}
+
+// parseRedaction parses the policy redacting the sensitive data from the audit logs and the
+// matched rule logs.
+func parseRedaction(value gjson.Result) (*redact.Policy, error) {
+	var headers, args, patterns []string
+	for _, h := range value.Get("headers").Array() {
+		headers = append(headers, h.String())
+	}
+	for _, a := range value.Get("args").Array() {
+		args = append(args, a.String())
+	}
+	for _, p := range value.Get("patterns").Array() {
+		patterns = append(patterns, p.String())
+	}
+	if len(headers) == 0 && len(args) == 0 && len(patterns) == 0 {
+		return nil, errors.New("at least one of headers, args or patterns is required")
+	}
+
+	return redact.NewPolicy(headers, args, patterns, value.Get("replacement").String())
+}
@@ -5,11 +5,17 @@ package wasmplugin
 
 import (
 	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/debuglog"
+	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
 )
 
 func TestParsePluginConfiguration(t *testing.T) {
@@ -243,6 +249,941 @@ func TestParsePluginConfiguration(t *testing.T) {
 	}
 }
 
+func TestParseRuntimeMetricsPeriod(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    bool
+		expectPeriod time.Duration
+	}{
+		{
+			name:         "default",
+			config:       `{}`,
+			expectPeriod: defaultRuntimeMetricsPeriod,
+		},
+		{
+			name:         "custom period",
+			config:       `{"runtime_metrics_period": "1m"}`,
+			expectPeriod: time.Minute,
+		},
+		{
+			name:         "disabled",
+			config:       `{"runtime_metrics_period": "0s"}`,
+			expectPeriod: 0,
+		},
+		{
+			name:      "invalid period",
+			config:    `{"runtime_metrics_period": "foo"}`,
+			expectErr: true,
+		},
+		{
+			name:      "negative period",
+			config:    `{"runtime_metrics_period": "-1s"}`,
+			expectErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectPeriod, cfg.runtimeMetricsPeriod)
+		})
+	}
+}
+
+func TestParseRuleLogFormat(t *testing.T) {
+	cfg, err := parsePluginConfiguration([]byte(`{}`), func(string) {})
+	require.NoError(t, err)
+	assert.Equal(t, ruleLogFormatText, cfg.ruleLogFormat)
+
+	cfg, err = parsePluginConfiguration([]byte(`{"rule_log_format": "json"}`), func(string) {})
+	require.NoError(t, err)
+	assert.Equal(t, ruleLogFormatJSON, cfg.ruleLogFormat)
+
+	_, err = parsePluginConfiguration([]byte(`{"rule_log_format": "xml"}`), func(string) {})
+	require.EqualError(t, err, "unknown rule log format: \"xml\"")
+}
+
+func TestParseDirectivesSettings(t *testing.T) {
+	testCases := []struct {
+		name           string
+		config         string
+		expectErr      string
+		expectSettings map[string]directivesSettings
+	}{
+		{
+			name:           "no settings",
+			config:         `{"directives_map": {"default": []}}`,
+			expectSettings: map[string]directivesSettings{},
+		},
+		{
+			name: "rule log levels",
+			config: `
+			{
+				"directives_map": {"default": [], "custom-01": []},
+				"directives_settings": {
+					"custom-01": {"rule_log_levels": {"critical": "warn", "7": "off"}}
+				}
+			}`,
+			expectSettings: map[string]directivesSettings{
+				"custom-01": {
+					ruleLogLevels: map[ctypes.RuleSeverity]proxyLogLevel{
+						ctypes.RuleSeverityCritical: proxyLogLevelWarn,
+						ctypes.RuleSeverityDebug:    proxyLogLevelOff,
+					},
+				},
+			},
+		},
+		{
+			name:   "enrich request",
+			config: `{"directives_map": {"default": []}, "directives_settings": {"default": {"enrich_request": true}}}`,
+			expectSettings: map[string]directivesSettings{
+				"default": {enrichRequest: true},
+			},
+		},
+		{
+			name:   "response body streaming",
+			config: `{"directives_map": {"default": [], "stream": []}, "directives_settings": {"default": {"response_body_streaming": {}}, "stream": {"response_body_streaming": {"look_behind": 64}}}}`,
+			expectSettings: map[string]directivesSettings{
+				"default": {responseBodyStreaming: &bodyStreamingConfig{lookBehind: defaultStreamingLookBehind}},
+				"stream":  {responseBodyStreaming: &bodyStreamingConfig{lookBehind: 64}},
+			},
+		},
+		{
+			name:   "request body streaming",
+			config: `{"directives_map": {"default": []}, "directives_settings": {"default": {"request_body_streaming": {"look_behind": 0}}}}`,
+			expectSettings: map[string]directivesSettings{
+				"default": {requestBodyStreaming: &bodyStreamingConfig{lookBehind: 0}},
+			},
+		},
+		{
+			name:      "negative look-behind",
+			config:    `{"directives_map": {"default": []}, "directives_settings": {"default": {"response_body_streaming": {"look_behind": -1}}}}`,
+			expectErr: "invalid settings for directives \"default\": invalid response_body_streaming: look_behind must not be negative",
+		},
+		{
+			name:      "response body streaming with the replace strategy",
+			config:    `{"directives_map": {"default": []}, "directives_settings": {"default": {"response_body_streaming": {}}}, "response_body_interruption": {"strategy": "replace"}}`,
+			expectErr: "invalid settings for directives \"default\": response_body_streaming does not support the replace strategy of response_body_interruption",
+		},
+		{
+			name:      "unknown directives",
+			config:    `{"directives_map": {"default": []}, "directives_settings": {"foo": {}}}`,
+			expectErr: "directive map not found for directives settings: \"foo\"",
+		},
+		{
+			name:      "unknown severity",
+			config:    `{"directives_map": {"default": []}, "directives_settings": {"default": {"rule_log_levels": {"fatal": "warn"}}}}`,
+			expectErr: "invalid settings for directives \"default\": unknown severity: fatal",
+		},
+		{
+			name:      "unknown log level",
+			config:    `{"directives_map": {"default": []}, "directives_settings": {"default": {"rule_log_levels": {"critical": "loud"}}}}`,
+			expectErr: "invalid settings for directives \"default\": unknown log level: \"loud\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectSettings, cfg.directivesSettings)
+		})
+	}
+}
+
+func TestParseRuleLogRateLimit(t *testing.T) {
+	testCases := []struct {
+		name            string
+		config          string
+		expectErr       string
+		expectRateLimit *ruleLogRateLimitConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:   "per rule and per client IP",
+			config: `{"rule_log_rate_limit": {"per_rule": {"rate": 10, "burst": 20}, "per_client_ip": {"rate": 0.5}, "summary_period": "1m"}}`,
+			expectRateLimit: &ruleLogRateLimitConfig{
+				perRule:       &tokenBucketConfig{rate: 10, burst: 20},
+				perClientIP:   &tokenBucketConfig{rate: 0.5, burst: 1},
+				summaryPeriod: time.Minute,
+			},
+		},
+		{
+			name:   "default summary period",
+			config: `{"rule_log_rate_limit": {"per_rule": {"rate": 10}}}`,
+			expectRateLimit: &ruleLogRateLimitConfig{
+				perRule:       &tokenBucketConfig{rate: 10, burst: 10},
+				summaryPeriod: defaultRuleLogSummaryPeriod,
+			},
+		},
+		{
+			name:      "invalid rate",
+			config:    `{"rule_log_rate_limit": {"per_rule": {"rate": 0}}}`,
+			expectErr: "invalid rule_log_rate_limit: per_rule: rate must be positive",
+		},
+		{
+			name:      "invalid burst",
+			config:    `{"rule_log_rate_limit": {"per_client_ip": {"rate": 1, "burst": 0.5}}}`,
+			expectErr: "invalid rule_log_rate_limit: per_client_ip: burst must be at least 1",
+		},
+		{
+			name:      "invalid summary period",
+			config:    `{"rule_log_rate_limit": {"summary_period": "0s"}}`,
+			expectErr: "invalid rule_log_rate_limit: summary_period: non positive duration \"0s\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectRateLimit, cfg.ruleLogRateLimit)
+		})
+	}
+}
+
+func TestParseDebugTrace(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+
+	testCases := []struct {
+		name             string
+		config           string
+		expectErr        string
+		expectDebugTrace *debugTraceConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:   "secret",
+			config: `{"debug_trace": {"header": "X-Coraza-Debug", "secret": "s3cr3t"}}`,
+			expectDebugTrace: &debugTraceConfig{
+				header: "x-coraza-debug",
+				secret: "s3cr3t",
+				level:  debuglog.LevelDebug,
+			},
+		},
+		{
+			name:   "source CIDRs",
+			config: `{"debug_trace": {"header": "x-coraza-debug", "source_cidrs": ["10.0.0.0/8"], "level": "trace"}}`,
+			expectDebugTrace: &debugTraceConfig{
+				header:      "x-coraza-debug",
+				sourceCIDRs: []*net.IPNet{cidr},
+				level:       debuglog.LevelTrace,
+			},
+		},
+		{
+			name:      "missing header",
+			config:    `{"debug_trace": {"secret": "s3cr3t"}}`,
+			expectErr: "invalid debug_trace: header is required",
+		},
+		{
+			name:      "missing trigger condition",
+			config:    `{"debug_trace": {"header": "x-coraza-debug"}}`,
+			expectErr: "invalid debug_trace: either secret or source_cidrs is required",
+		},
+		{
+			name:      "invalid CIDR",
+			config:    `{"debug_trace": {"header": "x-coraza-debug", "source_cidrs": ["10.0.0.1"]}}`,
+			expectErr: "invalid debug_trace: invalid CIDR address: 10.0.0.1",
+		},
+		{
+			name:      "invalid level",
+			config:    `{"debug_trace": {"header": "x-coraza-debug", "secret": "s3cr3t", "level": "error"}}`,
+			expectErr: "invalid debug_trace: unknown debug trace level: \"error\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectDebugTrace, cfg.debugTrace)
+		})
+	}
+}
+
+func TestParseClientIP(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+
+	testCases := []struct {
+		name           string
+		config         string
+		expectErr      string
+		expectClientIP *clientIPConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:   "trusted proxies",
+			config: `{"client_ip": {"trusted_proxies": ["10.0.0.0/8"]}}`,
+			expectClientIP: &clientIPConfig{
+				header:         "x-forwarded-for",
+				trustedProxies: []*net.IPNet{cidr},
+			},
+		},
+		{
+			name:   "trusted hops",
+			config: `{"client_ip": {"header": "Forwarded", "trusted_hops": 2}}`,
+			expectClientIP: &clientIPConfig{
+				header:      "forwarded",
+				trustedHops: 2,
+			},
+		},
+		{
+			name:      "missing trusted proxies",
+			config:    `{"client_ip": {"header": "x-real-ip"}}`,
+			expectErr: "invalid client_ip: either trusted_proxies or trusted_hops is required",
+		},
+		{
+			name:      "negative trusted hops",
+			config:    `{"client_ip": {"trusted_hops": -1}}`,
+			expectErr: "invalid client_ip: trusted_hops must not be negative",
+		},
+		{
+			name:      "invalid CIDR",
+			config:    `{"client_ip": {"trusted_proxies": ["10.0.0.1"]}}`,
+			expectErr: "invalid client_ip: invalid CIDR address: 10.0.0.1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectClientIP, cfg.clientIP)
+		})
+	}
+}
+
+func TestParseResponseBodyInterruption(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    string
+		expectConfig *responseBodyInterruptionConfig
+	}{
+		{
+			name:   "default",
+			config: `{}`,
+		},
+		{
+			name:         "default strategy",
+			config:       `{"response_body_interruption": {}}`,
+			expectConfig: &responseBodyInterruptionConfig{strategy: responseBodyInterruptionReplace, body: []byte{}},
+		},
+		{
+			name:   "replace",
+			config: `{"response_body_interruption": {"strategy": "replace", "status": 451, "body": "blocked", "content_type": "text/plain"}}`,
+			expectConfig: &responseBodyInterruptionConfig{
+				strategy:    responseBodyInterruptionReplace,
+				status:      451,
+				body:        []byte("blocked"),
+				contentType: "text/plain",
+			},
+		},
+		{
+			name:         "truncate",
+			config:       `{"response_body_interruption": {"strategy": "truncate"}}`,
+			expectConfig: &responseBodyInterruptionConfig{strategy: responseBodyInterruptionTruncate, body: []byte{}},
+		},
+		{
+			name:         "abort",
+			config:       `{"response_body_interruption": {"strategy": "abort"}}`,
+			expectConfig: &responseBodyInterruptionConfig{strategy: responseBodyInterruptionAbort, body: []byte{}},
+		},
+		{
+			name:      "unknown strategy",
+			config:    `{"response_body_interruption": {"strategy": "nullify"}}`,
+			expectErr: "invalid response_body_interruption: unknown strategy: \"nullify\"",
+		},
+		{
+			name:      "body without replace",
+			config:    `{"response_body_interruption": {"strategy": "abort", "body": "blocked"}}`,
+			expectErr: "invalid response_body_interruption: status, body and content_type are only supported by the replace strategy",
+		},
+		{
+			name:      "invalid status",
+			config:    `{"response_body_interruption": {"status": 99}}`,
+			expectErr: "invalid response_body_interruption: status must be between 200 and 599: 99",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectConfig, cfg.responseBodyInterruption)
+		})
+	}
+}
+
+func TestParseGRPCInterruption(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    string
+		expectConfig grpcInterruptionConfig
+	}{
+		{
+			name:         "default",
+			config:       `{}`,
+			expectConfig: grpcInterruptionConfig{status: grpcStatusPermissionDenied},
+		},
+		{
+			name:         "status and message",
+			config:       `{"grpc_interruption": {"status": 16, "message": "blocked"}}`,
+			expectConfig: grpcInterruptionConfig{status: 16, message: "blocked"},
+		},
+		{
+			name:      "OK status",
+			config:    `{"grpc_interruption": {"status": 0}}`,
+			expectErr: "invalid grpc_interruption: status must be an error gRPC status code, from 1 to 16",
+		},
+		{
+			name:      "unknown status",
+			config:    `{"grpc_interruption": {"status": 17}}`,
+			expectErr: "invalid grpc_interruption: status must be an error gRPC status code, from 1 to 16",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectConfig, cfg.grpcInterruption)
+		})
+	}
+}
+
+func TestParseGRPCBodyDecoding(t *testing.T) {
+	testCases := []struct {
+		name              string
+		config            string
+		expectErr         string
+		expectDecoding    bool
+		expectDescriptors bool
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:           "without descriptor set",
+			config:         `{"grpc_body_decoding": {}}`,
+			expectDecoding: true,
+		},
+		{
+			name:              "empty descriptor set",
+			config:            `{"grpc_body_decoding": {"descriptor_set": ""}}`,
+			expectDecoding:    true,
+			expectDescriptors: true,
+		},
+		{
+			name:      "invalid base64",
+			config:    `{"grpc_body_decoding": {"descriptor_set": "not base64"}}`,
+			expectErr: "invalid grpc_body_decoding: descriptor_set: illegal base64 data at input byte 3",
+		},
+		{
+			name:      "invalid descriptor set",
+			config:    `{"grpc_body_decoding": {"descriptor_set": "CgU="}}`,
+			expectErr: "invalid grpc_body_decoding: descriptor_set: truncated message",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			if !testCase.expectDecoding {
+				require.Nil(t, cfg.grpcBodyDecoding)
+				return
+			}
+			require.NotNil(t, cfg.grpcBodyDecoding)
+			require.Equal(t, testCase.expectDescriptors, cfg.grpcBodyDecoding.descriptors != nil)
+		})
+	}
+}
+
+func TestParseBodyDecompression(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    string
+		expectConfig *bodyDecompressionConfig
+		// expectResponseConfig is the expected response_body_decompression.
+		expectResponseConfig *bodyDecompressionConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:         "request",
+			config:       `{"request_body_decompression": {}}`,
+			expectConfig: &bodyDecompressionConfig{maxSize: defaultDecompressionMaxSize, maxRatio: defaultDecompressionMaxRatio},
+		},
+		{
+			name:                 "response",
+			config:               `{"response_body_decompression": {"max_size": 4096, "max_ratio": 10}}`,
+			expectResponseConfig: &bodyDecompressionConfig{maxSize: 4096, maxRatio: 10},
+		},
+		{
+			name:      "invalid max_size",
+			config:    `{"request_body_decompression": {"max_size": 0}}`,
+			expectErr: "invalid request_body_decompression: max_size must be positive",
+		},
+		{
+			name:      "invalid max_ratio",
+			config:    `{"response_body_decompression": {"max_ratio": -1}}`,
+			expectErr: "invalid response_body_decompression: max_ratio must be positive",
+		},
+		{
+			name:      "unknown key",
+			config:    `{"request_body_decompression": {"max_sise": 4096}}`,
+			expectErr: "invalid request_body_decompression: unknown key \"max_sise\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectConfig, cfg.requestBodyDecompression)
+			assert.Equal(t, testCase.expectResponseConfig, cfg.responseBodyDecompression)
+		})
+	}
+}
+
+func TestReadBodyLimitActions(t *testing.T) {
+	testCases := map[string]struct {
+		directives    string
+		expectActions bodyLimitActions
+	}{
+		"defaults": {
+			directives:    "SecRuleEngine On",
+			expectActions: bodyLimitActions{request: ctypes.BodyLimitActionReject, response: ctypes.BodyLimitActionProcessPartial},
+		},
+		"inline": {
+			directives:    "SecRequestBodyLimitAction ProcessPartial\nSecResponseBodyLimitAction \"Reject\"",
+			expectActions: bodyLimitActions{request: ctypes.BodyLimitActionProcessPartial, response: ctypes.BodyLimitActionReject},
+		},
+		"included": {
+			directives:    "Include @demo-conf\nInclude @owasp_crs/*.conf",
+			expectActions: bodyLimitActions{request: ctypes.BodyLimitActionProcessPartial, response: ctypes.BodyLimitActionProcessPartial},
+		},
+		"overridden after the include": {
+			directives:    "Include @demo-conf\nSecRequestBodyLimitAction Reject",
+			expectActions: bodyLimitActions{request: ctypes.BodyLimitActionReject, response: ctypes.BodyLimitActionProcessPartial},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, testCase.expectActions, readBodyLimitActions(testCase.directives, root))
+		})
+	}
+}
+
+func TestParseTransactionIDSource(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    string
+		expectSource *transactionIDSource
+	}{
+		{
+			name:   "generated",
+			config: `{}`,
+		},
+		{
+			name:         "header",
+			config:       `{"transaction_id": {"header": "X-Request-Id"}}`,
+			expectSource: &transactionIDSource{header: "x-request-id"},
+		},
+		{
+			name:         "property",
+			config:       `{"transaction_id": {"property": "request.id"}}`,
+			expectSource: &transactionIDSource{property: []string{"request", "id"}},
+		},
+		{
+			name:      "header and property",
+			config:    `{"transaction_id": {"header": "x-request-id", "property": "request.id"}}`,
+			expectErr: "invalid transaction_id: only one of header or property can be set",
+		},
+		{
+			name:      "no source",
+			config:    `{"transaction_id": {}}`,
+			expectErr: "invalid transaction_id: either header or property is required",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectSource, cfg.transactionIDSource)
+		})
+	}
+}
+
+func TestParseAuditLogCollectors(t *testing.T) {
+	testCases := []struct {
+		name               string
+		config             string
+		expectErr          string
+		expectAuditLogHTTP *auditLogCollectorConfig
+		expectAuditLogGRPC *auditLogCollectorConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:   "defaults",
+			config: `{"audit_log_http": {"cluster": "audit_collector"}}`,
+			expectAuditLogHTTP: &auditLogCollectorConfig{
+				collector: auditlog.CollectorConfig{
+					Cluster:    "audit_collector",
+					Path:       "/",
+					BatchSize:  100,
+					QueueSize:  1000,
+					MaxRetries: 3,
+					Timeout:    5 * time.Second,
+				},
+				flushInterval: time.Second,
+			},
+		},
+		{
+			name: "custom",
+			config: `{"audit_log_http": {"cluster": "audit_collector", "path": "/ingest", "authority": "collector.local",
+				"headers": {"X-Api-Key": "foo"}, "batch_size": 10, "queue_size": 50, "max_retries": 0, "timeout": "1s", "flush_interval": "500ms"}}`,
+			expectAuditLogHTTP: &auditLogCollectorConfig{
+				collector: auditlog.CollectorConfig{
+					Cluster:    "audit_collector",
+					Path:       "/ingest",
+					Authority:  "collector.local",
+					Headers:    [][2]string{{"x-api-key", "foo"}},
+					BatchSize:  10,
+					QueueSize:  50,
+					MaxRetries: 0,
+					Timeout:    time.Second,
+				},
+				flushInterval: 500 * time.Millisecond,
+			},
+		},
+		{
+			name:   "grpc",
+			config: `{"audit_log_grpc": {"cluster": "audit_grpc", "batch_size": 10}}`,
+			expectAuditLogGRPC: &auditLogCollectorConfig{
+				collector: auditlog.CollectorConfig{
+					Cluster:    "audit_grpc",
+					BatchSize:  10,
+					QueueSize:  1000,
+					MaxRetries: 3,
+					Timeout:    5 * time.Second,
+				},
+				flushInterval: time.Second,
+			},
+		},
+		{
+			name:      "grpc with path",
+			config:    `{"audit_log_grpc": {"cluster": "audit_grpc", "path": "/ingest"}}`,
+			expectErr: "invalid audit_log_grpc: path: not supported",
+		},
+		{
+			name:      "missing cluster",
+			config:    `{"audit_log_http": {"path": "/ingest"}}`,
+			expectErr: "invalid audit_log_http: cluster is required",
+		},
+		{
+			name:      "invalid path",
+			config:    `{"audit_log_http": {"cluster": "audit_collector", "path": "ingest"}}`,
+			expectErr: "invalid audit_log_http: path: must start with /: \"ingest\"",
+		},
+		{
+			name:      "invalid batch size",
+			config:    `{"audit_log_http": {"cluster": "audit_collector", "batch_size": 0}}`,
+			expectErr: "invalid audit_log_http: batch_size: must be at least 1",
+		},
+		{
+			name:      "invalid flush interval",
+			config:    `{"audit_log_http": {"cluster": "audit_collector", "flush_interval": "0s"}}`,
+			expectErr: "invalid audit_log_http: flush_interval: non positive duration \"0s\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectAuditLogHTTP, cfg.auditLogHTTP)
+			assert.Equal(t, testCase.expectAuditLogGRPC, cfg.auditLogGRPC)
+		})
+	}
+}
+
+func TestParseAuditLogSerial(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string
+		expectErr    string
+		expectSerial auditLogSerialConfig
+	}{
+		{
+			name:         "defaults",
+			config:       `{}`,
+			expectSerial: auditLogSerialConfig{prefix: "AuditLog:", logLevel: proxyLogLevelInfo},
+		},
+		{
+			name:         "custom",
+			config:       `{"audit_log_serial": {"prefix": "", "log_level": "warn", "max_line_size": 16384}}`,
+			expectSerial: auditLogSerialConfig{prefix: "", logLevel: proxyLogLevelWarn, maxLineSize: 16384},
+		},
+		{
+			name:      "invalid log level",
+			config:    `{"audit_log_serial": {"log_level": "loud"}}`,
+			expectErr: "invalid audit_log_serial: log_level: unknown log level: \"loud\"",
+		},
+		{
+			name:      "max line size too small",
+			config:    `{"audit_log_serial": {"max_line_size": 10}}`,
+			expectErr: "invalid audit_log_serial: max_line_size: must be 0 or at least 128",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectSerial, cfg.auditLogSerial)
+		})
+	}
+}
+
+func TestParseAuditLogSharedQueue(t *testing.T) {
+	testCases := []struct {
+		name              string
+		config            string
+		expectErr         string
+		expectSharedQueue *auditLogSharedQueueConfig
+		expectAggregator  *auditLogAggregatorConfig
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:              "defaults",
+			config:            `{"audit_log_shared_queue": {}, "audit_log_aggregator": {}}`,
+			expectSharedQueue: &auditLogSharedQueueConfig{name: "coraza.audit_logs"},
+			expectAggregator: &auditLogAggregatorConfig{
+				queueName:   "coraza.audit_logs",
+				drainPeriod: time.Second,
+				maxDrain:    1000,
+				sink:        "log",
+			},
+		},
+		{
+			name: "custom",
+			config: `{"audit_log_shared_queue": {"vm_id": "coraza_audit", "name": "audit"},
+				"audit_log_http": {"cluster": "audit_collector"},
+				"audit_log_aggregator": {"queue_name": "audit", "drain_period": "5s", "max_drain": 10, "sink": "http"}}`,
+			expectSharedQueue: &auditLogSharedQueueConfig{vmID: "coraza_audit", name: "audit"},
+			expectAggregator: &auditLogAggregatorConfig{
+				queueName:   "audit",
+				drainPeriod: 5 * time.Second,
+				maxDrain:    10,
+				sink:        "http",
+			},
+		},
+		{
+			name:      "http sink without collector",
+			config:    `{"audit_log_aggregator": {"sink": "http"}}`,
+			expectErr: "invalid audit_log_aggregator: http sink requires audit_log_http",
+		},
+		{
+			name:      "grpc sink without collector",
+			config:    `{"audit_log_aggregator": {"sink": "grpc"}}`,
+			expectErr: "invalid audit_log_aggregator: grpc sink requires audit_log_grpc",
+		},
+		{
+			name:      "unknown sink",
+			config:    `{"audit_log_aggregator": {"sink": "file"}}`,
+			expectErr: "invalid audit_log_aggregator: unknown sink: \"file\"",
+		},
+		{
+			name:      "invalid max drain",
+			config:    `{"audit_log_aggregator": {"max_drain": 0}}`,
+			expectErr: "invalid audit_log_aggregator: max_drain: must be at least 1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectSharedQueue, cfg.auditLogSharedQueue)
+			assert.Equal(t, testCase.expectAggregator, cfg.auditLogAggregator)
+		})
+	}
+}
+
+func TestParseRedaction(t *testing.T) {
+	testCases := []struct {
+		name              string
+		config            string
+		expectErr         string
+		expectReplacement string
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:              "default replacement",
+			config:            `{"redaction": {"headers": ["authorization"]}}`,
+			expectReplacement: "[REDACTED]",
+		},
+		{
+			name:              "custom replacement",
+			config:            `{"redaction": {"args": ["password"], "replacement": "***"}}`,
+			expectReplacement: "***",
+		},
+		{
+			name:      "empty",
+			config:    `{"redaction": {"replacement": "***"}}`,
+			expectErr: "invalid redaction: at least one of headers, args or patterns is required",
+		},
+		{
+			name:      "invalid pattern",
+			config:    `{"redaction": {"patterns": ["("]}}`,
+			expectErr: "invalid redaction: invalid pattern \"(\": error parsing regexp: missing closing ): `(`",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			if testCase.expectReplacement == "" {
+				require.Nil(t, cfg.redaction)
+				return
+			}
+			require.NotNil(t, cfg.redaction)
+			require.Equal(t, testCase.expectReplacement, cfg.redaction.Replacement())
+		})
+	}
+}
+
+func TestParseEnvoyAttributes(t *testing.T) {
+	testCases := []struct {
+		name             string
+		config           string
+		expectErr        string
+		expectAttributes []envoyAttribute
+	}{
+		{
+			name:   "disabled",
+			config: `{}`,
+		},
+		{
+			name:   "attributes",
+			config: `{"envoy_attributes": ["xds.route_name", "node.id"]}`,
+			expectAttributes: []envoyAttribute{
+				{name: "xds.route_name", path: []string{"xds", "route_name"}},
+				{name: "node.id", path: []string{"node", "id"}},
+			},
+		},
+		{
+			name:      "not a list",
+			config:    `{"envoy_attributes": "xds.route_name"}`,
+			expectErr: "invalid envoy_attributes: must be a list of property paths",
+		},
+		{
+			name:      "empty segment",
+			config:    `{"envoy_attributes": ["xds..route_name"]}`,
+			expectErr: "invalid envoy_attributes: invalid property path \"xds..route_name\"",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			if testCase.expectErr != "" {
+				require.EqualError(t, err, testCase.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectAttributes, cfg.envoyAttributes)
+		})
+	}
+}
+
 func TestWAFMap(t *testing.T) {
 	w, _ := coraza.NewWAF(coraza.NewWAFConfig())
 
@@ -0,0 +1,181 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/debuglog"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// debugTraceConfig configures the debug tracing of single requests. A request is traced
+// when it carries the header and, if configured, the header value matches the secret and
+// the source address belongs to one of the source CIDRs.
+type debugTraceConfig struct {
+	header      string
+	secret      string
+	sourceCIDRs []*net.IPNet
+	level       debuglog.Level
+}
+
+func parseDebugTraceLevel(level string) (debuglog.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "debug":
+		return debuglog.LevelDebug, nil
+	case "trace":
+		return debuglog.LevelTrace, nil
+	case "info":
+		return debuglog.LevelInfo, nil
+	default:
+		return debuglog.LevelUnknown, fmt.Errorf("unknown debug trace level: %q", level)
+	}
+}
+
+// isTriggered reports whether a request with the given header value and source IP has to be traced.
+func (c *debugTraceConfig) isTriggered(headerValue string, sourceIP string) bool {
+	if c.secret != "" && subtle.ConstantTimeCompare([]byte(headerValue), []byte(c.secret)) != 1 {
+		return false
+	}
+
+	if len(c.sourceCIDRs) > 0 {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return false
+		}
+		for _, cidr := range c.sourceCIDRs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// tracedTransactions is the set of the IDs of the transactions being traced.
+type tracedTransactions map[string]struct{}
+
+// traceableLogger is the debug logger of a WAF that logs at a higher level the
+// transactions being traced. Coraza derives the logger of each transaction adding
+// the tx_id field, which is used to tell whether the transaction is traced.
+type traceableLogger struct {
+	debuglog.Logger
+	tracer    debuglog.Logger
+	txID      string
+	tracedTXs tracedTransactions
+}
+
+var _ debuglog.Logger = traceableLogger{}
+
+// tracePrinterFactory prints the logs of traced transactions at least at info level, so that
+// they are visible without raising the log level of the proxy.
+var tracePrinterFactory = func(io.Writer) debuglog.Printer {
+	return func(lvl debuglog.Level, message, fields string) {
+		switch lvl {
+		case debuglog.LevelWarn:
+			proxywasm.LogWarnf("%s %s", message, fields)
+		case debuglog.LevelError:
+			proxywasm.LogErrorf("%s %s", message, fields)
+		default:
+			proxywasm.LogInfof("[%s] %s %s", lvl.String(), message, fields)
+		}
+	}
+}
+
+func newTraceableLogger(base debuglog.Logger, level debuglog.Level, tracedTXs tracedTransactions) debuglog.Logger {
+	return traceableLogger{
+		Logger: base,
+		tracer: debuglog.DefaultWithPrinterFactory(tracePrinterFactory).
+			WithLevel(level).
+			With(debuglog.Bool("debug_trace", true)),
+		tracedTXs: tracedTXs,
+	}
+}
+
+func (l traceableLogger) current() debuglog.Logger {
+	if l.txID == "" {
+		return l.Logger
+	}
+	if _, ok := l.tracedTXs[l.txID]; ok {
+		return l.tracer
+	}
+	return l.Logger
+}
+
+func (l traceableLogger) WithOutput(w io.Writer) debuglog.Logger {
+	l.Logger = l.Logger.WithOutput(w)
+	return l
+}
+
+func (l traceableLogger) WithLevel(lvl debuglog.Level) debuglog.Logger {
+	l.Logger = l.Logger.WithLevel(lvl)
+	return l
+}
+
+func (l traceableLogger) With(fs ...debuglog.ContextField) debuglog.Logger {
+	e := &fieldsCaptureEvent{}
+	for _, f := range fs {
+		f(e)
+	}
+	if e.txID != "" {
+		l.txID = e.txID
+	}
+	l.Logger = l.Logger.With(fs...)
+	l.tracer = l.tracer.With(fs...)
+	return l
+}
+
+func (l traceableLogger) Trace() debuglog.Event {
+	return l.current().Trace()
+}
+
+func (l traceableLogger) Debug() debuglog.Event {
+	return l.current().Debug()
+}
+
+func (l traceableLogger) Info() debuglog.Event {
+	return l.current().Info()
+}
+
+func (l traceableLogger) Warn() debuglog.Event {
+	return l.current().Warn()
+}
+
+func (l traceableLogger) Error() debuglog.Event {
+	return l.current().Error()
+}
+
+// fieldsCaptureEvent captures the transaction ID out of context fields.
+type fieldsCaptureEvent struct {
+	txID string
+}
+
+var _ debuglog.Event = (*fieldsCaptureEvent)(nil)
+
+func (*fieldsCaptureEvent) Msg(string) {}
+
+func (e *fieldsCaptureEvent) Str(key, val string) debuglog.Event {
+	if key == "tx_id" {
+		e.txID = val
+	}
+	return e
+}
+
+func (e *fieldsCaptureEvent) Err(error) debuglog.Event { return e }
+
+func (e *fieldsCaptureEvent) Bool(string, bool) debuglog.Event { return e }
+
+func (e *fieldsCaptureEvent) Int(string, int) debuglog.Event { return e }
+
+func (e *fieldsCaptureEvent) Uint(string, uint) debuglog.Event { return e }
+
+func (e *fieldsCaptureEvent) Stringer(string, fmt.Stringer) debuglog.Event { return e }
+
+func (*fieldsCaptureEvent) IsEnabled() bool { return true }
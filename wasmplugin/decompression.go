@@ -0,0 +1,606 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/corazawaf/coraza/v3/collection"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// decompressionMargin is the size of the compressed data kept unread until the next chunk. The
+	// decompressors can not resume once they ran out of input, while a deflate block yields up to
+	// 32KiB of data at once from less than 64KiB of compressed data.
+	decompressionMargin = 128 * 1024
+	// decompressionBufferSize is the size of the decompressed data written at once into the transaction.
+	decompressionBufferSize = 32 * 1024
+	// defaultDecompressionMaxSize is the default maximum size of a decompressed body.
+	defaultDecompressionMaxSize = 1024 * 1024
+	// defaultDecompressionMaxRatio is the default maximum ratio between the sizes of a
+	// decompressed body and of the compressed one, guarding against decompression bombs.
+	defaultDecompressionMaxRatio = 100
+	// maxIncludeDepth is the maximum depth of the includes followed to read the body limit actions.
+	maxIncludeDepth = 10
+)
+
+var (
+	// errInputPending is returned while decompressing a body whose next chunks are required.
+	errInputPending = errors.New("compressed input pending")
+	// errDecompressionLimit is returned once the decompressed data exceeds the decompression limits.
+	errDecompressionLimit = errors.New("decompression limit exceeded")
+)
+
+// bodyDecompressionConfig configures the decompression of the bodies before their inspection. The
+// decompressed data is limited by maxSize and maxRatio times the size of the compressed body, as
+// well as by SecRequestBodyLimit and SecResponseBodyLimit.
+type bodyDecompressionConfig struct {
+	maxSize  int
+	maxRatio int
+}
+
+func parseBodyDecompression(value gjson.Result) (*bodyDecompressionConfig, error) {
+	config := &bodyDecompressionConfig{
+		maxSize:  defaultDecompressionMaxSize,
+		maxRatio: defaultDecompressionMaxRatio,
+	}
+	var err error
+	value.ForEach(func(key, value gjson.Result) bool {
+		switch key.String() {
+		case "max_size":
+			config.maxSize = int(value.Int())
+		case "max_ratio":
+			config.maxRatio = int(value.Int())
+		default:
+			err = fmt.Errorf("unknown key %q", key.String())
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.maxSize <= 0 {
+		return nil, errors.New("max_size must be positive")
+	}
+	if config.maxRatio <= 0 {
+		return nil, errors.New("max_ratio must be positive")
+	}
+	return config, nil
+}
+
+// limit returns the maximum size of the data decompressed from a compressed body of the given size.
+func (c *bodyDecompressionConfig) limit(compressedSize int) int {
+	return min(c.maxSize, c.maxRatio*compressedSize)
+}
+
+// bodyLimitActions holds the SecRequestBodyLimitAction and SecResponseBodyLimitAction of a set of
+// directives, which apply as well to the bodies exceeding the decompression limits.
+type bodyLimitActions struct {
+	request  ctypes.BodyLimitAction
+	response ctypes.BodyLimitAction
+}
+
+// readBodyLimitActions reads the body limit actions set by the directives, following the included
+// files, Coraza not exposing them. The actions default to the ones of Coraza.
+func readBodyLimitActions(directives string, root fs.FS) bodyLimitActions {
+	actions := bodyLimitActions{
+		request:  ctypes.BodyLimitActionReject,
+		response: ctypes.BodyLimitActionProcessPartial,
+	}
+	actions.read(directives, "", root, 0)
+	return actions
+}
+
+func (a *bodyLimitActions) read(directives string, dir string, root fs.FS, depth int) {
+	var line strings.Builder
+	for _, l := range strings.Split(directives, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		if strings.HasSuffix(l, "\\") {
+			line.WriteString(strings.TrimSuffix(l, "\\"))
+			continue
+		}
+		line.WriteString(l)
+		directive, opts, _ := strings.Cut(line.String(), " ")
+		opts = strings.Trim(strings.TrimSpace(opts), `"`)
+		line.Reset()
+
+		switch strings.ToLower(directive) {
+		case "include":
+			if depth < maxIncludeDepth {
+				a.include(opts, dir, root, depth+1)
+			}
+		case "secrequestbodylimitaction":
+			a.request = parseBodyLimitAction(opts, a.request)
+		case "secresponsebodylimitaction":
+			a.response = parseBodyLimitAction(opts, a.response)
+		}
+	}
+}
+
+// include reads the body limit actions of included files, resolved as Coraza does.
+func (a *bodyLimitActions) include(pattern string, dir string, root fs.FS, depth int) {
+	files := []string{pattern}
+	if strings.Contains(pattern, "*") {
+		files, _ = fs.Glob(root, pattern)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file, "/") {
+			file = path.Join(dir, file)
+		}
+		data, err := fs.ReadFile(root, file)
+		if err != nil {
+			continue
+		}
+		a.read(string(data), path.Dir(file), root, depth)
+	}
+}
+
+func parseBodyLimitAction(action string, current ctypes.BodyLimitAction) ctypes.BodyLimitAction {
+	switch strings.ToLower(action) {
+	case "reject":
+		return ctypes.BodyLimitActionReject
+	case "processpartial":
+		return ctypes.BodyLimitActionProcessPartial
+	default:
+		return current
+	}
+}
+
+// isCompressed tells whether a Content-Encoding header value requires a decompression.
+func isCompressed(contentEncoding string) bool {
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			return true
+		}
+	}
+	return false
+}
+
+// newDecompressors returns the reader of the data decoded according to a Content-Encoding, the
+// encodings being undone in the reverse order they have been applied.
+func newDecompressors(contentEncoding string, r io.Reader) (io.Reader, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		var err error
+		if r, err = newDecompressor(encoding, bufio.NewReader(r)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func newDecompressor(encoding string, r *bufio.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		return gr, nil
+	case "deflate":
+		// deflate is the zlib format, although some clients send raw deflate data.
+		header, err := r.Peek(2)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid deflate data: %w", err)
+		}
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid deflate data: %w", err)
+			}
+			return zr, nil
+		}
+		return flate.NewReader(r), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// compressedInput holds the compressed data received and not read yet by the decompressors.
+type compressedInput struct {
+	data        []byte
+	endOfStream bool
+}
+
+func (in *compressedInput) Read(p []byte) (int, error) {
+	if len(in.data) == 0 {
+		if in.endOfStream {
+			return 0, io.EOF
+		}
+		return 0, errInputPending
+	}
+	n := copy(p, in.data)
+	in.data = in.data[n:]
+	return n, nil
+}
+
+// bodyDecompressor decompresses a body as its chunks are received, so that the decompressed data
+// is inspected, and the decompression stopped, as soon as the body limit is reached.
+type bodyDecompressor struct {
+	contentEncoding string
+	limits          *bodyDecompressionConfig
+	input           compressedInput
+	reader          io.Reader
+	buf             []byte
+	// received is the size of the compressed body received, read the size of the data decompressed.
+	received int
+	read     int
+	// skip is the size of the data decompressed before a restart, discarded by the new decompressors.
+	skip int
+	// stalled tells whether the decompressors ran out of input, the decompression being restarted
+	// over the whole body once received.
+	stalled bool
+	// passThrough tells whether the body is read as it is, as it could not be decompressed at all.
+	passThrough bool
+	done        bool
+}
+
+func newBodyDecompressor(contentEncoding string, limits *bodyDecompressionConfig) *bodyDecompressor {
+	return &bodyDecompressor{contentEncoding: contentEncoding, limits: limits}
+}
+
+// write appends a chunk of the compressed body.
+func (d *bodyDecompressor) write(chunk []byte, endOfStream bool) {
+	d.received += len(chunk)
+	d.input.endOfStream = endOfStream
+	if !d.stalled && !d.done {
+		d.input.data = append(d.input.data, chunk...)
+	}
+}
+
+// restart decompresses again the whole body of a stalled decompressor, the data already read being skipped.
+func (d *bodyDecompressor) restart(body []byte) {
+	d.input = compressedInput{data: body, endOfStream: d.input.endOfStream}
+	d.reader = nil
+	d.skip = d.read
+	d.stalled = false
+}
+
+// readAsIs reads the body received so far, and the next chunks, without decompressing them.
+func (d *bodyDecompressor) readAsIs(body []byte) {
+	d.input = compressedInput{data: body, endOfStream: d.input.endOfStream}
+	d.passThrough = true
+	d.done = false
+}
+
+// next returns the next data decompressed, errInputPending if the next chunks are required,
+// errDecompressionLimit along with the data up to the limit once the decompression limits are
+// exceeded and io.EOF once the whole body has been read. Any other error is due to invalid data.
+func (d *bodyDecompressor) next() ([]byte, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	if d.passThrough {
+		data := d.input.data
+		d.input.data = nil
+		if len(data) == 0 && d.input.endOfStream {
+			return nil, io.EOF
+		} else if len(data) == 0 {
+			return nil, errInputPending
+		}
+		return data, nil
+	}
+	// A margin is kept until the end of the body, so that the decompressors do not run out of input.
+	if d.stalled || (!d.input.endOfStream && len(d.input.data) < decompressionMargin) {
+		return nil, errInputPending
+	}
+
+	if d.reader == nil {
+		if d.received == 0 {
+			d.done = true
+			return nil, io.EOF
+		}
+		r, err := newDecompressors(d.contentEncoding, &d.input)
+		if err != nil {
+			return nil, d.fail(err)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(d.skip)); err != nil {
+			return nil, d.fail(err)
+		}
+		d.reader = r
+		d.buf = make([]byte, decompressionBufferSize)
+	}
+
+	n, err := d.reader.Read(d.buf)
+	if limit := d.limits.limit(d.received); d.read+n > limit {
+		// The ratio is checked against the compressed data received so far.
+		n = max(limit-d.read, 0)
+		d.read += n
+		d.done = true
+		d.input.data = nil
+		return d.buf[:n], errDecompressionLimit
+	}
+	d.read += n
+	if errors.Is(err, io.EOF) {
+		d.done = true
+		err = nil
+	} else if err != nil {
+		err = d.fail(err)
+	}
+	return d.buf[:n], err
+}
+
+// fail stops the decompression, unless the decompressors ran out of input.
+func (d *bodyDecompressor) fail(err error) error {
+	d.input.data = nil
+	if errors.Is(err, errInputPending) {
+		d.stalled = true
+		return errInputPending
+	}
+	d.done = true
+	return err
+}
+
+// inspectCompressedRequestBody decompresses the request body as its chunks are received, and
+// inspects the decompressed data until SecRequestBodyLimit is reached. The compressed body is
+// buffered until the end of the inspection, the upstream receiving the original body.
+func (ctx *httpContext) inspectCompressedRequestBody(bodySize int, endOfStream bool) types.Action {
+	if ctx.requestDecompressor == nil {
+		ctx.requestDecompressor = newBodyDecompressor(ctx.requestContentEncoding, ctx.requestBodyDecompression)
+	}
+	d := ctx.requestDecompressor
+
+	// bodyReadIndex tracks the size of the buffered body, used if the request ends with trailers.
+	if chunkSize := bodySize - ctx.bodyReadIndex; chunkSize > 0 || endOfStream {
+		var chunk []byte
+		if chunkSize > 0 {
+			var err error
+			if chunk, err = proxywasm.GetHttpRequestBody(ctx.bodyReadIndex, chunkSize); err != nil {
+				ctx.logger.Error().Err(err).Int("body_size", bodySize).Msg("Failed to read request body")
+				return types.ActionContinue
+			}
+			ctx.bodyReadIndex = bodySize
+		}
+		d.write(chunk, endOfStream)
+	}
+
+	for {
+		data, err := d.next()
+		if errors.Is(err, errInputPending) && endOfStream {
+			// The decompressors ran out of input, the decompression restarts over the whole body.
+			body, bodyErr := proxywasm.GetHttpRequestBody(0, bodySize)
+			if bodyErr != nil {
+				ctx.logger.Error().Err(bodyErr).Int("body_size", bodySize).Msg("Failed to read request body")
+				return types.ActionContinue
+			}
+			d.restart(body)
+			continue
+		}
+
+		if len(data) > 0 {
+			interruption, writtenBytes, writeErr := ctx.tx.WriteRequestBody(data)
+			if writeErr != nil {
+				ctx.logger.Error().Err(writeErr).Msg("Failed to write request body")
+				return types.ActionContinue
+			}
+			ctx.metrics.CountRequestBodyInspectedBytes(writtenBytes, ctx.metricLabelsKV)
+			if interruption != nil {
+				return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+			}
+			// As for the uncompressed bodies, ProcessRequestBody has been called internally once the limit
+			// is reached: the decompression stops, the rest of the body being released as it is.
+			if writtenBytes < len(data) {
+				ctx.metrics.CountRequestBodyLimitReached(ctx.metricLabelsKV)
+				ctx.processedRequestBody = true
+				ctx.requestDecompressor = nil
+				ctx.bodyReadIndex = 0
+				ctx.addEnrichmentHeaders()
+				return types.ActionContinue
+			}
+			if ctx.grpcRequest && ctx.grpcBodyDecoding != nil {
+				ctx.grpcRequestBody = append(ctx.grpcRequestBody, data...)
+			}
+		}
+
+		if errors.Is(err, errInputPending) {
+			return types.ActionPause
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, errDecompressionLimit) {
+			return ctx.requestDecompressionLimitReached()
+		}
+		if err != nil {
+			ctx.metrics.CountRequestBodyDecompressionError(ctx.metricLabelsKV)
+			ctx.logger.Warn().Err(err).
+				Str("content_encoding", ctx.requestContentEncoding).
+				Msg("Failed to decompress request body")
+			// Invalid data is reported as a request body error, e.g. matched by the CRS rule 200002.
+			if state, ok := ctx.tx.(plugintypes.TransactionState); ok {
+				setSingle(state.Variables().RequestBodyError(), "1")
+				setSingle(state.Variables().RequestBodyErrorMsg(), "decompression: "+err.Error())
+			}
+			if d.read == 0 {
+				// The original body is inspected if it could not be decompressed at all.
+				body, bodyErr := proxywasm.GetHttpRequestBody(0, bodySize)
+				if bodyErr != nil {
+					ctx.logger.Error().Err(bodyErr).Int("body_size", bodySize).Msg("Failed to read request body")
+					return types.ActionContinue
+				}
+				d.readAsIs(body)
+			}
+		}
+	}
+
+	if ctx.grpcRequest && ctx.grpcBodyDecoding != nil {
+		ctx.decodeGRPCMessages(ctx.grpcRequestBody)
+		ctx.grpcRequestBody = nil
+	}
+	ctx.requestDecompressor = nil
+	ctx.bodyReadIndex = 0
+	return ctx.processRequestBody()
+}
+
+// inspectCompressedResponseBody decompresses the response body as its chunks are received, and
+// inspects the decompressed data until SecResponseBodyLimit is reached. The compressed body is
+// buffered until the end of the inspection, the client receiving the original body.
+func (ctx *httpContext) inspectCompressedResponseBody(bodySize int, endOfStream bool) types.Action {
+	if ctx.responseDecompressor == nil {
+		ctx.responseDecompressor = newBodyDecompressor(ctx.responseContentEncoding, ctx.responseBodyDecompression)
+	}
+	d := ctx.responseDecompressor
+
+	// bodyReadIndex tracks the size of the buffered body, used if the response ends with trailers.
+	if chunkSize := bodySize - ctx.bodyReadIndex; chunkSize > 0 || endOfStream {
+		var chunk []byte
+		if chunkSize > 0 {
+			var err error
+			if chunk, err = proxywasm.GetHttpResponseBody(ctx.bodyReadIndex, chunkSize); err != nil {
+				ctx.logger.Error().Err(err).Int("body_size", bodySize).Msg("Failed to read response body")
+				return types.ActionContinue
+			}
+			ctx.bodyReadIndex = bodySize
+		}
+		d.write(chunk, endOfStream)
+	}
+
+	for {
+		data, err := d.next()
+		if errors.Is(err, errInputPending) && endOfStream {
+			// The decompressors ran out of input, the decompression restarts over the whole body.
+			body, bodyErr := proxywasm.GetHttpResponseBody(0, bodySize)
+			if bodyErr != nil {
+				ctx.logger.Error().Err(bodyErr).Int("body_size", bodySize).Msg("Failed to read response body")
+				return types.ActionContinue
+			}
+			d.restart(body)
+			continue
+		}
+
+		if len(data) > 0 {
+			interruption, writtenBytes, writeErr := ctx.tx.WriteResponseBody(data)
+			if writeErr != nil {
+				ctx.logger.Error().Err(writeErr).Msg("Failed to write response body")
+				return types.ActionContinue
+			}
+			ctx.metrics.CountResponseBodyInspectedBytes(writtenBytes, ctx.metricLabelsKV)
+			if interruption != nil {
+				return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+			}
+			// As for the uncompressed bodies, ProcessResponseBody has been called internally once the limit
+			// is reached: the decompression stops, the rest of the body being released as it is.
+			if writtenBytes < len(data) {
+				ctx.metrics.CountResponseBodyLimitReached(ctx.metricLabelsKV)
+				ctx.processedResponseBody = true
+				ctx.responseDecompressor = nil
+				ctx.bodyReadIndex = 0
+				return types.ActionContinue
+			}
+		}
+
+		if errors.Is(err, errInputPending) {
+			return types.ActionPause
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, errDecompressionLimit) {
+			return ctx.responseDecompressionLimitReached()
+		}
+		if err != nil {
+			ctx.metrics.CountResponseBodyDecompressionError(ctx.metricLabelsKV)
+			ctx.logger.Warn().Err(err).
+				Str("content_encoding", ctx.responseContentEncoding).
+				Msg("Failed to decompress response body")
+			if d.read == 0 {
+				// The original body is inspected if it could not be decompressed at all.
+				body, bodyErr := proxywasm.GetHttpResponseBody(0, bodySize)
+				if bodyErr != nil {
+					ctx.logger.Error().Err(bodyErr).Int("body_size", bodySize).Msg("Failed to read response body")
+					return types.ActionContinue
+				}
+				d.readAsIs(body)
+			}
+		}
+	}
+
+	ctx.responseDecompressor = nil
+	ctx.bodyReadIndex = 0
+	return ctx.processResponseBody()
+}
+
+// requestDecompressionLimitReached handles a request body exceeding the decompression limits as one
+// exceeding SecRequestBodyLimit: Reject interrupts the request, ProcessPartial evaluates the request
+// body phase against the data decompressed up to the limits, the rest of the body being released.
+func (ctx *httpContext) requestDecompressionLimitReached() types.Action {
+	ctx.metrics.CountRequestBodyLimitReached(ctx.metricLabelsKV)
+	ctx.logger.Warn().
+		Str("content_encoding", ctx.requestContentEncoding).
+		Msg("Decompressed request body exceeds the decompression limits")
+	ctx.requestDecompressor = nil
+	ctx.bodyReadIndex = 0
+
+	state, ok := ctx.tx.(plugintypes.TransactionState)
+	if ok {
+		setSingle(state.Variables().InboundDataError(), "1")
+	}
+	if ctx.settings.bodyLimitActions.request == ctypes.BodyLimitActionReject {
+		interruption := &ctypes.Interruption{Status: 413, Action: "deny"}
+		if ok {
+			state.Interrupt(interruption)
+		}
+		ctx.processedRequestBody = true
+		return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+	}
+	return ctx.processRequestBody()
+}
+
+// responseDecompressionLimitReached handles a response body exceeding the decompression limits as
+// one exceeding SecResponseBodyLimit, according to SecResponseBodyLimitAction.
+func (ctx *httpContext) responseDecompressionLimitReached() types.Action {
+	ctx.metrics.CountResponseBodyLimitReached(ctx.metricLabelsKV)
+	ctx.logger.Warn().
+		Str("content_encoding", ctx.responseContentEncoding).
+		Msg("Decompressed response body exceeds the decompression limits")
+	ctx.responseDecompressor = nil
+	ctx.bodyReadIndex = 0
+
+	state, ok := ctx.tx.(plugintypes.TransactionState)
+	if ok {
+		setSingle(state.Variables().OutboundDataError(), "1")
+	}
+	if ctx.settings.bodyLimitActions.response == ctypes.BodyLimitActionReject {
+		interruption := &ctypes.Interruption{Status: 413, Action: "deny"}
+		if ok {
+			state.Interrupt(interruption)
+		}
+		ctx.processedResponseBody = true
+		return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+	}
+	return ctx.processResponseBody()
+}
+
+// setSingle sets the value of a single-value variable, whose collection.Single interface is read-only.
+func setSingle(variable collection.Single, value string) {
+	if s, ok := variable.(interface{ Set(string) }); ok {
+		s.Set(value)
+	}
+}
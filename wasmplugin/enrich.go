@@ -0,0 +1,58 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// Request headers forwarding the WAF outcome of the request to the upstream in enrich mode.
+const (
+	enrichAnomalyScoreHeader  = "x-waf-anomaly-score"
+	enrichMatchedRulesHeader  = "x-waf-matched-rules"
+	enrichTransactionIDHeader = "x-waf-transaction-id"
+)
+
+var enrichmentHeaders = []string{enrichAnomalyScoreHeader, enrichMatchedRulesHeader, enrichTransactionIDHeader}
+
+// removeEnrichmentHeaders removes the enrichment headers sent by the client, so that the
+// upstream can trust the ones it receives.
+func (ctx *httpContext) removeEnrichmentHeaders() {
+	for _, name := range enrichmentHeaders {
+		if err := proxywasm.RemoveHttpRequestHeader(name); err != nil {
+			ctx.logger.Error().Err(err).Str("header", name).Msg("Failed to remove enrichment header")
+		}
+	}
+}
+
+// addEnrichmentHeaders adds the enrichment headers to the upstream request once the request
+// has been inspected. The anomaly score and the matched rules are only added when available.
+func (ctx *httpContext) addEnrichmentHeaders() {
+	if !ctx.enrichRequest {
+		return
+	}
+	// The headers are added once, even if the request body is processed again, e.g. on trailers.
+	ctx.enrichRequest = false
+
+	headers := [][2]string{{enrichTransactionIDHeader, ctx.tx.ID()}}
+	if score := anomalyScore(ctx.tx, inboundAnomalyScoreVars); score != nil {
+		headers = append(headers, [2]string{enrichAnomalyScoreHeader, strconv.Itoa(*score)})
+	}
+	if ids := loggedRuleIDs(ctx.tx); len(ids) > 0 {
+		rules := make([]string, 0, len(ids))
+		for _, id := range ids {
+			rules = append(rules, strconv.Itoa(id))
+		}
+		headers = append(headers, [2]string{enrichMatchedRulesHeader, strings.Join(rules, ",")})
+	}
+
+	for _, h := range headers {
+		if err := proxywasm.ReplaceHttpRequestHeader(h[0], h[1]); err != nil {
+			ctx.logger.Error().Err(err).Str("header", h[0]).Msg("Failed to add enrichment header")
+		}
+	}
+}
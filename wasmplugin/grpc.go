@@ -0,0 +1,123 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/grpcbody"
+)
+
+// grpcStatusPermissionDenied is the PERMISSION_DENIED gRPC status code.
+// See https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const grpcStatusPermissionDenied int32 = 7
+
+// grpcInterruptionConfig configures the responses sent to the gRPC requests interrupted.
+type grpcInterruptionConfig struct {
+	status  int32
+	message string
+}
+
+func parseGRPCInterruption(value gjson.Result) (grpcInterruptionConfig, error) {
+	config := grpcInterruptionConfig{
+		status:  grpcStatusPermissionDenied,
+		message: value.Get("message").String(),
+	}
+	if status := value.Get("status"); status.Exists() {
+		config.status = int32(status.Int())
+	}
+	// 0 is OK, 16 is UNAUTHENTICATED, the last status code defined.
+	if config.status < 1 || config.status > 16 {
+		return config, errors.New("status must be an error gRPC status code, from 1 to 16")
+	}
+	return config, nil
+}
+
+// grpcBodyDecodingConfig configures the decoding of the gRPC request bodies into arguments.
+type grpcBodyDecodingConfig struct {
+	// descriptors describes the messages of the gRPC methods, nil if no descriptor set is
+	// configured, the fields being then named after their numbers.
+	descriptors *grpcbody.Descriptors
+}
+
+func parseGRPCBodyDecoding(value gjson.Result) (*grpcBodyDecodingConfig, error) {
+	config := &grpcBodyDecodingConfig{}
+	if descriptorSet := value.Get("descriptor_set"); descriptorSet.Exists() {
+		data, err := base64.StdEncoding.DecodeString(descriptorSet.String())
+		if err != nil {
+			return nil, fmt.Errorf("descriptor_set: %v", err)
+		}
+		if config.descriptors, err = grpcbody.ParseDescriptorSet(data); err != nil {
+			return nil, fmt.Errorf("descriptor_set: %v", err)
+		}
+	}
+	return config, nil
+}
+
+// isGRPCContentType tells whether the content type is the one of a gRPC request, e.g.
+// application/grpc or application/grpc+proto, or of a gRPC-Web request, e.g.
+// application/grpc-web+proto or application/grpc-web-text.
+func isGRPCContentType(contentType string) bool {
+	return hasMediaType(contentType, "application/grpc") ||
+		hasMediaType(contentType, "application/grpc-web") ||
+		hasMediaType(contentType, "application/grpc-web-text")
+}
+
+// isGRPCWebTextContentType tells whether the content type is the one of a gRPC-Web request
+// with a base64-encoded body.
+func isGRPCWebTextContentType(contentType string) bool {
+	return hasMediaType(contentType, "application/grpc-web-text")
+}
+
+// hasMediaType tells whether the content type is the given media type, possibly followed by a
+// message format (e.g. +proto) or parameters (e.g. ;charset=utf-8).
+func hasMediaType(contentType, mediaType string) bool {
+	rest, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(contentType)), mediaType)
+	return ok && (rest == "" || rest[0] == '+' || rest[0] == ';')
+}
+
+// sendInterruptionResponse sends the response of an interrupted transaction. gRPC requests
+// are answered with the configured gRPC status and message, which Envoy sends as a
+// trailers-only response (HTTP 200 with the grpc-status and grpc-message headers) so that
+// gRPC clients get a meaningful status instead of UNKNOWN.
+func (ctx *httpContext) sendInterruptionResponse(statusCode int) error {
+	if !ctx.grpcRequest {
+		return proxywasm.SendHttpResponse(uint32(statusCode), nil, nil, noGRPCStream)
+	}
+	return proxywasm.SendHttpResponse(uint32(statusCode), nil, []byte(ctx.grpcInterruption.message), ctx.grpcInterruption.status)
+}
+
+// decodeGRPCRequestBody decodes the messages of the buffered gRPC request body into the
+// ARGS_POST variables, the body itself being inspected as it is.
+func (ctx *httpContext) decodeGRPCRequestBody(bodySize int) {
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		ctx.logger.Error().Err(err).Int("body_size", bodySize).Msg("Failed to read gRPC request body")
+		return
+	}
+	ctx.decodeGRPCMessages(body)
+}
+
+// decodeGRPCMessages decodes the messages of a whole gRPC request body, once decompressed if
+// it has a Content-Encoding, into the ARGS_POST variables.
+func (ctx *httpContext) decodeGRPCMessages(body []byte) {
+	var err error
+	if ctx.grpcWebText {
+		if body, err = base64.StdEncoding.DecodeString(string(body)); err != nil {
+			ctx.logger.Debug().Err(err).Msg("Failed to decode gRPC-Web text request body")
+			return
+		}
+	}
+
+	err = ctx.grpcBodyDecoding.descriptors.Decode(ctx.grpcPath, body, ctx.tx.AddPostRequestArgument)
+	if err != nil {
+		ctx.logger.Debug().Err(err).Str("grpc_path", ctx.grpcPath).Msg("Failed to decode gRPC request body")
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import "strings"
+
+// normalizeHeaders returns the headers as an HTTP/1.1 message carries them, so that the rules
+// see the same REQUEST_HEADERS, RESPONSE_HEADERS and REQUEST_COOKIES whatever the protocol of the
+// client. The proxy exposes the HTTP/1.1 messages with HTTP/2 semantics (e.g. the request line as
+// pseudo-headers), hence:
+//   - the pseudo-headers are dropped, their values being already exposed by their own variables
+//     (REQUEST_METHOD, REQUEST_URI, RESPONSE_STATUS) or by the Host header for :authority;
+//   - the cookie crumbs HTTP/2 clients may split the Cookie header into are joined with "; ",
+//     see https://httpwg.org/specs/rfc9113.html#rfc.section.8.2.3.
+func normalizeHeaders(headers [][2]string) [][2]string {
+	normalized := make([][2]string, 0, len(headers))
+	cookieIndex := -1
+	for _, h := range headers {
+		if strings.HasPrefix(h[0], ":") {
+			continue
+		}
+		if strings.EqualFold(h[0], "cookie") {
+			if cookieIndex >= 0 {
+				normalized[cookieIndex][1] += "; " + h[1]
+				continue
+			}
+			cookieIndex = len(normalized)
+		}
+		normalized = append(normalized, h)
+	}
+	return normalized
+}
@@ -4,7 +4,9 @@
 package wasmplugin
 
 import (
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/corazawaf/coraza/v3/debuglog"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
@@ -48,3 +50,56 @@ func (l logger) WithOutput(_ io.Writer) debuglog.Logger {
 	proxywasm.LogWarn("Ignoring SecDebugLog directive, debug logs are always routed to proxy logs")
 	return l
 }
+
+// proxyLogLevel is the level of a message logged through the proxy logger.
+type proxyLogLevel int8
+
+const (
+	proxyLogLevelTrace proxyLogLevel = iota
+	proxyLogLevelDebug
+	proxyLogLevelInfo
+	proxyLogLevelWarn
+	proxyLogLevelError
+	proxyLogLevelCritical
+	// proxyLogLevelOff discards the messages.
+	proxyLogLevelOff
+)
+
+func parseProxyLogLevel(level string) (proxyLogLevel, error) {
+	switch strings.ToLower(level) {
+	case "trace":
+		return proxyLogLevelTrace, nil
+	case "debug":
+		return proxyLogLevelDebug, nil
+	case "info":
+		return proxyLogLevelInfo, nil
+	case "warn", "warning":
+		return proxyLogLevelWarn, nil
+	case "error":
+		return proxyLogLevelError, nil
+	case "critical":
+		return proxyLogLevelCritical, nil
+	case "off":
+		return proxyLogLevelOff, nil
+	default:
+		return proxyLogLevelOff, fmt.Errorf("unknown log level: %q", level)
+	}
+}
+
+func (l proxyLogLevel) log(msg string) {
+	switch l {
+	case proxyLogLevelTrace:
+		proxywasm.LogTrace(msg)
+	case proxyLogLevelDebug:
+		proxywasm.LogDebug(msg)
+	case proxyLogLevelInfo:
+		proxywasm.LogInfo(msg)
+	case proxyLogLevelWarn:
+		proxywasm.LogWarn(msg)
+	case proxyLogLevelError:
+		proxywasm.LogError(msg)
+	case proxyLogLevelCritical:
+		proxywasm.LogCritical(msg)
+	default:
+	}
+}
@@ -5,6 +5,7 @@ package wasmplugin
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
@@ -12,15 +13,21 @@ import (
 
 type wafMetrics struct {
 	counters map[string]proxywasm.MetricCounter
+	gauges   map[string]proxywasm.MetricGauge
 }
 
 func NewWAFMetrics() *wafMetrics {
 	return &wafMetrics{
 		counters: make(map[string]proxywasm.MetricCounter),
+		gauges:   make(map[string]proxywasm.MetricGauge),
 	}
 }
 
 func (m *wafMetrics) incrementCounter(fqn string) {
+	m.addToCounter(fqn, 1)
+}
+
+func (m *wafMetrics) addToCounter(fqn string, offset uint64) {
 	// TODO(jcchavezs): figure out if we are OK with dynamic creation of metrics
 	// or we generate the metrics on before hand.
 	counter, ok := m.counters[fqn]
@@ -28,7 +35,25 @@ func (m *wafMetrics) incrementCounter(fqn string) {
 		counter = proxywasm.DefineCounterMetric(fqn)
 		m.counters[fqn] = counter
 	}
-	counter.Increment(1)
+	counter.Increment(offset)
+}
+
+func (m *wafMetrics) gauge(fqn string) proxywasm.MetricGauge {
+	gauge, ok := m.gauges[fqn]
+	if !ok {
+		gauge = proxywasm.DefineGaugeMetric(fqn)
+		m.gauges[fqn] = gauge
+	}
+	return gauge
+}
+
+// setGauge sets the gauge to the given value. proxy-wasm only allows adding an
+// offset to a gauge, hence the offset is computed from the current value.
+func (m *wafMetrics) setGauge(fqn string, value int64) {
+	gauge := m.gauge(fqn)
+	if offset := value - gauge.Value(); offset != 0 {
+		gauge.Add(offset)
+	}
 }
 
 func (m *wafMetrics) CountTX() {
@@ -40,13 +65,135 @@ func (m *wafMetrics) CountTXInterruption(phase string, ruleID int, metricLabelsK
 	// This metric is processed as: waf_filter_tx_interruption{phase="http_request_body",rule_id="100",identifier="foo"}.
 	// The extraction rule is defined in envoy.yaml as a bootstrap configuration.
 	// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/metrics/v3/stats.proto#config-metrics-v3-statsconfig.
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("waf_filter.tx.interruptions_ruleid=%d_phase=%s", ruleID, phase))
+	fqn := withMetricLabels(fmt.Sprintf("waf_filter.tx.interruptions_ruleid=%d_phase=%s", ruleID, phase), metricLabelsKV)
+	m.incrementCounter(fqn)
+}
+
+func (m *wafMetrics) CountRequestBodyInspectedBytes(n int, metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_inspected_bytes{identifier="foo"}
+	if n <= 0 {
+		return
+	}
+	m.addToCounter(withMetricLabels("waf_filter.tx.request_body_inspected_bytes", metricLabelsKV), uint64(n))
+}
+
+func (m *wafMetrics) CountResponseBodyInspectedBytes(n int, metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_response_body_inspected_bytes{identifier="foo"}
+	if n <= 0 {
+		return
+	}
+	m.addToCounter(withMetricLabels("waf_filter.tx.response_body_inspected_bytes", metricLabelsKV), uint64(n))
+}
+
+func (m *wafMetrics) CountRequestBodyLimitReached(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_limit_reached{identifier="foo"}
+	m.incrementCounter(withMetricLabels("waf_filter.tx.request_body_limit_reached", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountResponseBodyLimitReached(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_response_body_limit_reached{identifier="foo"}
+	m.incrementCounter(withMetricLabels("waf_filter.tx.response_body_limit_reached", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountLateResponseBodyProcessing(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_response_body_late_processing{identifier="foo"}
+	// It counts transactions whose response body phase has been evaluated in OnHttpStreamDone,
+	// when triggered actions can not be enforced anymore.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.response_body_late_processing", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountLateRequestBodyInterruption(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_late_interruption{identifier="foo"}
+	// It counts streamed request bodies interrupted after chunks have been released upstream.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.request_body_late_interruption", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountUnenforcedRequestBodyInterruption(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_unenforced_interruption{identifier="foo"}
+	// It counts streamed request bodies interrupted once the response has started, when the
+	// interruption can not be enforced anymore.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.request_body_unenforced_interruption", metricLabelsKV))
+}
 
+func (m *wafMetrics) CountRequestBodyInspectedChunk(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_inspected_chunks{identifier="foo"}
+	// It counts the chunks of the streamed request bodies, the inspection of each chunk replaying
+	// the request headers phase.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.request_body_inspected_chunks", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountResponseBodyInspectedChunk(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_response_body_inspected_chunks{identifier="foo"}
+	// It counts the chunks of the streamed response bodies, the inspection of each chunk replaying
+	// the request and response headers phases.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.response_body_inspected_chunks", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountRequestBodyDecompressionError(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_request_body_decompression_error{identifier="foo"}
+	// It counts compressed request bodies that could not be fully decompressed, being corrupted or
+	// with an unsupported encoding.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.request_body_decompression_error", metricLabelsKV))
+}
+
+func (m *wafMetrics) CountResponseBodyDecompressionError(metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_response_body_decompression_error{identifier="foo"}
+	// It counts compressed response bodies that could not be fully decompressed, being corrupted or
+	// with an unsupported encoding.
+	m.incrementCounter(withMetricLabels("waf_filter.tx.response_body_decompression_error", metricLabelsKV))
+}
+
+func (m *wafMetrics) TXStarted() {
+	// This metric is processed as: waf_filter_tx_active
+	m.gauge("waf_filter.tx.active").Add(1)
+}
+
+func (m *wafMetrics) TXFinished() {
+	m.gauge("waf_filter.tx.active").Add(-1)
+}
+
+func (m *wafMetrics) SetLoadedWAFs(n int) {
+	// This metric is processed as: waf_filter_wafs_loaded
+	m.setGauge("waf_filter.wafs.loaded", int64(n))
+}
+
+// RecordMemStats reports the heap statistics of the runtime of this VM.
+func (m *wafMetrics) RecordMemStats(ms *runtime.MemStats) {
+	// These metrics are processed as: waf_filter_runtime_<stat>
+	m.setGauge("waf_filter.runtime.sys_bytes", int64(ms.Sys))
+	m.setGauge("waf_filter.runtime.heap_sys_bytes", int64(ms.HeapSys))
+	m.setGauge("waf_filter.runtime.heap_idle_bytes", int64(ms.HeapIdle))
+	m.setGauge("waf_filter.runtime.heap_inuse_bytes", int64(ms.HeapInuse))
+	m.setGauge("waf_filter.runtime.heap_released_bytes", int64(ms.HeapReleased))
+	m.setGauge("waf_filter.runtime.total_alloc_bytes", int64(ms.TotalAlloc))
+}
+
+func (m *wafMetrics) CountAuditLogsSent(n int) {
+	// This metric is processed as: waf_filter_audit_log_sent
+	m.addToCounter("waf_filter.audit_log.sent", uint64(n))
+}
+
+func (m *wafMetrics) CountAuditLogsDropped(reason string, n int) {
+	// This metric is processed as: waf_filter_audit_log_dropped{reason="queue_full"}
+	m.addToCounter(fmt.Sprintf("waf_filter.audit_log.dropped_reason=%s", reason), uint64(n))
+}
+
+func (m *wafMetrics) CountAuditLogsRetried(n int) {
+	// This metric is processed as: waf_filter_audit_log_retried
+	m.addToCounter("waf_filter.audit_log.retried", uint64(n))
+}
+
+// withMetricLabels appends the metric labels to the metric name so that they
+// can be extracted as tags by the proxy.
+func withMetricLabels(name string, metricLabelsKV []string) string {
+	if len(metricLabelsKV) == 0 {
+		return name
+	}
+
+	var sb strings.Builder
+	sb.WriteString(name)
 	for i := 0; i < len(metricLabelsKV); i += 2 {
 		sb.WriteString(fmt.Sprintf("_%s=%s", metricLabelsKV[i], metricLabelsKV[i+1]))
 	}
-
-	fqn := sb.String()
-	m.incrementCounter(fqn)
+	return sb.String()
 }
@@ -4,13 +4,13 @@
 package wasmplugin
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -19,6 +19,8 @@ import (
 	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
 )
 
 type vmContext struct {
@@ -81,6 +83,22 @@ type corazaPlugin struct {
 	perAuthorityWAFs wafMap
 	metricLabelsKV   []string
 	metrics          *wafMetrics
+	txLogContexts    txLogContexts
+	scheduler        tickScheduler
+	runtimeMetrics   *runtimeMetricsPublisher
+	debugTrace       *debugTraceConfig
+	clientIP         *clientIPConfig
+	tracedTXs        tracedTransactions
+	txIDSource       *transactionIDSource
+	envoyAttributes  []envoyAttribute
+	verdictProperty  string
+	// wafSettings holds the settings of the directives each WAF has been created from.
+	wafSettings               map[coraza.WAF]directivesSettings
+	responseBodyInterruption  *responseBodyInterruptionConfig
+	grpcInterruption          grpcInterruptionConfig
+	grpcBodyDecoding          *grpcBodyDecodingConfig
+	requestBodyDecompression  *bodyDecompressionConfig
+	responseBodyDecompression *bodyDecompressionConfig
 }
 
 func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
@@ -103,7 +121,68 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 		directivesAuthoritiesMap[directivesName] = append(directivesAuthoritiesMap[directivesName], authority)
 	}
 
+	ctx.metrics = NewWAFMetrics()
+	ctx.txLogContexts = txLogContexts{}
+	ctx.debugTrace = config.debugTrace
+	ctx.clientIP = config.clientIP
+	ctx.tracedTXs = tracedTransactions{}
+	ctx.txIDSource = config.transactionIDSource
+	ctx.envoyAttributes = config.envoyAttributes
+	ctx.verdictProperty = config.verdictProperty
+	ctx.responseBodyInterruption = config.responseBodyInterruption
+	ctx.grpcInterruption = config.grpcInterruption
+	ctx.grpcBodyDecoding = config.grpcBodyDecoding
+	ctx.requestBodyDecompression = config.requestBodyDecompression
+	ctx.responseBodyDecompression = config.responseBodyDecompression
+
+	auditlog.RegisterFormatters()
+	auditlog.SetRedactionPolicy(config.redaction)
+	auditlog.SetAttributesLookup(ctx.txLogContexts.attributes)
+	serialOptions := []auditlog.SerialOption{
+		auditlog.WithPrefix(config.auditLogSerial.prefix),
+		auditlog.WithLogFunc(config.auditLogSerial.logLevel.log),
+		auditlog.WithMaxLineSize(config.auditLogSerial.maxLineSize),
+	}
+	auditlog.RegisterProxyWasmSerialWriter(serialOptions...)
+
+	// The writers are registered even if not configured, so that their usage fails explicitly.
+	auditLogHTTPCollector := ctx.newAuditLogCollector(config.auditLogHTTP, auditlog.NewHTTPCollector)
+	auditlog.RegisterHTTPWriter(auditLogHTTPCollector)
+	auditLogGRPCCollector := ctx.newAuditLogCollector(config.auditLogGRPC, auditlog.NewGRPCCollector)
+	auditlog.RegisterGRPCWriter(auditLogGRPCCollector)
+
+	var auditLogSharedQueue *auditlog.SharedQueue
+	if config.auditLogSharedQueue != nil {
+		auditLogSharedQueue = auditlog.NewSharedQueue(config.auditLogSharedQueue.vmID, config.auditLogSharedQueue.name, ctx.metrics)
+	}
+	auditlog.RegisterSharedQueueWriter(auditLogSharedQueue)
+
+	if config.auditLogAggregator != nil {
+		// The log sink prints the entries as configured by audit_log_serial.
+		var sink auditlog.Sink = auditlog.NewLogSink(serialOptions...)
+		switch config.auditLogAggregator.sink {
+		case auditLogSinkHTTP:
+			sink = auditLogHTTPCollector
+		case auditLogSinkGRPC:
+			sink = auditLogGRPCCollector
+		}
+		aggregator, err := auditlog.NewSharedQueueAggregator(config.auditLogAggregator.queueName, config.auditLogAggregator.maxDrain, sink)
+		if err != nil {
+			proxywasm.LogCriticalf("Failed to register the audit log shared queue: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+		ctx.scheduler.schedule(config.auditLogAggregator.drainPeriod, aggregator.Drain)
+	}
+
+	var ruleLogLimiter *ruleLogLimiter
+	if config.ruleLogRateLimit != nil {
+		ruleLogLimiter = newRuleLogLimiter(*config.ruleLogRateLimit)
+		ctx.scheduler.schedule(config.ruleLogRateLimit.summaryPeriod, ruleLogLimiter.logSuppressed)
+	}
+
 	perAuthorityWAFs := newWAFMap(len(config.directivesMap))
+	ctx.wafSettings = make(map[coraza.WAF]directivesSettings, len(config.directivesSettings))
+	loadedWAFs := 0
 	for name, directives := range config.directivesMap {
 		var authorities []string
 
@@ -122,10 +201,18 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 			}
 		}
 
+		debugLogger := debuglog.DefaultWithPrinterFactory(logPrinterFactory)
+		if config.debugTrace != nil {
+			debugLogger = newTraceableLogger(debugLogger, config.debugTrace.level, ctx.tracedTXs)
+		}
+
+		ruleLogger := newRuleLogger(name, config.ruleLogFormat, config.directivesSettings[name].ruleLogLevels,
+			ruleLogLimiter, config.redaction, ctx.txLogContexts)
+
 		// First we initialize our waf and our seclang parser
 		conf := coraza.NewWAFConfig().
-			WithErrorCallback(logError).
-			WithDebugLogger(debuglog.DefaultWithPrinterFactory(logPrinterFactory)).
+			WithErrorCallback(ruleLogger.logMatchedRule).
+			WithDebugLogger(debugLogger).
 			// TODO(anuraaga): Make this configurable in plugin configuration.
 			// WithRequestBodyLimit(1024 * 1024 * 1024).
 			// WithRequestBodyInMemoryLimit(1024 * 1024 * 1024).
@@ -133,11 +220,26 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 			// buffering request body to files anyways.
 			WithRootFS(root)
 
-		waf, err := coraza.NewWAF(conf.WithDirectives(strings.Join(directives, "\n")))
+		joinedDirectives := strings.Join(directives, "\n")
+		waf, err := coraza.NewWAF(conf.WithDirectives(joinedDirectives))
 		if err != nil {
 			proxywasm.LogCriticalf("Failed to parse directives: %v", err)
 			return types.OnPluginStartStatusFailed
 		}
+		loadedWAFs++
+		settings, ok := config.directivesSettings[name]
+		if config.requestBodyDecompression != nil || config.responseBodyDecompression != nil {
+			// The decompression limits are handled as the body limits.
+			settings.bodyLimitActions = readBodyLimitActions(joinedDirectives, root)
+			ok = true
+		}
+		if ok {
+			ctx.wafSettings[waf] = settings
+			if settings.requestBodyStreaming != nil {
+				proxywasm.LogWarnf("Streamed request bodies of directives %q are inspected as raw data, only the urlencoded ones populating ARGS_POST: "+
+					"multipart, JSON and XML bodies do not populate ARGS_POST, FILES nor the parsed REQUEST_BODY", name)
+			}
+		}
 
 		if len(authorities) == 0 {
 			// if no authorities are associated directly with this WAF
@@ -171,17 +273,65 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 	for k, v := range config.metricLabels {
 		ctx.metricLabelsKV = append(ctx.metricLabelsKV, k, v)
 	}
-	ctx.metrics = NewWAFMetrics()
+	ctx.metrics.SetLoadedWAFs(loadedWAFs)
+
+	ctx.runtimeMetrics = newRuntimeMetricsPublisher(config.runtimeMetricsPeriod)
+	ctx.recordRuntimeMetrics()
+	ctx.scheduler.schedule(config.runtimeMetricsPeriod, ctx.recordRuntimeMetrics)
+	if tickPeriod := ctx.scheduler.tickPeriod(); tickPeriod > 0 {
+		if err := proxywasm.SetTickPeriodMilliSeconds(uint32(tickPeriod.Milliseconds())); err != nil {
+			proxywasm.LogCriticalf("Failed to set tick period: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+	}
 
 	return types.OnPluginStartStatusOK
 }
 
+func (ctx *corazaPlugin) OnTick() {
+	ctx.scheduler.tick()
+}
+
+// newAuditLogCollector creates an audit log collector flushed periodically, nil if not configured.
+func (ctx *corazaPlugin) newAuditLogCollector(cfg *auditLogCollectorConfig,
+	newCollector func(auditlog.CollectorConfig, auditlog.Metrics) *auditlog.Collector) *auditlog.Collector {
+	if cfg == nil {
+		return nil
+	}
+	collector := newCollector(cfg.collector, ctx.metrics)
+	ctx.scheduler.schedule(cfg.flushInterval, collector.Flush)
+	return collector
+}
+
+// recordRuntimeMetrics refreshes the gauges about the runtime of this VM, if elected to publish them.
+func (ctx *corazaPlugin) recordRuntimeMetrics() {
+	if !ctx.runtimeMetrics.elected() {
+		return
+	}
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	ctx.metrics.RecordMemStats(&ms)
+}
+
 func (ctx *corazaPlugin) NewHttpContext(contextID uint32) types.HttpContext {
 	return &httpContext{
-		contextID:        contextID,
-		metrics:          ctx.metrics,
-		metricLabelsKV:   ctx.metricLabelsKV,
-		perAuthorityWAFs: ctx.perAuthorityWAFs,
+		contextID:                 contextID,
+		metrics:                   ctx.metrics,
+		metricLabelsKV:            ctx.metricLabelsKV,
+		perAuthorityWAFs:          ctx.perAuthorityWAFs,
+		txLogContexts:             ctx.txLogContexts,
+		debugTrace:                ctx.debugTrace,
+		clientIP:                  ctx.clientIP,
+		tracedTXs:                 ctx.tracedTXs,
+		txIDSource:                ctx.txIDSource,
+		envoyAttributes:           ctx.envoyAttributes,
+		verdictProperty:           ctx.verdictProperty,
+		wafSettings:               ctx.wafSettings,
+		responseBodyInterruption:  ctx.responseBodyInterruption,
+		grpcInterruption:          ctx.grpcInterruption,
+		grpcBodyDecoding:          ctx.grpcBodyDecoding,
+		requestBodyDecompression:  ctx.requestBodyDecompression,
+		responseBodyDecompression: ctx.responseBodyDecompression,
 	}
 }
 
@@ -229,6 +379,54 @@ type httpContext struct {
 	interruptedAt         interruptionPhase
 	logger                debuglog.Logger
 	metricLabelsKV        []string
+	txLogContexts         txLogContexts
+	debugTrace            *debugTraceConfig
+	tracedTXs             tracedTransactions
+	txIDSource            *transactionIDSource
+	envoyAttributes       []envoyAttribute
+	verdictProperty       string
+	wafSettings           map[coraza.WAF]directivesSettings
+	waf                   coraza.WAF
+	settings              directivesSettings
+	enrichRequest         bool
+	// responseBodyInterruption handles the interruptions at the response body phase.
+	responseBodyInterruption *responseBodyInterruptionConfig
+	// clientIP resolves the client address from the forwarding header, if set.
+	clientIP       *clientIPConfig
+	sourceResolved bool
+	sourceIP       string
+	sourcePort     int
+	// peerAddress is the address of the immediate peer, set if it is not the client.
+	peerAddress string
+	// grpcInterruption configures the responses to the interrupted gRPC requests.
+	grpcInterruption grpcInterruptionConfig
+	// grpcRequest tells whether the request is a gRPC one, based on its content type.
+	grpcRequest bool
+	grpcWebText bool
+	// grpcBodyDecoding decodes the gRPC request bodies into arguments, if set.
+	grpcBodyDecoding *grpcBodyDecodingConfig
+	grpcPath         string
+	// grpcRequestBody accumulates the decompressed gRPC request body to be decoded.
+	grpcRequestBody []byte
+	// requestBodyDecompression decompresses the request bodies before their inspection, if set.
+	requestBodyDecompression *bodyDecompressionConfig
+	requestContentEncoding   string
+	requestDecompressor      *bodyDecompressor
+	// responseBodyDecompression decompresses the response bodies before their inspection, if set.
+	responseBodyDecompression *bodyDecompressionConfig
+	responseContentEncoding   string
+	responseDecompressor      *bodyDecompressor
+	responseHeadersHeld       bool
+	// responseBodySize is the size of the response body buffered by the proxy.
+	responseBodySize int
+	// The request and the response status and headers are kept to inspect the body chunks when streaming.
+	inspectionRequest inspectionRequest
+	requestChunks     chunkInspection
+	requestArgs       urlencodedArgs
+	responseStarted   bool
+	responseStatus    int
+	responseHeaders   [][2]string
+	responseChunks    chunkInspection
 }
 
 func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
@@ -247,13 +445,28 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		authority = string(propHostRaw)
 	}
 	if waf, isDefault, resolveWAFErr := ctx.perAuthorityWAFs.getWAFOrDefault(authority); resolveWAFErr == nil {
-		ctx.tx = waf.NewTransaction()
+		ctx.tx = ctx.newTransaction(waf)
+		ctx.waf = waf
+		ctx.settings = ctx.wafSettings[waf]
+		ctx.metrics.TXStarted()
+		if ctx.debugTrace != nil {
+			ctx.checkDebugTrace()
+		}
+		if ctx.settings.enrichRequest {
+			ctx.enrichRequest = true
+			ctx.removeEnrichmentHeaders()
+		}
 
 		logFields := []debuglog.ContextField{debuglog.Uint("context_id", uint(ctx.contextID))}
 		if !isDefault {
 			logFields = append(logFields, debuglog.Str("authority", authority))
 		}
+		attributes := ctx.collectEnvoyAttributes(nil)
+		for _, attr := range attributes {
+			logFields = append(logFields, debuglog.Str(attr.Name, attr.Value))
+		}
 		ctx.logger = ctx.tx.DebugLogger().With(logFields...)
+		ctx.txLogContexts[ctx.tx.ID()] = txLogContext{authority: authority, fields: logFields, attributes: attributes}
 
 		// CRS rules tend to expect Host even with HTTP/2
 		ctx.tx.AddRequestHeader("Host", authority)
@@ -277,10 +490,13 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 	}
 
 	// OnHttpRequestHeaders does not terminate if IP/Port retrieve goes wrong
-	srcIP, srcPort := retrieveAddressInfo(ctx.logger, "source")
+	srcIP, srcPort := ctx.sourceAddress(ctx.logger)
 	dstIP, dstPort := retrieveAddressInfo(ctx.logger, "destination")
 
 	tx.ProcessConnection(srcIP, srcPort, dstIP, dstPort)
+	if ctx.peerAddress != "" {
+		ctx.addPeerAddress()
+	}
 
 	method, err := proxywasm.GetHttpRequestHeader(":method")
 	if err != nil {
@@ -336,9 +552,25 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		ctx.logger.Error().Err(err).Msg("Failed to get request headers")
 		return types.ActionContinue
 	}
+	hs = normalizeHeaders(hs)
 
 	for _, h := range hs {
 		tx.AddRequestHeader(h[0], h[1])
+		if strings.EqualFold(h[0], "content-type") && isGRPCContentType(h[1]) {
+			ctx.grpcRequest = true
+			ctx.grpcWebText = isGRPCWebTextContentType(h[1])
+			ctx.grpcPath = uri
+		}
+		if strings.EqualFold(h[0], "content-encoding") && ctx.requestBodyDecompression != nil && isCompressed(h[1]) {
+			ctx.requestContentEncoding = h[1]
+		}
+	}
+	if ctx.settings.streaming() {
+		ctx.inspectionRequest = inspectionRequest{
+			uri:     uri,
+			method:  method,
+			headers: append([][2]string{{"Host", authority}}, hs...),
+		}
 	}
 
 	interruption := tx.ProcessRequestHeaders()
@@ -346,6 +578,15 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, interruption)
 	}
 
+	ctx.publishVerdict()
+	if ctx.enrichRequest {
+		if !endOfStream && ctx.settings.requestBodyStreaming == nil {
+			// The headers are held until the request body has been inspected, so that the
+			// enrichment headers account for the phase 2 rules.
+			return types.ActionPause
+		}
+		ctx.addEnrichmentHeaders()
+	}
 	return types.ActionContinue
 }
 
@@ -359,7 +600,9 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 		return types.ActionPause
 	}
 
-	if ctx.processedRequestBody {
+	// When streaming, the chunks received once the request body phase has been evaluated (e.g. the
+	// response has started) are still inspected.
+	if ctx.processedRequestBody && (ctx.settings.requestBodyStreaming == nil || !ctx.tx.IsRequestBodyAccessible()) {
 		return types.ActionContinue
 	}
 
@@ -388,9 +631,18 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
 		}
 
+		ctx.addEnrichmentHeaders()
 		return types.ActionContinue
 	}
 
+	if ctx.settings.requestBodyStreaming != nil {
+		return ctx.streamRequestBody(bodySize, endOfStream)
+	}
+
+	if ctx.requestContentEncoding != "" {
+		return ctx.inspectCompressedRequestBody(bodySize, endOfStream)
+	}
+
 	// bodySize is the size of the whole body received so far, not the size of the current chunk
 	chunkSize := bodySize - ctx.bodyReadIndex
 	// OnHttpRequestBody might be called more than once with the same data, we check if there is new data available to be read
@@ -413,6 +665,7 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 			ctx.logger.Error().Err(err).Msg("Failed to write request body")
 			return types.ActionContinue
 		}
+		ctx.metrics.CountRequestBodyInspectedBytes(writtenBytes, ctx.metricLabelsKV)
 		if interruption != nil {
 			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
 		}
@@ -420,9 +673,11 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 		// If not the whole chunk has been written, it implicitly means that we reached the waf request body limit.
 		// Internally ProcessRequestBody has been called and it did not raise any interruption (just checked in the condition above).
 		if writtenBytes < readchunkSize {
+			ctx.metrics.CountRequestBodyLimitReached(ctx.metricLabelsKV)
 			// No further body data will be processed
 			// Setting processedRequestBody avoid to call more than once ProcessRequestBody
 			ctx.processedRequestBody = true
+			ctx.addEnrichmentHeaders()
 			return types.ActionContinue
 		}
 
@@ -430,23 +685,33 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 	}
 
 	if endOfStream {
-		ctx.processedRequestBody = true
-		ctx.bodyReadIndex = 0 // cleaning for further usage
-		interruption, err := tx.ProcessRequestBody()
-		if err != nil {
-			ctx.logger.Error().
-				Err(err).
-				Msg("Failed to process request body")
-			return types.ActionContinue
-		}
-		if interruption != nil {
-			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+		if ctx.grpcRequest && ctx.grpcBodyDecoding != nil {
+			ctx.decodeGRPCRequestBody(ctx.bodyReadIndex)
 		}
+		ctx.bodyReadIndex = 0 // cleaning for further usage
+		return ctx.processRequestBody()
+	}
+
+	return types.ActionPause
+}
 
+// processRequestBody evaluates the request body phase once the whole body has been written.
+func (ctx *httpContext) processRequestBody() types.Action {
+	ctx.processedRequestBody = true
+	interruption, err := ctx.tx.ProcessRequestBody()
+	if err != nil {
+		ctx.logger.Error().
+			Err(err).
+			Msg("Failed to process request body")
 		return types.ActionContinue
 	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+	}
 
-	return types.ActionPause
+	ctx.publishVerdict()
+	ctx.addEnrichmentHeaders()
+	return types.ActionContinue
 }
 
 func (ctx *httpContext) OnHttpRequestTrailers(numTrailers int) types.Action {
@@ -455,12 +720,16 @@ func (ctx *httpContext) OnHttpRequestTrailers(numTrailers int) types.Action {
 	// Ref: https://github.com/envoyproxy/envoy/blob/121a541dd3fadef7131963f23e42a41e0c93e102/envoy/http/filter.h#L913
 	// We therefore need to enforce phase 2 rules execution here, in order to avoid sending the request body upstream
 	// prior to being inspected.
+	if ctx.tx != nil && !ctx.tx.IsRuleEngineOff() && !ctx.interruptedAt.isInterrupted() {
+		ctx.addRequestTrailers()
+	}
 	ctx.logger.Debug().Msg("Enforced request body processing at OnHttpRequestTrailers")
 	return ctx.OnHttpRequestBody(ctx.bodyReadIndex, true)
 }
 
 func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
 	defer logTime("OnHttpResponseHeaders", currentTime())
+	ctx.responseStarted = true
 
 	if ctx.interruptedAt.isInterrupted() {
 		// Handling the interruption (see handleInterruption) generates a HttpResponse with the required interruption status code.
@@ -525,9 +794,13 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 			Msg("Failed to get response headers")
 		return types.ActionContinue
 	}
+	hs = normalizeHeaders(hs)
 
 	for _, h := range hs {
 		tx.AddResponseHeader(h[0], h[1])
+		if strings.EqualFold(h[0], "content-encoding") && ctx.responseBodyDecompression != nil && isCompressed(h[1]) {
+			ctx.responseContentEncoding = h[1]
+		}
 	}
 
 	interruption := tx.ProcessResponseHeaders(code, ctx.httpProtocol)
@@ -535,23 +808,38 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 		return ctx.handleInterruption(interruptionPhaseHttpResponseHeaders, interruption)
 	}
 
+	if ctx.settings.responseBodyStreaming != nil {
+		ctx.responseStatus = code
+		ctx.responseHeaders = hs
+		return types.ActionContinue
+	}
+
+	if !endOfStream && ctx.responseBodyInterruption.holdsResponseHeaders() &&
+		tx.IsResponseBodyAccessible() && tx.IsResponseBodyProcessable() {
+		// The headers are held until the response body has been inspected, so that they can
+		// still be changed if the response is interrupted at the response body phase.
+		ctx.responseHeadersHeld = true
+		return types.ActionPause
+	}
+
 	return types.ActionContinue
 }
 
 func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
 	defer logTime("OnHttpResponseBody", currentTime())
+	ctx.responseBodySize = bodySize
 
 	if ctx.interruptedAt.isInterrupted() {
-		// At response body phase, proxy-wasm currently relies on emptying the response body as a way of
-		// interruption the response. See https://github.com/corazawaf/coraza-proxy-wasm/issues/26.
-		// If OnHttpResponseBody is called again and an interruption has already been raised, it means that
-		// we have to keep going with the sanitization of the response, emptying it.
-		// Sending the crafted HttpResponse with empty body, we don't expect to trigger OnHttpResponseBody
+		// If OnHttpResponseBody is called again and an interruption has already been raised, the response
+		// body has already been handled (see interruptResponseBody). The data received afterwards is dropped,
+		// or replaced with null bytes if no strategy is configured.
 		ctx.logger.Debug().
 			Str("interruption_handled_phase", ctx.interruptedAt.String()).
-			Msg("Response body interruption already handled, keeping replacing the body")
-		// Interruption happened, we don't want to send response body data
-		return replaceResponseBodyWhenInterrupted(ctx.logger, bodySize)
+			Msg("Response body interruption already handled, dropping the body")
+		if ctx.responseBodyInterruption == nil && ctx.settings.responseBodyStreaming == nil {
+			return ctx.nullifyResponseBody()
+		}
+		return ctx.dropResponseBody()
 	}
 
 	if ctx.processedResponseBody {
@@ -582,15 +870,22 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 			}
 			ctx.processedResponseBody = true
 			if interruption != nil {
-				// Proxy-wasm can not anymore deny the response. The best interruption is emptying the body
+				// The response headers may have already been sent, see interruptResponseBody.
 				// Coraza Multiphase evaluation will help here avoiding late interruptions
-				ctx.bodyReadIndex = bodySize // hacky: bodyReadIndex stores the body size that has to be replaced
 				return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
 			}
 		}
 		return types.ActionContinue
 	}
 
+	if ctx.settings.responseBodyStreaming != nil {
+		return ctx.streamResponseBody(bodySize, endOfStream)
+	}
+
+	if ctx.responseContentEncoding != "" {
+		return ctx.inspectCompressedResponseBody(bodySize, endOfStream)
+	}
+
 	chunkSize := bodySize - ctx.bodyReadIndex
 	if chunkSize > 0 {
 		bodyChunk, err := proxywasm.GetHttpResponseBody(ctx.bodyReadIndex, chunkSize)
@@ -613,8 +908,7 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 			ctx.logger.Error().Err(err).Msg("Failed to write response body")
 			return types.ActionContinue
 		}
-		// bodyReadIndex has to be updated before evaluating the interruption
-		// it is internally needed to replace the full body if the transaction is interrupted
+		ctx.metrics.CountResponseBodyInspectedBytes(writtenBytes, ctx.metricLabelsKV)
 		ctx.bodyReadIndex += readchunkSize
 		if interruption != nil {
 			return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
@@ -622,6 +916,7 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 		// If not the whole chunk has been written, it implicitly means that we reached the waf response body limit,
 		// internally ProcessResponseBody has been called and it did not raise any interruption (just checked in the condition above).
 		if writtenBytes < readchunkSize {
+			ctx.metrics.CountResponseBodyLimitReached(ctx.metricLabelsKV)
 			// no further body data will be processed
 			ctx.processedResponseBody = true
 			return types.ActionContinue
@@ -629,29 +924,36 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 	}
 
 	if endOfStream {
-		// We have already sent response headers, an unauthorized response can not be sent anymore,
-		// but we can still drop the response body to prevent leaking sensitive content.
-		// The error will also be logged by Coraza.
-		ctx.processedResponseBody = true
-		interruption, err := tx.ProcessResponseBody()
-		if err != nil {
-			ctx.logger.Error().
-				Err(err).
-				Msg("Failed to process response body")
-			return types.ActionContinue
-		}
-		if interruption != nil {
-			return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
-		}
-		return types.ActionContinue
+		// The body has been buffered, so that it is not leaked downstream if the response is interrupted.
+		return ctx.processResponseBody()
 	}
 	// Wait until we see the entire body. It has to be buffered in order to check that it is fully legit
 	// before sending it downstream (to the client)
 	return types.ActionPause
 }
 
+// processResponseBody evaluates the response body phase once the whole body has been written.
+func (ctx *httpContext) processResponseBody() types.Action {
+	ctx.processedResponseBody = true
+	interruption, err := ctx.tx.ProcessResponseBody()
+	if err != nil {
+		// The error will also be logged by Coraza.
+		ctx.logger.Error().
+			Err(err).
+			Msg("Failed to process response body")
+		return types.ActionContinue
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+	}
+	return types.ActionContinue
+}
+
 func (ctx *httpContext) OnHttpResponseTrailers(numTrailers int) types.Action {
 	defer logTime("OnHttpResponseTrailers", currentTime())
+	if ctx.tx != nil && !ctx.tx.IsRuleEngineOff() && !ctx.interruptedAt.isInterrupted() {
+		ctx.addResponseTrailers()
+	}
 	ctx.logger.Debug().Msg("Enforced response body processing at OnHttpResponseTrailers")
 	return ctx.OnHttpResponseBody(ctx.bodyReadIndex, true)
 }
@@ -667,6 +969,7 @@ func (ctx *httpContext) OnHttpStreamDone() {
 			// interruption, now is the time.
 			if !ctx.processedResponseBody {
 				ctx.logger.Info().Msg("Running ProcessResponseBody in OnHttpStreamDone, triggered actions will not be enforced. Further logs are for detection only purposes")
+				ctx.metrics.CountLateResponseBodyProcessing(ctx.metricLabelsKV)
 				ctx.processedResponseBody = true
 				_, err := tx.ProcessResponseBody()
 				if err != nil {
@@ -677,19 +980,151 @@ func (ctx *httpContext) OnHttpStreamDone() {
 			}
 		}
 
+		// Attributes such as the upstream host are only available once the request has been routed.
+		ctx.completeEnvoyAttributes()
+
 		// ProcessLogging is still called even if RuleEngine is off for potential logs generated before the engine is turned off.
 		// Internally, if the engine is off, no log phase rules are evaluated
 		ctx.tx.ProcessLogging()
+		ctx.publishVerdict()
 
 		err := ctx.tx.Close()
 		if err != nil {
 			ctx.logger.Error().Err(err).Msg("Failed to close transaction")
 		}
+		ctx.metrics.TXFinished()
+		delete(ctx.txLogContexts, ctx.tx.ID())
+		delete(ctx.tracedTXs, ctx.tx.ID())
 		ctx.logger.Info().Msg("Finished")
 		logMemStats()
 	}
 }
 
+// newTransaction creates a transaction identified by the ID provided by the proxy, if configured
+// and available, so that the logs of the WAF can be correlated with the ones of the proxy.
+// Otherwise, the ID is generated by Coraza.
+func (ctx *httpContext) newTransaction(waf coraza.WAF) ctypes.Transaction {
+	if ctx.txIDSource == nil {
+		return waf.NewTransaction()
+	}
+
+	var id string
+	if ctx.txIDSource.header != "" {
+		id, _ = proxywasm.GetHttpRequestHeader(ctx.txIDSource.header)
+	} else if raw, err := proxywasm.GetProperty(ctx.txIDSource.property); err == nil {
+		id = string(raw)
+	}
+
+	if id == "" {
+		proxywasm.LogDebug("Transaction ID not provided by the proxy, generating one")
+		return waf.NewTransaction()
+	}
+
+	// The ID might be provided by the client: it ends up verbatim in the logs, it must be a
+	// reasonable token and must not collide with an in-flight transaction.
+	if !isValidTransactionID(id) {
+		proxywasm.LogWarnf("Invalid transaction ID of %d bytes, generating one", len(id))
+		return waf.NewTransaction()
+	}
+	if _, ok := ctx.txLogContexts[id]; ok {
+		proxywasm.LogWarnf("Transaction ID %q already in use, generating one", id)
+		return waf.NewTransaction()
+	}
+
+	return waf.NewTransactionWithID(id)
+}
+
+// maxTransactionIDLength is the maximum length of the transaction IDs provided by the proxy.
+const maxTransactionIDLength = 128
+
+// isValidTransactionID tells whether a transaction ID provided by the proxy is made of at most
+// maxTransactionIDLength letters, digits, dots, underscores, colons and dashes.
+func isValidTransactionID(id string) bool {
+	if len(id) > maxTransactionIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '.' || c == '_' || c == ':' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// collectEnvoyAttributes returns the configured proxy attributes available so far, skipping
+// the ones already collected.
+func (ctx *httpContext) collectEnvoyAttributes(collected []auditlog.Attribute) []auditlog.Attribute {
+	var attributes []auditlog.Attribute
+	for _, attr := range ctx.envoyAttributes {
+		if hasAttribute(collected, attr.name) {
+			continue
+		}
+		value, err := proxywasm.GetProperty(attr.path)
+		if err != nil || len(value) == 0 {
+			continue
+		}
+		attributes = append(attributes, auditlog.Attribute{Name: attr.name, Value: string(value)})
+	}
+	return attributes
+}
+
+// completeEnvoyAttributes collects the proxy attributes not available when the request headers
+// were processed, adding them to the log context of the transaction.
+func (ctx *httpContext) completeEnvoyAttributes() {
+	txCtx, ok := ctx.txLogContexts[ctx.tx.ID()]
+	if !ok || len(txCtx.attributes) == len(ctx.envoyAttributes) {
+		return
+	}
+
+	attributes := ctx.collectEnvoyAttributes(txCtx.attributes)
+	if len(attributes) == 0 {
+		return
+	}
+
+	fields := make([]debuglog.ContextField, 0, len(attributes))
+	for _, attr := range attributes {
+		fields = append(fields, debuglog.Str(attr.Name, attr.Value))
+	}
+	txCtx.attributes = append(txCtx.attributes, attributes...)
+	txCtx.fields = append(txCtx.fields, fields...)
+	ctx.txLogContexts[ctx.tx.ID()] = txCtx
+	ctx.logger = ctx.logger.With(fields...)
+}
+
+func hasAttribute(attributes []auditlog.Attribute, name string) bool {
+	for _, attr := range attributes {
+		if attr.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDebugTrace enables the debug tracing of the transaction if the request carries the
+// configured trigger.
+func (ctx *httpContext) checkDebugTrace() {
+	value, err := proxywasm.GetHttpRequestHeader(ctx.debugTrace.header)
+	if err != nil {
+		return
+	}
+
+	// The trigger header might carry the secret, hence it is neither inspected nor sent upstream.
+	if err := proxywasm.RemoveHttpRequestHeader(ctx.debugTrace.header); err != nil {
+		proxywasm.LogWarnf("Failed to remove the debug trace header: %v", err)
+	}
+
+	var sourceIP string
+	if len(ctx.debugTrace.sourceCIDRs) > 0 {
+		sourceIP, _ = ctx.sourceAddress(debuglog.Noop())
+	}
+
+	if ctx.debugTrace.isTriggered(value, sourceIP) {
+		ctx.tracedTXs[ctx.tx.ID()] = struct{}{}
+	}
+}
+
 const noGRPCStream int32 = -1
 const defaultInterruptionStatusCode int = 403
 
@@ -707,15 +1142,16 @@ func (ctx *httpContext) handleInterruption(phase interruptionPhase, interruption
 		Msg("Transaction interrupted")
 
 	ctx.interruptedAt = phase
-	if phase == interruptionPhaseHttpResponseBody {
-		return replaceResponseBodyWhenInterrupted(ctx.logger, ctx.bodyReadIndex)
-	}
+	ctx.publishVerdict()
 
 	statusCode := interruption.Status
 	if statusCode == 0 {
 		statusCode = defaultInterruptionStatusCode
 	}
-	if err := proxywasm.SendHttpResponse(uint32(statusCode), nil, nil, noGRPCStream); err != nil {
+	if phase == interruptionPhaseHttpResponseBody {
+		return ctx.interruptResponseBody(statusCode)
+	}
+	if err := ctx.sendInterruptionResponse(statusCode); err != nil {
 		panic(err)
 	}
 
@@ -723,28 +1159,6 @@ func (ctx *httpContext) handleInterruption(phase interruptionPhase, interruption
 	return types.ActionPause
 }
 
-func logError(error ctypes.MatchedRule) {
-	msg := error.ErrorLog()
-	switch error.Rule().Severity() {
-	case ctypes.RuleSeverityEmergency:
-		proxywasm.LogCritical(msg)
-	case ctypes.RuleSeverityAlert:
-		proxywasm.LogCritical(msg)
-	case ctypes.RuleSeverityCritical:
-		proxywasm.LogCritical(msg)
-	case ctypes.RuleSeverityError:
-		proxywasm.LogError(msg)
-	case ctypes.RuleSeverityWarning:
-		proxywasm.LogWarn(msg)
-	case ctypes.RuleSeverityNotice:
-		proxywasm.LogInfo(msg)
-	case ctypes.RuleSeverityInfo:
-		proxywasm.LogInfo(msg)
-	case ctypes.RuleSeverityDebug:
-		proxywasm.LogDebug(msg)
-	}
-}
-
 // retrieveAddressInfo retrieves address properties from the proxy
 // Expected targets are "source" or "destination"
 // Envoy ref: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/advanced/attributes#connection-attributes
@@ -802,21 +1216,6 @@ func parsePort(b []byte) (int, error) {
 	return int(unsignedInt), nil
 }
 
-// replaceResponseBodyWhenInterrupted address an interruption raised during phase 4.
-// At this phase, response headers are already sent downstream, therefore an interruption
-// can not change anymore the status code, but only tweak the response body
-func replaceResponseBodyWhenInterrupted(logger debuglog.Logger, bodySize int) types.Action {
-	// TODO(M4tteoP): Update response body interruption logic after https://github.com/corazawaf/coraza-proxy-wasm/issues/26
-	// Currently returns a body filled with null bytes that replaces the sensitive data potentially leaked
-	err := proxywasm.ReplaceHttpResponseBody(bytes.Repeat([]byte("\x00"), bodySize))
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to replace response body")
-		return types.ActionContinue
-	}
-	logger.Warn().Msg("Response body intervention occurred: body replaced")
-	return types.ActionContinue
-}
-
 // parseServerName parses :authority pseudo-header in order to retrieve the
 // virtual host.
 func parseServerName(logger debuglog.Logger, authority string) string {
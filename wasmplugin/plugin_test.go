@@ -4,7 +4,9 @@
 package wasmplugin
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/corazawaf/coraza/v3/debuglog"
 	"github.com/stretchr/testify/assert"
@@ -72,3 +74,189 @@ func TestRetrieveAddressInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleLogLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRuleLogLimiter(ruleLogRateLimitConfig{
+		perRule:     &tokenBucketConfig{rate: 1, burst: 2},
+		perClientIP: &tokenBucketConfig{rate: 1, burst: 3},
+	})
+	limiter.now = func() time.Time { return now }
+
+	require.True(t, limiter.allow(1, "10.0.0.1"))
+	require.True(t, limiter.allow(1, "10.0.0.1"))
+	// per rule bucket exhausted
+	require.False(t, limiter.allow(1, "10.0.0.1"))
+	require.True(t, limiter.allow(2, "10.0.0.1"))
+	// per client IP bucket exhausted
+	require.False(t, limiter.allow(3, "10.0.0.1"))
+	require.True(t, limiter.allow(3, "10.0.0.2"))
+	require.Equal(t, 2, limiter.suppressed)
+
+	now = now.Add(time.Second)
+	require.True(t, limiter.allow(1, "10.0.0.1"))
+	require.False(t, limiter.allow(1, "10.0.0.1"))
+
+	// full buckets are forgotten
+	now = now.Add(time.Minute)
+	limiter.prune(now)
+	require.Empty(t, limiter.ruleBuckets)
+	require.Empty(t, limiter.clientIPBuckets)
+}
+
+func TestDebugTraceIsTriggered(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := debugTraceConfig{header: "x-coraza-debug", secret: "s3cr3t", sourceCIDRs: []*net.IPNet{cidr}}
+
+	require.True(t, cfg.isTriggered("s3cr3t", "10.1.2.3"))
+	require.False(t, cfg.isTriggered("s3cr3", "10.1.2.3"))
+	require.False(t, cfg.isTriggered("s3cr3t", "192.168.1.1"))
+	require.False(t, cfg.isTriggered("s3cr3t", ""))
+
+	cfg.secret = ""
+	require.True(t, cfg.isTriggered("anything", "10.1.2.3"))
+}
+
+func TestTickScheduler(t *testing.T) {
+	s := tickScheduler{}
+	require.Zero(t, s.tickPeriod())
+
+	var fastRuns, slowRuns int
+	s.schedule(0, func() { t.Fatal("disabled task must not run") })
+	s.schedule(10*time.Second, func() { slowRuns++ })
+	s.schedule(4*time.Second, func() { fastRuns++ })
+	require.Equal(t, 2*time.Second, s.tickPeriod())
+
+	for i := 0; i < 10; i++ {
+		s.tick()
+	}
+	require.Equal(t, 5, fastRuns)
+	require.Equal(t, 2, slowRuns)
+}
+
+func TestNormalizeHeaders(t *testing.T) {
+	headers := [][2]string{
+		{":method", "GET"},
+		{":path", "/hello"},
+		{":authority", "localhost"},
+		{"cookie", "a=1"},
+		{"accept", "*/*"},
+		{"cookie", "b=2"},
+		{"Cookie", "c=3"},
+	}
+	require.Equal(t, [][2]string{
+		{"cookie", "a=1; b=2; c=3"},
+		{"accept", "*/*"},
+	}, normalizeHeaders(headers))
+
+	require.Equal(t, [][2]string{{"content-type", "text/plain"}}, normalizeHeaders([][2]string{{":status", "200"}, {"content-type", "text/plain"}}))
+	require.Empty(t, normalizeHeaders(nil))
+}
+
+func TestIsGRPCContentType(t *testing.T) {
+	testCases := map[string]struct {
+		grpc    bool
+		webText bool
+	}{
+		"application/grpc":                      {grpc: true},
+		"application/grpc+proto":                {grpc: true},
+		"Application/GRPC; charset=utf-8":       {grpc: true},
+		"application/grpc-web":                  {grpc: true},
+		"application/grpc-web+proto":            {grpc: true},
+		"application/grpc-web-text":             {grpc: true, webText: true},
+		"application/grpc-web-text+proto":       {grpc: true, webText: true},
+		"application/grpcfoo":                   {},
+		"application/grpc-webfoo":               {},
+		"application/grpc-web-textual":          {},
+		"application/json":                      {},
+		"text/plain; boundary=application/grpc": {},
+	}
+
+	for contentType, tCase := range testCases {
+		t.Run(contentType, func(t *testing.T) {
+			require.Equal(t, tCase.grpc, isGRPCContentType(contentType))
+			require.Equal(t, tCase.webText, isGRPCWebTextContentType(contentType))
+		})
+	}
+}
+
+func TestClientIPResolve(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+
+	testCases := map[string]struct {
+		cfg        clientIPConfig
+		peerIP     string
+		values     []string
+		expectIP   string
+		expectPort int
+		expectOK   bool
+	}{
+		"closest untrusted address": {
+			cfg:      clientIPConfig{header: "x-forwarded-for", trustedProxies: []*net.IPNet{proxies}},
+			peerIP:   "10.0.0.1",
+			values:   []string{"203.0.113.7, 198.51.100.1", "10.0.0.2"},
+			expectIP: "198.51.100.1",
+			expectOK: true,
+		},
+		"all addresses trusted": {
+			cfg:      clientIPConfig{header: "x-forwarded-for", trustedProxies: []*net.IPNet{proxies}},
+			peerIP:   "10.0.0.1",
+			values:   []string{"10.0.0.3, 10.0.0.2"},
+			expectIP: "10.0.0.3",
+			expectOK: true,
+		},
+		"untrusted peer": {
+			cfg:    clientIPConfig{header: "x-forwarded-for", trustedProxies: []*net.IPNet{proxies}},
+			peerIP: "198.51.100.1",
+			values: []string{"203.0.113.7"},
+		},
+		"invalid address before the client": {
+			cfg:    clientIPConfig{header: "x-forwarded-for", trustedProxies: []*net.IPNet{proxies}},
+			peerIP: "10.0.0.1",
+			values: []string{"203.0.113.7, unknown"},
+		},
+		"trusted hops": {
+			// As with xff_num_trusted_hops: 1, the second rightmost address is the client.
+			cfg:        clientIPConfig{header: "x-forwarded-for", trustedHops: 1},
+			peerIP:     "192.0.2.1",
+			values:     []string{"198.51.100.1, 203.0.113.7:4711, 192.0.2.2"},
+			expectIP:   "203.0.113.7",
+			expectPort: 4711,
+			expectOK:   true,
+		},
+		"leftmost address after trusted hops": {
+			cfg:      clientIPConfig{header: "x-forwarded-for", trustedHops: 2},
+			peerIP:   "192.0.2.1",
+			values:   []string{"198.51.100.1, 203.0.113.7:4711", "192.0.2.2"},
+			expectIP: "198.51.100.1",
+			expectOK: true,
+		},
+		"as many addresses as trusted hops": {
+			cfg:    clientIPConfig{header: "x-forwarded-for", trustedHops: 2},
+			peerIP: "192.0.2.1",
+			values: []string{"203.0.113.7, 192.0.2.2"},
+		},
+		"forwarded": {
+			cfg:        clientIPConfig{header: "forwarded", trustedHops: 1},
+			peerIP:     "192.0.2.1",
+			values:     []string{`For="[2001:db8::1]:4711", for=198.51.100.1;proto=https`},
+			expectIP:   "2001:db8::1",
+			expectPort: 4711,
+			expectOK:   true,
+		},
+		"forwarded without for": {
+			cfg:    clientIPConfig{header: "forwarded", trustedHops: 1},
+			peerIP: "192.0.2.1",
+			values: []string{"proto=https, for=198.51.100.1"},
+		},
+	}
+
+	for name, tCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ip, port, ok := tCase.cfg.resolve(tCase.peerIP, tCase.values)
+			require.Equal(t, tCase.expectOK, ok)
+			require.Equal(t, tCase.expectIP, ip)
+			require.Equal(t, tCase.expectPort, port)
+		})
+	}
+}
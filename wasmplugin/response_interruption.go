@@ -0,0 +1,172 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+// responseBodyInterruptionStrategy tells how a response interrupted at the response body
+// phase is handled, its status and headers being possibly already sent downstream.
+type responseBodyInterruptionStrategy int8
+
+const (
+	// responseBodyInterruptionReplace replaces the response with a safe body and the interruption
+	// status. The response headers are held while the body is inspected, so that the status and
+	// the Content-Length can still be changed.
+	responseBodyInterruptionReplace responseBodyInterruptionStrategy = iota
+	// responseBodyInterruptionTruncate drops the response body, leaving the response headers
+	// untouched. Clients of fixed-length responses see an incomplete response.
+	responseBodyInterruptionTruncate
+	// responseBodyInterruptionAbort sends the interruption status instead of the response. The
+	// response headers are held while the body is inspected; if they were sent anyway, the proxy
+	// resets the stream.
+	responseBodyInterruptionAbort
+)
+
+// responseBodyInterruptionConfig configures the handling of the interruptions at the response
+// body phase. Without it, the response headers are not held and the buffered body of an
+// interrupted response is replaced with null bytes.
+type responseBodyInterruptionConfig struct {
+	strategy responseBodyInterruptionStrategy
+	// status overrides the interruption status of the replace strategy.
+	status      int
+	body        []byte
+	contentType string
+}
+
+func parseResponseBodyInterruptionStrategy(strategy string) (responseBodyInterruptionStrategy, error) {
+	switch strategy {
+	case "", "replace":
+		return responseBodyInterruptionReplace, nil
+	case "truncate":
+		return responseBodyInterruptionTruncate, nil
+	case "abort":
+		return responseBodyInterruptionAbort, nil
+	default:
+		return responseBodyInterruptionReplace, fmt.Errorf("unknown strategy: %q", strategy)
+	}
+}
+
+func parseResponseBodyInterruption(value gjson.Result) (*responseBodyInterruptionConfig, error) {
+	strategy, err := parseResponseBodyInterruptionStrategy(value.Get("strategy").String())
+	if err != nil {
+		return nil, err
+	}
+
+	config := &responseBodyInterruptionConfig{
+		strategy:    strategy,
+		status:      int(value.Get("status").Int()),
+		body:        []byte(value.Get("body").String()),
+		contentType: value.Get("content_type").String(),
+	}
+	if strategy != responseBodyInterruptionReplace && (config.status != 0 || len(config.body) > 0 || config.contentType != "") {
+		return nil, errors.New("status, body and content_type are only supported by the replace strategy")
+	}
+	if config.status != 0 && (config.status < 200 || config.status > 599) {
+		return nil, fmt.Errorf("status must be between 200 and 599: %d", config.status)
+	}
+	return config, nil
+}
+
+// holdsResponseHeaders tells whether the response headers are held while the response body
+// is inspected, so that they can still be changed if the response is interrupted. They are
+// only held if a strategy has been configured.
+func (c *responseBodyInterruptionConfig) holdsResponseHeaders() bool {
+	return c != nil && c.strategy != responseBodyInterruptionTruncate
+}
+
+// interruptResponseBody applies the configured strategy to a response interrupted at the
+// response body phase.
+func (ctx *httpContext) interruptResponseBody(statusCode int) types.Action {
+	if ctx.responseBodyInterruption == nil {
+		if ctx.settings.responseBodyStreaming != nil {
+			// The chunks already released can not be withdrawn, the remaining ones are dropped.
+			ctx.logger.Warn().Msg("Response body intervention occurred: body truncated")
+			return ctx.dropResponseBody()
+		}
+		return ctx.nullifyResponseBody()
+	}
+
+	switch ctx.responseBodyInterruption.strategy {
+	case responseBodyInterruptionAbort:
+		if err := ctx.sendInterruptionResponse(statusCode); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to abort the response")
+			return ctx.dropResponseBody()
+		}
+		ctx.logger.Warn().
+			Bool("response_headers_held", ctx.responseHeadersHeld).
+			Msg("Response body intervention occurred: response aborted")
+		return types.ActionPause
+	case responseBodyInterruptionTruncate:
+		ctx.logger.Warn().Msg("Response body intervention occurred: body truncated")
+		return ctx.dropResponseBody()
+	default:
+		if ctx.responseHeadersHeld {
+			if ctx.responseBodyInterruption.status != 0 {
+				statusCode = ctx.responseBodyInterruption.status
+			}
+			ctx.replaceSafeBodyHeaders(statusCode)
+		} else {
+			ctx.logger.Warn().Msg("Response headers already sent, the interruption status can not be set")
+		}
+		if err := proxywasm.ReplaceHttpResponseBody(ctx.responseBodyInterruption.body); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to replace response body")
+			return types.ActionContinue
+		}
+		ctx.logger.Warn().Msg("Response body intervention occurred: body replaced")
+		return types.ActionContinue
+	}
+}
+
+// replaceSafeBodyHeaders adapts the held response headers to the interruption status and the safe
+// body. Chunked responses, without Content-Length, are kept chunked. The safe body is not encoded,
+// even if the response was.
+func (ctx *httpContext) replaceSafeBodyHeaders(statusCode int) {
+	if _, err := proxywasm.GetHttpResponseHeader("content-encoding"); err == nil {
+		if err := proxywasm.RemoveHttpResponseHeader("content-encoding"); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to remove response header content-encoding")
+		}
+	}
+	headers := [][2]string{{":status", strconv.Itoa(statusCode)}}
+	if _, err := proxywasm.GetHttpResponseHeader("content-length"); err == nil {
+		headers = append(headers, [2]string{"content-length", strconv.Itoa(len(ctx.responseBodyInterruption.body))})
+	}
+	if contentType := ctx.responseBodyInterruption.contentType; contentType != "" {
+		headers = append(headers, [2]string{"content-type", contentType})
+	}
+	for _, h := range headers {
+		if err := proxywasm.ReplaceHttpResponseHeader(h[0], h[1]); err != nil {
+			ctx.logger.Error().Err(err).Str("header", h[0]).Msg("Failed to replace response header")
+		}
+	}
+}
+
+// dropResponseBody drops the response body data received after the response has been
+// interrupted, the safe body, if any, having already been sent.
+func (ctx *httpContext) dropResponseBody() types.Action {
+	if err := proxywasm.ReplaceHttpResponseBody(nil); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to drop response body")
+	}
+	return types.ActionContinue
+}
+
+// nullifyResponseBody replaces the buffered body of an interrupted response with null bytes,
+// when no strategy is configured. The response headers having already been sent, the status
+// can not be changed, but the length of fixed-length responses is kept.
+func (ctx *httpContext) nullifyResponseBody() types.Action {
+	if err := proxywasm.ReplaceHttpResponseBody(bytes.Repeat([]byte("\x00"), ctx.responseBodySize)); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to replace response body")
+		return types.ActionContinue
+	}
+	ctx.logger.Warn().Msg("Response body intervention occurred: body replaced")
+	return types.ActionContinue
+}
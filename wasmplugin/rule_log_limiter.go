@@ -0,0 +1,152 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// maxTrackedClientIPs bounds the number of client IPs tracked by the rule log limiter,
+// so that a scan from many sources can not exhaust the VM memory.
+const maxTrackedClientIPs = 10000
+
+// tokenBucketConfig configures a token bucket: burst tokens at most, refilled
+// at rate tokens per second.
+type tokenBucketConfig struct {
+	rate  float64
+	burst float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg tokenBucketConfig, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: cfg.burst, last: now}
+}
+
+func (b *tokenBucket) refill(cfg tokenBucketConfig, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * cfg.rate
+		if b.tokens > cfg.burst {
+			b.tokens = cfg.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) isFull(cfg tokenBucketConfig, now time.Time) bool {
+	b.refill(cfg, now)
+	return b.tokens >= cfg.burst
+}
+
+// ruleLogRateLimitConfig configures the rate limiting of the matched rule logs.
+// A nil bucket configuration disables the limiting for that key.
+type ruleLogRateLimitConfig struct {
+	perRule       *tokenBucketConfig
+	perClientIP   *tokenBucketConfig
+	summaryPeriod time.Duration
+}
+
+// ruleLogLimiter suppresses the logs of repeated rule matches using a token bucket per rule ID
+// and a token bucket per client IP. A log is emitted only when both buckets have a token available.
+type ruleLogLimiter struct {
+	cfg             ruleLogRateLimitConfig
+	ruleBuckets     map[int]*tokenBucket
+	clientIPBuckets map[string]*tokenBucket
+	suppressed      int
+	now             func() time.Time
+}
+
+func newRuleLogLimiter(cfg ruleLogRateLimitConfig) *ruleLogLimiter {
+	return &ruleLogLimiter{
+		cfg:             cfg,
+		ruleBuckets:     map[int]*tokenBucket{},
+		clientIPBuckets: map[string]*tokenBucket{},
+		now:             time.Now,
+	}
+}
+
+// allow reports whether the log of a match of the rule for the given client IP can be emitted,
+// consuming a token of each bucket if so.
+func (l *ruleLogLimiter) allow(ruleID int, clientIP string) bool {
+	now := l.now()
+
+	var ruleBucket, clientIPBucket *tokenBucket
+	if l.cfg.perRule != nil {
+		ruleBucket = l.ruleBucket(ruleID, now)
+		ruleBucket.refill(*l.cfg.perRule, now)
+	}
+	if l.cfg.perClientIP != nil {
+		clientIPBucket = l.clientIPBucket(clientIP, now)
+		if clientIPBucket != nil {
+			clientIPBucket.refill(*l.cfg.perClientIP, now)
+		}
+	}
+
+	if (ruleBucket != nil && ruleBucket.tokens < 1) || (clientIPBucket != nil && clientIPBucket.tokens < 1) {
+		l.suppressed++
+		return false
+	}
+
+	if ruleBucket != nil {
+		ruleBucket.tokens--
+	}
+	if clientIPBucket != nil {
+		clientIPBucket.tokens--
+	}
+	return true
+}
+
+func (l *ruleLogLimiter) ruleBucket(ruleID int, now time.Time) *tokenBucket {
+	b, ok := l.ruleBuckets[ruleID]
+	if !ok {
+		b = newTokenBucket(*l.cfg.perRule, now)
+		l.ruleBuckets[ruleID] = b
+	}
+	return b
+}
+
+// clientIPBucket returns the bucket of the client IP, or nil if the client IP can not be
+// tracked because too many client IPs are being tracked already.
+func (l *ruleLogLimiter) clientIPBucket(clientIP string, now time.Time) *tokenBucket {
+	b, ok := l.clientIPBuckets[clientIP]
+	if !ok {
+		if len(l.clientIPBuckets) >= maxTrackedClientIPs {
+			l.prune(now)
+			if len(l.clientIPBuckets) >= maxTrackedClientIPs {
+				return nil
+			}
+		}
+		b = newTokenBucket(*l.cfg.perClientIP, now)
+		l.clientIPBuckets[clientIP] = b
+	}
+	return b
+}
+
+// prune forgets the buckets that are full, as they are equivalent to new ones.
+func (l *ruleLogLimiter) prune(now time.Time) {
+	for ruleID, b := range l.ruleBuckets {
+		if b.isFull(*l.cfg.perRule, now) {
+			delete(l.ruleBuckets, ruleID)
+		}
+	}
+	for clientIP, b := range l.clientIPBuckets {
+		if b.isFull(*l.cfg.perClientIP, now) {
+			delete(l.clientIPBuckets, clientIP)
+		}
+	}
+}
+
+// logSuppressed logs a summary of the messages suppressed since the last call.
+func (l *ruleLogLimiter) logSuppressed() {
+	if l.suppressed > 0 {
+		proxywasm.LogWarnf("%d rule log messages suppressed by rate limiting", l.suppressed)
+		l.suppressed = 0
+	}
+	l.prune(l.now())
+}
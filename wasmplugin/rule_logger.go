@@ -0,0 +1,285 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/corazawaf/coraza/v3/debuglog"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/corazawaf/coraza/v3/types/variables"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
+	"github.com/corazawaf/coraza-proxy-wasm/internal/redact"
+)
+
+type ruleLogFormat int8
+
+const (
+	// ruleLogFormatText logs matched rules as ModSecurity-style error log lines.
+	ruleLogFormatText ruleLogFormat = iota
+	// ruleLogFormatJSON logs matched rules as JSON objects.
+	ruleLogFormatJSON
+)
+
+func parseRuleLogFormat(format string) (ruleLogFormat, error) {
+	switch format {
+	case "", "text":
+		return ruleLogFormatText, nil
+	case "json":
+		return ruleLogFormatJSON, nil
+	default:
+		return ruleLogFormatText, fmt.Errorf("unknown rule log format: %q", format)
+	}
+}
+
+// txLogContext holds the information about an in-flight transaction that is not
+// carried by the matched rules.
+type txLogContext struct {
+	authority  string
+	fields     []debuglog.ContextField
+	attributes []auditlog.Attribute
+	// inspectedPhase is the phase inspected by the chunk inspection transaction in progress, if
+	// any. The rules of the other phases have already been logged by the streamed transaction.
+	inspectedPhase ctypes.RulePhase
+	// lookBehind tells whether the look-behind of a chunk is being evaluated alone, its matched
+	// rules having been logged with the previous chunk.
+	lookBehind bool
+}
+
+// txLogContexts indexes the log context of the in-flight transactions by transaction ID.
+// Error callbacks are called synchronously while the transaction is being processed, hence
+// the context is registered when the transaction is created and removed once it is closed.
+type txLogContexts map[string]txLogContext
+
+// attributes returns the proxy attributes of the transaction, enriching its audit log.
+func (c txLogContexts) attributes(txID string) []auditlog.Attribute {
+	return c[txID].attributes
+}
+
+// defaultRuleLogLevels maps the severity of the matched rules to the level they are logged at.
+var defaultRuleLogLevels = map[ctypes.RuleSeverity]proxyLogLevel{
+	ctypes.RuleSeverityEmergency: proxyLogLevelCritical,
+	ctypes.RuleSeverityAlert:     proxyLogLevelCritical,
+	ctypes.RuleSeverityCritical:  proxyLogLevelCritical,
+	ctypes.RuleSeverityError:     proxyLogLevelError,
+	ctypes.RuleSeverityWarning:   proxyLogLevelWarn,
+	ctypes.RuleSeverityNotice:    proxyLogLevelInfo,
+	ctypes.RuleSeverityInfo:      proxyLogLevelInfo,
+	ctypes.RuleSeverityDebug:     proxyLogLevelDebug,
+}
+
+// ruleLogger logs the rules matched by the transactions of a WAF.
+type ruleLogger struct {
+	directivesName string
+	format         ruleLogFormat
+	levels         map[ctypes.RuleSeverity]proxyLogLevel
+	limiter        *ruleLogLimiter
+	redaction      *redact.Policy
+	txContexts     txLogContexts
+}
+
+// newRuleLogger creates a rule logger for the WAF of the given directives. Severities missing
+// in levels are logged at their default level, a nil limiter disables the rate limiting and a nil
+// redaction policy disables the redaction of the logs.
+func newRuleLogger(directivesName string, format ruleLogFormat, levels map[ctypes.RuleSeverity]proxyLogLevel,
+	limiter *ruleLogLimiter, redaction *redact.Policy, txContexts txLogContexts) *ruleLogger {
+	mergedLevels := make(map[ctypes.RuleSeverity]proxyLogLevel, len(defaultRuleLogLevels))
+	for severity, level := range defaultRuleLogLevels {
+		mergedLevels[severity] = level
+	}
+	for severity, level := range levels {
+		mergedLevels[severity] = level
+	}
+
+	return &ruleLogger{
+		directivesName: directivesName,
+		format:         format,
+		levels:         mergedLevels,
+		limiter:        limiter,
+		redaction:      redaction,
+		txContexts:     txContexts,
+	}
+}
+
+func (l *ruleLogger) logMatchedRule(mr ctypes.MatchedRule) {
+	if logContext := l.txContexts[mr.TransactionID()]; logContext.lookBehind ||
+		(logContext.inspectedPhase != 0 && mr.Rule().Phase() != logContext.inspectedPhase) {
+		return
+	}
+
+	level, ok := l.levels[mr.Rule().Severity()]
+	if !ok || level == proxyLogLevelOff {
+		return
+	}
+
+	if l.limiter != nil && !l.limiter.allow(mr.Rule().ID(), mr.ClientIPAddress()) {
+		return
+	}
+
+	// The redaction is a no-op when not configured.
+	redactor := func(s string) string { return s }
+	if l.redaction != nil {
+		sensitiveValues := l.sensitiveValues(mr)
+		redactor = func(s string) string { return l.redaction.String(s, sensitiveValues...) }
+	}
+
+	var msg string
+	switch l.format {
+	case ruleLogFormatJSON:
+		msg = l.formatJSON(mr, redactor)
+	default:
+		msg = redactor(mr.ErrorLog())
+	}
+	level.log(msg)
+}
+
+// sensitiveValues returns the values matched in sensitive headers and arguments, which are
+// redacted wherever they appear in the log.
+func (l *ruleLogger) sensitiveValues(mr ctypes.MatchedRule) []string {
+	var values []string
+	for _, md := range mr.MatchedDatas() {
+		if l.isSensitiveMatch(md) {
+			values = append(values, md.Value())
+		}
+	}
+	return values
+}
+
+func (l *ruleLogger) isSensitiveMatch(md ctypes.MatchData) bool {
+	if l.redaction == nil {
+		return false
+	}
+
+	switch md.Variable() {
+	case variables.RequestHeaders, variables.ResponseHeaders:
+		return l.redaction.IsSensitiveHeader(md.Key())
+	case variables.Args, variables.ArgsGet, variables.ArgsPost, variables.ArgsPath, variables.RequestCookies:
+		return l.redaction.IsSensitiveArg(md.Key())
+	default:
+		return false
+	}
+}
+
+func (l *ruleLogger) formatJSON(mr ctypes.MatchedRule, redactor func(string) string) string {
+	txCtx := l.txContexts[mr.TransactionID()]
+
+	e := newJSONLogEvent()
+	e.Int("rule_id", mr.Rule().ID())
+	e.Str("message", redactor(mr.Message()))
+	e.Str("severity", mr.Rule().Severity().String())
+	e.writeField("tags", mr.Rule().Tags())
+	e.Str("data", redactor(mr.Data()))
+
+	matchedData := make([]map[string]string, 0, len(mr.MatchedDatas()))
+	for _, md := range mr.MatchedDatas() {
+		value := redactor(md.Value())
+		if l.isSensitiveMatch(md) {
+			value = l.redaction.Replacement()
+		}
+		matchedData = append(matchedData, map[string]string{
+			"variable": md.Variable().Name(),
+			"key":      md.Key(),
+			"value":    value,
+		})
+	}
+	e.writeField("matched_data", matchedData)
+	e.Str("uri", redactor(mr.URI()))
+	e.Str("client_ip", mr.ClientIPAddress())
+	e.Str("authority", txCtx.authority)
+	e.Str("directives", l.directivesName)
+	e.Str("transaction_id", mr.TransactionID())
+	for _, field := range txCtx.fields {
+		field(e)
+	}
+	return e.String()
+}
+
+// jsonLogEvent is a debuglog.Event that renders its fields as a JSON object, so that
+// debuglog.ContextField can be reused to enrich the JSON logs. Fields are written in the
+// order they are added and only the first occurrence of a key is kept.
+type jsonLogEvent struct {
+	buf  bytes.Buffer
+	keys map[string]struct{}
+}
+
+var _ debuglog.Event = (*jsonLogEvent)(nil)
+
+func newJSONLogEvent() *jsonLogEvent {
+	e := &jsonLogEvent{keys: map[string]struct{}{}}
+	e.buf.WriteByte('{')
+	return e
+}
+
+func (e *jsonLogEvent) writeField(key string, val interface{}) {
+	if _, ok := e.keys[key]; ok {
+		return
+	}
+
+	rawKey, err := json.Marshal(key)
+	if err != nil {
+		return
+	}
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return
+	}
+
+	e.keys[key] = struct{}{}
+	if len(e.keys) > 1 {
+		e.buf.WriteByte(',')
+	}
+	e.buf.Write(rawKey)
+	e.buf.WriteByte(':')
+	e.buf.Write(raw)
+}
+
+func (e *jsonLogEvent) Msg(msg string) {
+	e.writeField("msg", msg)
+}
+
+func (e *jsonLogEvent) Str(key, val string) debuglog.Event {
+	e.writeField(key, val)
+	return e
+}
+
+func (e *jsonLogEvent) Err(err error) debuglog.Event {
+	if err != nil {
+		e.writeField("error", err.Error())
+	}
+	return e
+}
+
+func (e *jsonLogEvent) Bool(key string, b bool) debuglog.Event {
+	e.writeField(key, b)
+	return e
+}
+
+func (e *jsonLogEvent) Int(key string, i int) debuglog.Event {
+	e.writeField(key, i)
+	return e
+}
+
+func (e *jsonLogEvent) Uint(key string, i uint) debuglog.Event {
+	e.writeField(key, i)
+	return e
+}
+
+func (e *jsonLogEvent) Stringer(key string, val fmt.Stringer) debuglog.Event {
+	if val != nil {
+		e.writeField(key, val.String())
+	}
+	return e
+}
+
+func (e *jsonLogEvent) IsEnabled() bool {
+	return true
+}
+
+// String returns the JSON object built so far.
+func (e *jsonLogEvent) String() string {
+	return e.buf.String() + "}"
+}
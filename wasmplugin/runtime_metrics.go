@@ -0,0 +1,64 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// runtimeMetricsLeaseKey is the shared data key of the lease held by the VM publishing the runtime gauges.
+const runtimeMetricsLeaseKey = "coraza.runtime_metrics.publisher"
+
+// runtimeMetricsPublisher elects the VM publishing the runtime gauges. The proxy runs a VM per
+// worker, all of them sharing the gauges: if each VM reported its own heap, the gauges would
+// reflect whichever VM reported last, and concurrent updates could be lost. The elected VM holds
+// a lease in the shared data, renewed on each refresh, another VM taking over once it expired,
+// e.g. after a configuration reload.
+type runtimeMetricsPublisher struct {
+	id  string
+	ttl time.Duration
+	now func() time.Time
+}
+
+func newRuntimeMetricsPublisher(period time.Duration) *runtimeMetricsPublisher {
+	if period <= 0 {
+		// The gauges are only recorded at startup, the lease is kept for the default period.
+		period = defaultRuntimeMetricsPeriod
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &runtimeMetricsPublisher{
+		id:  hex.EncodeToString(id),
+		ttl: 3 * period,
+		now: time.Now,
+	}
+}
+
+// elected tells whether this VM publishes the runtime gauges, acquiring or renewing the lease.
+func (p *runtimeMetricsPublisher) elected() bool {
+	lease, cas, err := proxywasm.GetSharedData(runtimeMetricsLeaseKey)
+	if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+		return false
+	}
+
+	now := p.now()
+	if holder, expiry, ok := strings.Cut(string(lease), " "); ok && holder != p.id {
+		if expiresAt, err := strconv.ParseInt(expiry, 10, 64); err == nil && now.UnixNano() < expiresAt {
+			return false
+		}
+	}
+
+	// The CAS fails if another VM updated the lease in the meantime.
+	lease = []byte(fmt.Sprintf("%s %d", p.id, now.Add(p.ttl).UnixNano()))
+	return proxywasm.SetSharedData(runtimeMetricsLeaseKey, lease, cas) == nil
+}
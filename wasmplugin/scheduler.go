@@ -0,0 +1,66 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"time"
+)
+
+// tickScheduler runs periodic tasks driven by the ticks of the plugin context. proxy-wasm
+// supports a single tick period per plugin context, hence the tick period is the greatest
+// common divisor of the periods of the scheduled tasks.
+type tickScheduler struct {
+	tasks []*scheduledTask
+}
+
+type scheduledTask struct {
+	period     time.Duration
+	everyTicks int
+	ticks      int
+	run        func()
+}
+
+// schedule registers a task to be run every period. Non-positive periods are ignored.
+func (s *tickScheduler) schedule(period time.Duration, run func()) {
+	if period <= 0 {
+		return
+	}
+	s.tasks = append(s.tasks, &scheduledTask{period: period, run: run})
+
+	tickPeriod := s.tickPeriod()
+	for _, t := range s.tasks {
+		t.everyTicks = int(t.period / tickPeriod)
+		t.ticks = 0
+	}
+}
+
+// tickPeriod returns the period at which tick has to be called, zero if there is nothing scheduled.
+func (s *tickScheduler) tickPeriod() time.Duration {
+	var period time.Duration
+	for _, t := range s.tasks {
+		period = gcd(period, t.period.Truncate(time.Millisecond))
+	}
+	if period == 0 && len(s.tasks) > 0 {
+		// periods shorter than a millisecond are not supported by proxy-wasm.
+		return time.Millisecond
+	}
+	return period
+}
+
+func (s *tickScheduler) tick() {
+	for _, t := range s.tasks {
+		t.ticks++
+		if t.ticks >= t.everyTicks {
+			t.ticks = 0
+			t.run()
+		}
+	}
+}
+
+func gcd(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
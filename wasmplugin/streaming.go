@@ -0,0 +1,431 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+// defaultStreamingLookBehind is the default number of bytes of the previous chunk inspected
+// again with the next one, so that the patterns crossing the chunk boundaries are matched.
+const defaultStreamingLookBehind = 1024
+
+// maxPendingArgumentSize is the size above which an urlencoded argument not completed by the
+// chunk is inspected in parts, instead of being kept until the next chunk.
+const maxPendingArgumentSize = 64 * 1024
+
+// bodyStreamingConfig configures the inspection of the bodies chunk by chunk, each chunk
+// being released as soon as it has been inspected instead of buffering the whole body.
+type bodyStreamingConfig struct {
+	lookBehind int
+}
+
+func parseBodyStreaming(value gjson.Result) (*bodyStreamingConfig, error) {
+	config := &bodyStreamingConfig{lookBehind: defaultStreamingLookBehind}
+	if lookBehind := value.Get("look_behind"); lookBehind.Exists() {
+		config.lookBehind = int(lookBehind.Int())
+	}
+	if config.lookBehind < 0 {
+		return nil, errors.New("look_behind must not be negative")
+	}
+	return config, nil
+}
+
+// chunkInspection holds the state of the inspection of a body chunk by chunk.
+type chunkInspection struct {
+	lookBehind []byte
+	// released is the number of bytes released so far.
+	released int
+}
+
+// window returns the data to inspect, the chunk preceded by the look-behind of the previous one,
+// along with the length of the look-behind.
+func (c *chunkInspection) window(chunk []byte, cfg *bodyStreamingConfig) ([]byte, int) {
+	if len(chunk) == 0 {
+		return nil, 0
+	}
+	lookBehind := len(c.lookBehind)
+	window := append(append([]byte{}, c.lookBehind...), chunk...)
+	if len(window) > cfg.lookBehind {
+		c.lookBehind = window[len(window)-cfg.lookBehind:]
+	} else {
+		c.lookBehind = window
+	}
+	return window, lookBehind
+}
+
+// urlencodedArgs splits an urlencoded body streamed chunk by chunk into its arguments, the
+// trailing argument of a chunk being kept until the next one completes it.
+type urlencodedArgs struct {
+	pending []byte
+}
+
+// parse returns the arguments completed by the chunk, including the trailing one at the end of
+// the stream.
+func (a *urlencodedArgs) parse(chunk []byte, endOfStream bool) [][2]string {
+	data := append(a.pending, chunk...)
+	end := bytes.LastIndexByte(data, '&')
+	if endOfStream || len(data)-end-1 > maxPendingArgumentSize {
+		end = len(data)
+	}
+	if end < 0 {
+		a.pending = data
+		return nil
+	}
+	a.pending = append([]byte{}, data[min(end+1, len(data)):]...)
+
+	var args [][2]string
+	for _, pair := range bytes.Split(data[:end], []byte("&")) {
+		if len(pair) == 0 {
+			continue
+		}
+		key, value, _ := bytes.Cut(pair, []byte("="))
+		args = append(args, [2]string{queryUnescape(key), queryUnescape(value)})
+	}
+	return args
+}
+
+// queryUnescape decodes an urlencoded key or value, kept as is if it is not valid.
+func queryUnescape(data []byte) string {
+	if s, err := url.QueryUnescape(string(data)); err == nil {
+		return s
+	}
+	return string(data)
+}
+
+// inspectionRequest holds the request line and headers replayed by the inspection transactions.
+type inspectionRequest struct {
+	uri     string
+	method  string
+	headers [][2]string
+}
+
+// inspectChunk evaluates the rules of the given body phase against a window of the body, made
+// of the look-behind of the previous chunk followed by the chunk.
+//
+// Coraza evaluates the rules of a phase once per transaction, hence each chunk is inspected by
+// its own transaction sharing the ID of the streamed one. The request headers phase is replayed,
+// so that the actions it triggers (e.g. the rule exclusions) apply to the chunk, then the TX
+// variables (e.g. paranoia level, anomaly scores) are copied from the streamed transaction before
+// the body phase is evaluated, and back once evaluated, so that the scores accumulate across the
+// chunks. The arguments completed by an urlencoded chunk are added to its ARGS_POST. The interruptions raised by the replayed phases have already
+// been enforced by the streamed transaction and are ignored, as are their matched rules, which are
+// not logged again (see ruleLogger).
+//
+// The look-behind has already been scored with the previous chunk: it is evaluated alone first,
+// and the scores it adds are deducted from the TX variables of the window before its evaluation,
+// so that only the matches reaching into the chunk add up.
+//
+// The matched rules of a transaction can not be added to another one, hence the chunks matching
+// body rules get their own audit log entry, explaining the interruption of the streamed transaction.
+func (ctx *httpContext) inspectChunk(phase ctypes.RulePhase, window []byte, lookBehind int, args [][2]string) (*ctypes.Interruption, error) {
+	var scored map[string]int
+	if lookBehind > 0 {
+		var err error
+		if scored, err = ctx.scoreLookBehind(phase, window[:lookBehind]); err != nil {
+			return nil, err
+		}
+	}
+
+	itx := ctx.waf.NewTransactionWithID(ctx.tx.ID())
+	ctx.setInspectedPhase(phase)
+
+	interruption, err := ctx.evaluateChunk(itx, phase, window, args, scored, true)
+	if interruption != nil || hasMatchedPhase(itx.MatchedRules(), phase) {
+		// The logging phase rules, matched again, are not logged either.
+		itx.ProcessLogging()
+	}
+
+	ctx.setInspectedPhase(0)
+	if err := itx.Close(); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to close inspection transaction")
+	}
+	return interruption, err
+}
+
+// scoreLookBehind evaluates the look-behind of a chunk alone, returning the scores it adds to
+// the integer TX variables. Neither its interruption nor its matched rules are reported.
+func (ctx *httpContext) scoreLookBehind(phase ctypes.RulePhase, lookBehind []byte) (map[string]int, error) {
+	itx := ctx.waf.NewTransactionWithID(ctx.tx.ID())
+	ctx.setLookBehindInspection(true)
+	defer func() {
+		ctx.setLookBehindInspection(false)
+		if err := itx.Close(); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to close look-behind inspection transaction")
+		}
+	}()
+
+	if _, err := ctx.evaluateChunk(itx, phase, lookBehind, nil, nil, false); err != nil {
+		return nil, err
+	}
+	state := ctx.tx.(plugintypes.TransactionState)
+	itxState := itx.(plugintypes.TransactionState)
+	return addedTXScores(state.Variables(), itxState.Variables()), nil
+}
+
+// evaluateChunk evaluates the phases of the inspection transaction of a chunk. The scores
+// already added by the look-behind are deducted from the TX variables copied from the streamed
+// transaction, to which they are copied back once evaluated if commit is set.
+func (ctx *httpContext) evaluateChunk(itx ctypes.Transaction, phase ctypes.RulePhase, window []byte, args [][2]string, scored map[string]int, commit bool) (*ctypes.Interruption, error) {
+	state, ok := ctx.tx.(plugintypes.TransactionState)
+	if !ok {
+		return nil, errors.New("transaction state not available")
+	}
+	itxState, ok := itx.(plugintypes.TransactionState)
+	if !ok {
+		return nil, errors.New("inspection transaction state not available")
+	}
+	vars := state.Variables()
+
+	remotePort, _ := strconv.Atoi(vars.RemotePort().Get())
+	serverPort, _ := strconv.Atoi(vars.ServerPort().Get())
+	itx.ProcessConnection(vars.RemoteAddr().Get(), remotePort, vars.ServerAddr().Get(), serverPort)
+	itx.ProcessURI(ctx.inspectionRequest.uri, ctx.inspectionRequest.method, ctx.httpProtocol)
+	for _, h := range ctx.inspectionRequest.headers {
+		itx.AddRequestHeader(h[0], h[1])
+	}
+	if interruption := itx.ProcessRequestHeaders(); interruption != nil {
+		ctx.logger.Debug().Int("rule_id", interruption.RuleID).Msg("Ignoring request headers interruption of the chunk inspection")
+		return nil, nil
+	}
+
+	switch phase {
+	case ctypes.PhaseRequestBody:
+		// The chunks are not valid documents on their own, they are inspected as raw data (REQUEST_BODY),
+		// the urlencoded arguments being parsed across the chunks.
+		setSingle(itxState.Variables().RequestBodyProcessor(), "RAW")
+		copyTXVariables(itxState.Variables(), vars)
+		deductTXScores(itxState.Variables(), scored)
+		if commit {
+			defer copyTXVariables(vars, itxState.Variables())
+		}
+		for _, arg := range args {
+			itx.AddPostRequestArgument(arg[0], arg[1])
+		}
+		interruption, _, err := itx.WriteRequestBody(window)
+		if err != nil || interruption != nil {
+			return interruption, err
+		}
+		return itx.ProcessRequestBody()
+	case ctypes.PhaseResponseBody:
+		for _, h := range ctx.responseHeaders {
+			itx.AddResponseHeader(h[0], h[1])
+		}
+		if interruption := itx.ProcessResponseHeaders(ctx.responseStatus, ctx.httpProtocol); interruption != nil {
+			ctx.logger.Debug().Int("rule_id", interruption.RuleID).Msg("Ignoring response headers interruption of the chunk inspection")
+			return nil, nil
+		}
+		copyTXVariables(itxState.Variables(), vars)
+		deductTXScores(itxState.Variables(), scored)
+		if commit {
+			defer copyTXVariables(vars, itxState.Variables())
+		}
+		interruption, _, err := itx.WriteResponseBody(window)
+		if err != nil || interruption != nil {
+			return interruption, err
+		}
+		return itx.ProcessResponseBody()
+	default:
+		return nil, fmt.Errorf("unsupported inspection phase %d", phase)
+	}
+}
+
+// hasMatchedPhase tells whether rules of the given phase have been matched.
+func hasMatchedPhase(matchedRules []ctypes.MatchedRule, phase ctypes.RulePhase) bool {
+	for _, mr := range matchedRules {
+		if mr.Rule().Phase() == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// copyTXVariables replaces the TX variables of a transaction with the ones of another.
+func copyTXVariables(to, from plugintypes.TransactionVariables) {
+	txVars := to.TX()
+	for _, md := range txVars.FindAll() {
+		txVars.Remove(md.Key())
+	}
+	for _, md := range from.TX().FindAll() {
+		txVars.Add(md.Key(), md.Value())
+	}
+}
+
+// addedTXScores returns the scores added to the integer TX variables of a transaction compared to
+// the ones of another.
+func addedTXScores(from, to plugintypes.TransactionVariables) map[string]int {
+	scores := map[string]int{}
+	for _, md := range to.TX().FindAll() {
+		value, err := strconv.Atoi(md.Value())
+		if err != nil {
+			continue
+		}
+		if previous := from.TX().Get(md.Key()); len(previous) > 0 {
+			if previousValue, err := strconv.Atoi(previous[0]); err == nil {
+				value -= previousValue
+			}
+		}
+		if value != 0 {
+			scores[md.Key()] = value
+		}
+	}
+	return scores
+}
+
+// deductTXScores deducts scores from the integer TX variables of a transaction.
+func deductTXScores(vars plugintypes.TransactionVariables, scores map[string]int) {
+	txVars := vars.TX()
+	for key, score := range scores {
+		value := 0
+		if current := txVars.Get(key); len(current) > 0 {
+			value, _ = strconv.Atoi(current[0])
+		}
+		txVars.Set(key, []string{strconv.Itoa(value - score)})
+	}
+}
+
+func (ctx *httpContext) setLookBehindInspection(lookBehind bool) {
+	logContext := ctx.txLogContexts[ctx.tx.ID()]
+	logContext.lookBehind = lookBehind
+	ctx.txLogContexts[ctx.tx.ID()] = logContext
+}
+
+func (ctx *httpContext) setInspectedPhase(phase ctypes.RulePhase) {
+	logContext := ctx.txLogContexts[ctx.tx.ID()]
+	logContext.inspectedPhase = phase
+	ctx.txLogContexts[ctx.tx.ID()] = logContext
+}
+
+// streamRequestBody inspects the request body chunk received, releasing it upstream if no
+// interruption occurred.
+func (ctx *httpContext) streamRequestBody(bodySize int, endOfStream bool) types.Action {
+	// The chunks are released as they are inspected, the proxy buffer only holds the last one.
+	// The trailing urlencoded argument is inspected at the end of the stream, even without data.
+	if bodySize > 0 || (endOfStream && len(ctx.requestArgs.pending) > 0) {
+		var chunk []byte
+		if bodySize > 0 {
+			var err error
+			if chunk, err = proxywasm.GetHttpRequestBody(0, bodySize); err != nil {
+				ctx.logger.Error().Err(err).Int("body_size", bodySize).Msg("Failed to read request body")
+				return types.ActionContinue
+			}
+		}
+		ctx.metrics.CountRequestBodyInspectedBytes(len(chunk), ctx.metricLabelsKV)
+		ctx.metrics.CountRequestBodyInspectedChunk(ctx.metricLabelsKV)
+
+		var args [][2]string
+		if state, ok := ctx.tx.(plugintypes.TransactionState); ok && state.Variables().RequestBodyProcessor().Get() == "URLENCODED" {
+			args = ctx.requestArgs.parse(chunk, endOfStream)
+		}
+		window, lookBehind := ctx.requestChunks.window(chunk, ctx.settings.requestBodyStreaming)
+		interruption, err := ctx.inspectChunk(ctypes.PhaseRequestBody, window, lookBehind, args)
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to inspect request body chunk")
+			return types.ActionContinue
+		}
+		if interruption != nil {
+			return ctx.interruptStreamedRequest(interruption)
+		}
+		ctx.requestChunks.released += len(chunk)
+	}
+
+	if endOfStream && !ctx.processedRequestBody {
+		// The request body phase of the streamed transaction evaluates the rules not bound to the body,
+		// e.g. the inbound anomaly score evaluation.
+		ctx.processedRequestBody = true
+		interruption, err := ctx.tx.ProcessRequestBody()
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to process request body")
+			return types.ActionContinue
+		}
+		if interruption != nil {
+			return ctx.interruptStreamedRequest(interruption)
+		}
+		ctx.publishVerdict()
+	}
+	return types.ActionContinue
+}
+
+// interruptStreamedRequest enforces an interruption raised while streaming the request body.
+// The chunks already released have reached the upstream, which is logged and counted. Once the
+// response has started, the interruption can not be enforced anymore.
+func (ctx *httpContext) interruptStreamedRequest(interruption *ctypes.Interruption) types.Action {
+	if state, ok := ctx.tx.(plugintypes.TransactionState); ok {
+		// Reflects the interruption of the chunk inspection in the audit log of the streamed transaction.
+		state.Interrupt(interruption)
+	}
+
+	if ctx.responseStarted {
+		ctx.metrics.CountUnenforcedRequestBodyInterruption(ctx.metricLabelsKV)
+		ctx.logger.Error().
+			Int("rule_id", interruption.RuleID).
+			Int("released_bytes", ctx.requestChunks.released).
+			Msg("Request body interruption not enforced, the response has already started")
+		return types.ActionContinue
+	}
+
+	if ctx.requestChunks.released > 0 {
+		ctx.metrics.CountLateRequestBodyInterruption(ctx.metricLabelsKV)
+		ctx.logger.Warn().
+			Int("rule_id", interruption.RuleID).
+			Int("released_bytes", ctx.requestChunks.released).
+			Msg("Request body interrupted after being partially released upstream")
+	}
+	return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+}
+
+// streamResponseBody inspects the response body chunk received, releasing it downstream if no
+// interruption occurred. Unlike the buffered inspection, the chunks previously released can not
+// be withdrawn if a later one is interrupted.
+func (ctx *httpContext) streamResponseBody(bodySize int, endOfStream bool) types.Action {
+	// The chunks are released as they are inspected, the proxy buffer only holds the last one.
+	if bodySize > 0 {
+		chunk, err := proxywasm.GetHttpResponseBody(0, bodySize)
+		if err != nil {
+			ctx.logger.Error().Err(err).Int("body_size", bodySize).Msg("Failed to read response body")
+			return types.ActionContinue
+		}
+		ctx.metrics.CountResponseBodyInspectedBytes(len(chunk), ctx.metricLabelsKV)
+		ctx.metrics.CountResponseBodyInspectedChunk(ctx.metricLabelsKV)
+
+		window, lookBehind := ctx.responseChunks.window(chunk, ctx.settings.responseBodyStreaming)
+		interruption, err := ctx.inspectChunk(ctypes.PhaseResponseBody, window, lookBehind, nil)
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to inspect response body chunk")
+			return types.ActionContinue
+		}
+		if interruption != nil {
+			if state, ok := ctx.tx.(plugintypes.TransactionState); ok {
+				// Reflects the interruption in the audit log of the streamed transaction.
+				state.Interrupt(interruption)
+			}
+			return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+		}
+		ctx.responseChunks.released += len(chunk)
+	}
+
+	if endOfStream {
+		// The response body phase of the streamed transaction evaluates the rules not bound to the body.
+		ctx.processedResponseBody = true
+		interruption, err := ctx.tx.ProcessResponseBody()
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to process response body")
+			return types.ActionContinue
+		}
+		if interruption != nil {
+			return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+		}
+	}
+	return types.ActionContinue
+}
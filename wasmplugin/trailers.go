@@ -0,0 +1,54 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// The TX variables listing the names of the trailers, so that the rules can tell them apart
+// from the headers, e.g. to detect the headers smuggled as trailers.
+const (
+	requestTrailerNamesVariable  = "request_trailer_names"
+	responseTrailerNamesVariable = "response_trailer_names"
+)
+
+// addRequestTrailers exposes the request trailers to the request body phase rules, as
+// additional REQUEST_HEADERS.
+func (ctx *httpContext) addRequestTrailers() {
+	trailers, err := proxywasm.GetHttpRequestTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get request trailers")
+		return
+	}
+	for _, t := range trailers {
+		ctx.tx.AddRequestHeader(t[0], t[1])
+	}
+	ctx.addTrailerNames(requestTrailerNamesVariable, trailers)
+}
+
+// addResponseTrailers exposes the response trailers to the response body phase rules, as
+// additional RESPONSE_HEADERS.
+func (ctx *httpContext) addResponseTrailers() {
+	trailers, err := proxywasm.GetHttpResponseTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get response trailers")
+		return
+	}
+	for _, t := range trailers {
+		ctx.tx.AddResponseHeader(t[0], t[1])
+	}
+	ctx.addTrailerNames(responseTrailerNamesVariable, trailers)
+}
+
+func (ctx *httpContext) addTrailerNames(variable string, trailers [][2]string) {
+	state, ok := ctx.tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	for _, t := range trailers {
+		state.Variables().TX().Add(variable, t[0])
+	}
+}
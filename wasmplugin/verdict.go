@@ -0,0 +1,110 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// verdict is the compact outcome of a transaction published to the proxy, so that access logs
+// and the following filters can use it.
+type verdict struct {
+	TransactionID        string `json:"tx_id"`
+	Interrupted          bool   `json:"interrupted"`
+	Phase                string `json:"phase,omitempty"`
+	RuleID               int    `json:"rule_id,omitempty"`
+	Action               string `json:"action,omitempty"`
+	Status               int    `json:"status,omitempty"`
+	MatchedRules         []int  `json:"matched_rules,omitempty"`
+	InboundAnomalyScore  *int   `json:"inbound_anomaly_score,omitempty"`
+	OutboundAnomalyScore *int   `json:"outbound_anomaly_score,omitempty"`
+}
+
+// Variables holding the anomaly scores, the CRS 4 ones first, then the CRS 3 ones.
+var (
+	inboundAnomalyScoreVars  = []string{"blocking_inbound_anomaly_score", "inbound_anomaly_score"}
+	outboundAnomalyScoreVars = []string{"blocking_outbound_anomaly_score", "outbound_anomaly_score"}
+)
+
+// loggedRule is implemented by the matched rules telling whether they are logged, rules
+// matched with nolog (e.g. the CRS initialization rules) not being part of the verdict.
+type loggedRule interface {
+	Log() bool
+}
+
+func newVerdict(tx ctypes.Transaction, phase interruptionPhase) verdict {
+	v := verdict{
+		TransactionID: tx.ID(),
+		Interrupted:   tx.IsInterrupted(),
+	}
+
+	if phase.isInterrupted() {
+		v.Phase = phase.String()
+	}
+	if interruption := tx.Interruption(); interruption != nil {
+		v.RuleID = interruption.RuleID
+		v.Action = interruption.Action
+		v.Status = interruption.Status
+	}
+
+	v.MatchedRules = loggedRuleIDs(tx)
+	v.InboundAnomalyScore = anomalyScore(tx, inboundAnomalyScoreVars)
+	v.OutboundAnomalyScore = anomalyScore(tx, outboundAnomalyScoreVars)
+	return v
+}
+
+// loggedRuleIDs returns the IDs of the logged rules matched so far.
+func loggedRuleIDs(tx ctypes.Transaction) []int {
+	var ids []int
+	for _, mr := range tx.MatchedRules() {
+		if lr, ok := mr.(loggedRule); ok && !lr.Log() {
+			continue
+		}
+		ids = append(ids, mr.Rule().ID())
+	}
+	return ids
+}
+
+// anomalyScore returns the value of the first of the given TX variables holding a score,
+// nil if none does.
+func anomalyScore(tx ctypes.Transaction, names []string) *int {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return nil
+	}
+	txVars := state.Variables().TX()
+	for _, name := range names {
+		values := txVars.Get(name)
+		if len(values) == 0 {
+			continue
+		}
+		if score, err := strconv.Atoi(values[0]); err == nil {
+			return &score
+		}
+	}
+	return nil
+}
+
+// publishVerdict writes the verdict of the transaction so far into the configured filter
+// state property. It is published once the request has been inspected, for the following
+// filters, and updated once the transaction is done, for the access logs.
+func (ctx *httpContext) publishVerdict() {
+	if ctx.verdictProperty == "" || ctx.tx == nil {
+		return
+	}
+
+	raw, err := json.Marshal(newVerdict(ctx.tx, ctx.interruptedAt))
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to marshal the verdict")
+		return
+	}
+	if err := proxywasm.SetProperty([]string{ctx.verdictProperty}, raw); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to publish the verdict")
+	}
+}